@@ -3,7 +3,6 @@ package main
 import (
 	"connauth/utils"
 	"connauth/utils/authproto"
-	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
@@ -11,14 +10,51 @@ import (
 	"time"
 )
 
-func auth(server *serverConfig, req *utils.AuthConfig) error {
-	dest, err := net.ResolveUDPAddr("udp", server.Addr)
+// how long to wait for each reply of the server
+var replyTimeout = 5 * time.Second
+
+func auth(server *serverConfig, req *utils.AuthConfig) (authproto.AuthResult, error) {
+	result, _, err := authAnyAddr(server, req)
+	return result, err
+}
+
+// authAnyAddr tries addr and then the altaddrs of server in order until one
+// of them answers, and returns the address that answered. A denial is an
+// answer, the next address is only tried when the handshake fails.
+func authAnyAddr(server *serverConfig, req *utils.AuthConfig) (authproto.AuthResult, string, error) {
+	// the code is read before the challenge, a prompt may take longer than
+	// the challenge lives
+	var otpCode string
+	if req.OTP != nil {
+		code, err := req.OTP()
+		if err != nil {
+			return authproto.AuthResult{}, "", err
+		}
+		otpCode = code
+	}
+	var result authproto.AuthResult
+	var err error
+	for _, addr := range server.addrs() {
+		result, err = authAddr(server, addr, req, otpCode)
+		if err == nil || result.Result != "" {
+			return result, addr, err
+		}
+		if len(server.AltAddrs) > 0 {
+			log.Debugf("auth to %s failed, try next address: %v", addr, err)
+		}
+	}
+	return result, "", err
+}
+
+// authAddr runs one handshake with the server at addr
+func authAddr(server *serverConfig, addr string, req *utils.AuthConfig, otpCode string) (authproto.AuthResult, error) {
+	dest, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return fmt.Errorf("cannot resolve address %s: %v", server.Addr, err)
+		return authproto.AuthResult{}, fmt.Errorf("cannot resolve address %s: %v", addr, err)
 	}
 	conn, err := net.DialUDP("udp", nil, dest)
 	if err != nil {
-		return fmt.Errorf("dial to %s fail: %v", server.Addr, err)
+		return authproto.AuthResult{}, fmt.Errorf("dial to %s fail: %v", addr, err)
 	}
 	defer func() {
 		_ = conn.Close()
@@ -26,7 +62,7 @@ func auth(server *serverConfig, req *utils.AuthConfig) error {
 
 	clientNonce, err := authproto.RandomNonceString()
 	if err != nil {
-		return fmt.Errorf("generate client nonce failed: %v", err)
+		return authproto.AuthResult{}, fmt.Errorf("generate client nonce failed: %v", err)
 	}
 	challengeReq := authproto.ChallengeRequest{
 		Type:        authproto.MessageTypeChallengeRequest,
@@ -36,28 +72,32 @@ func auth(server *serverConfig, req *utils.AuthConfig) error {
 		ClientNonce: clientNonce,
 		Timestamp:   time.Now().Unix(),
 	}
-	buf, err := sealMessage(server, challengeReq)
+	channel, err := newAuthChannel(server)
+	if err != nil {
+		return authproto.AuthResult{}, err
+	}
+	buf, err := channel.seal(challengeReq)
 	if err != nil {
-		return fmt.Errorf("build challenge request failed: %v", err)
+		return authproto.AuthResult{}, fmt.Errorf("build challenge request failed: %v", err)
 	}
 	if _, err := conn.Write(buf); err != nil {
-		return fmt.Errorf("write challenge request failed: %v", err)
+		return authproto.AuthResult{}, fmt.Errorf("write challenge request failed: %v", err)
 	}
-	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
 	respBuf := make([]byte, authproto.MaxPacketSize)
 	n, err := conn.Read(respBuf)
 	if err != nil {
-		return fmt.Errorf("read challenge failed: %v; check server reachability and system time sync", err)
+		return authproto.AuthResult{}, fmt.Errorf("read challenge failed: %v; check server reachability and system time sync", err)
 	}
-	challenge, err := openChallenge(server, respBuf[:n])
+	challenge, err := openChallenge(channel, respBuf[:n])
 	if err != nil {
-		return fmt.Errorf("challenge validation failed: %v; check system time sync", err)
+		return authproto.AuthResult{}, fmt.Errorf("challenge validation failed: %v; check system time sync", err)
 	}
 	if challenge.ServerID != server.ServerID ||
 		challenge.ClientID != globalConfig.ClientID ||
 		challenge.Port != req.Port ||
 		challenge.ClientNonce != clientNonce {
-		return fmt.Errorf("challenge binding mismatch")
+		return authproto.AuthResult{}, fmt.Errorf("challenge binding mismatch")
 	}
 	response := authproto.ChallengeResponse{
 		Type:        authproto.MessageTypeChallengeResponse,
@@ -68,19 +108,98 @@ func auth(server *serverConfig, req *utils.AuthConfig) error {
 		ServerNonce: challenge.ServerNonce,
 		Token:       req.Token,
 		Timestamp:   time.Now().Unix(),
+		WantTicket:  req.WantTicket,
+		BindAddr:    req.BindAddr,
 	}
-	buf, err = sealMessage(server, response)
+	if otpCode != "" {
+		response.OTP = authproto.OTPProof(otpCode, challenge.ServerNonce)
+	}
+	channel.sign(&response, challenge)
+	buf, err = channel.seal(response)
 	if err != nil {
-		return fmt.Errorf("build challenge response failed: %v", err)
+		return authproto.AuthResult{}, fmt.Errorf("build challenge response failed: %v", err)
 	}
 	if _, err := conn.Write(buf); err != nil {
-		return fmt.Errorf("write challenge response failed: %v", err)
+		return authproto.AuthResult{}, fmt.Errorf("write challenge response failed: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	n, err = conn.Read(respBuf)
+	if err != nil {
+		return authproto.AuthResult{}, fmt.Errorf("read auth result failed: %v; the server may be too old to send results", err)
+	}
+	result, err := openAuthResult(channel, respBuf[:n])
+	if err != nil {
+		return authproto.AuthResult{}, fmt.Errorf("auth result validation failed: %v", err)
+	}
+	if result.ServerID != server.ServerID ||
+		result.ClientID != globalConfig.ClientID ||
+		result.Port != req.Port ||
+		result.ClientNonce != clientNonce ||
+		result.ServerNonce != challenge.ServerNonce {
+		return authproto.AuthResult{}, fmt.Errorf("auth result binding mismatch")
+	}
+	if !result.Authorized() {
+		return result, fmt.Errorf("server denied auth: %s", result.Reason)
+	}
+	return result, nil
+}
+
+// authChannel seals and opens the messages of one handshake
+type authChannel interface {
+	seal(msg interface{}) ([]byte, error)
+	// open returns the opened payload and its wire format
+	open(packet []byte) ([]byte, string, error)
+	// sign adds the proof of the client key to resp in keypair mode
+	sign(resp *authproto.ChallengeResponse, challenge authproto.Challenge)
+	// verify checks the signature of a Challenge or AuthResult against the
+	// pinned identity key of the server
+	verify(msg interface{}, signature []byte) error
+}
+
+func newAuthChannel(server *serverConfig) (authChannel, error) {
+	if server.keypair() {
+		return newKeypairChannel(server, globalConfig.ClientID, globalConfig.privateKey)
+	}
+	return pskChannel{server: server}, nil
+}
+
+// pskChannel seals the messages with the shared authkey of the server
+type pskChannel struct {
+	server *serverConfig
+}
+
+func (c pskChannel) seal(msg interface{}) ([]byte, error) {
+	return sealMessage(c.server, msg)
+}
+
+func (c pskChannel) open(packet []byte) ([]byte, string, error) {
+	return openEnvelope(c.server, packet)
+}
+
+func (c pskChannel) sign(resp *authproto.ChallengeResponse, challenge authproto.Challenge) {}
+
+func (c pskChannel) verify(msg interface{}, signature []byte) error {
+	ctx := authproto.Context{KeyID: c.server.KeyID, ServerID: c.server.ServerID}
+	return verifyServerSignature(c.server, ctx, []byte(c.server.Key), msg, signature)
+}
+
+// verifyServerSignature accepts any message when no serverpublickey is pinned
+func verifyServerSignature(server *serverConfig, ctx authproto.Context, key []byte, msg interface{}, signature []byte) error {
+	if server.serverPublicKey == nil {
+		return nil
+	}
+	if len(signature) == 0 {
+		return fmt.Errorf("server signature missing, is identitykey set on the server?")
+	}
+	if !authproto.VerifyServerMessage(server.serverPublicKey, ctx, key, msg, signature) {
+		return fmt.Errorf("server signature invalid")
 	}
 	return nil
 }
 
 func sealMessage(server *serverConfig, msg interface{}) ([]byte, error) {
-	body, err := json.Marshal(msg)
+	format := server.wireFormat()
+	body, err := authproto.EncodeMessage(msg, format)
 	if err != nil {
 		return nil, err
 	}
@@ -88,30 +207,35 @@ func sealMessage(server *serverConfig, msg interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	env, err := json.Marshal(authproto.Envelope{KeyID: server.KeyID, ServerID: server.ServerID, Payload: sealed})
-	if err != nil {
-		return nil, err
-	}
-	return env, nil
+	return authproto.EncodeEnvelope(authproto.Envelope{KeyID: server.KeyID, ServerID: server.ServerID, Payload: sealed}, format)
 }
 
-func openChallenge(server *serverConfig, packet []byte) (authproto.Challenge, error) {
-	var env authproto.Envelope
-	if err := json.Unmarshal(packet, &env); err != nil {
-		return authproto.Challenge{}, err
+// openEnvelope returns the opened payload and its wire format
+func openEnvelope(server *serverConfig, packet []byte) ([]byte, string, error) {
+	env, format, err := authproto.DecodeEnvelope(packet)
+	if err != nil {
+		return nil, "", err
 	}
 	if err := env.Validate(); err != nil {
-		return authproto.Challenge{}, err
+		return nil, "", err
 	}
-	if env.KeyID != server.KeyID || env.ServerID != server.ServerID {
-		return authproto.Challenge{}, fmt.Errorf("challenge envelope mismatch")
+	if env.KeyID != server.KeyID || !env.MatchServer(server.ServerID) {
+		return nil, "", fmt.Errorf("envelope mismatch")
 	}
-	plain, err := authproto.Open([]byte(server.Key), authproto.Context{KeyID: env.KeyID, ServerID: env.ServerID}, env.Payload)
+	plain, err := authproto.Open([]byte(server.Key), authproto.Context{KeyID: env.KeyID, ServerID: server.ServerID}, env.Payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return plain, format, nil
+}
+
+func openChallenge(channel authChannel, packet []byte) (authproto.Challenge, error) {
+	plain, format, err := channel.open(packet)
 	if err != nil {
 		return authproto.Challenge{}, err
 	}
 	var challenge authproto.Challenge
-	if err := json.Unmarshal(plain, &challenge); err != nil {
+	if err := authproto.DecodeMessage(plain, format, &challenge); err != nil {
 		return authproto.Challenge{}, err
 	}
 	if challenge.Type != authproto.MessageTypeChallenge {
@@ -123,30 +247,75 @@ func openChallenge(server *serverConfig, packet []byte) (authproto.Challenge, er
 	if challenge.ServerNonce == "" {
 		return authproto.Challenge{}, fmt.Errorf("server nonce cannot be empty")
 	}
+	if err := channel.verify(challenge, challenge.Signature); err != nil {
+		return authproto.Challenge{}, err
+	}
 	return challenge, nil
 }
 
+func openAuthResult(channel authChannel, packet []byte) (authproto.AuthResult, error) {
+	plain, format, err := channel.open(packet)
+	if err != nil {
+		return authproto.AuthResult{}, err
+	}
+	var result authproto.AuthResult
+	if err := authproto.DecodeMessage(plain, format, &result); err != nil {
+		return authproto.AuthResult{}, err
+	}
+	if err := result.Validate(time.Now()); err != nil {
+		return authproto.AuthResult{}, err
+	}
+	if err := channel.verify(result, result.Signature); err != nil {
+		return authproto.AuthResult{}, err
+	}
+	return result, nil
+}
+
 func startAuthOfServer(server *serverConfig, stop <-chan struct{}) <-chan struct{} {
 	done := make(chan struct{})
 	var wg sync.WaitGroup
 	for i := range server.AuthConfigs {
+		if cfg := server.AuthConfigs[i]; cfg.LocalAddr != "" {
+			// listen before returning so the caller knows the proxies are up
+			listener, err := listenLocalProxy(server, cfg)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveLocalProxy(server, cfg, listener, stop)
+			}()
+			continue
+		}
 		wg.Add(1)
 		go func(cfg authConfig) {
 			defer wg.Done()
 			log.Infof("start auth to port %d, re-auth interval %d seconds",
 				cfg.Port, *cfg.Interval)
 			request := utils.NewAuthConfig(cfg.Token, cfg.Port)
+			request.BindAddr = cfg.BindAddr
+			request.OTP = otpSource(server, &cfg)
 			if !request.IsValid() {
 				log.Warnf("request invalid, stop auth for port %d", cfg.Port)
 				return
 			}
-			ticker := time.NewTicker(time.Duration(*cfg.Interval) * time.Second)
-			defer ticker.Stop()
+			interval := time.Duration(*cfg.Interval) * time.Second
+			// a prompt waits for the user as long as it takes
+			loop := 0
+			if !cfg.OTPPrompt {
+				loop = authLoops.add(cfg.Port)
+				defer authLoops.remove(loop)
+				authLoops.expect(loop, time.Now().Add(maxAuthTime(server)))
+			}
+			delay := interval
+			var warnedLifetime time.Duration
 			failCount := 0
 			nextAlarmCount := 1
 		Loop:
 			for {
-				if err := auth(server, request); err != nil {
+				if result, err := auth(server, request); err != nil {
 					log.Infof("auth failed: %v", err)
 					failCount++
 					if failCount >= nextAlarmCount {
@@ -155,18 +324,27 @@ func startAuthOfServer(server *serverConfig, stop <-chan struct{}) <-chan struct
 						nextAlarmCount = nextAlarmCount * 10
 					}
 				} else {
-					log.Debugf("auth port %d success", cfg.Port)
+					log.Debugf("auth port %d %s, expires at %s", cfg.Port, result.Result,
+						time.Unix(result.ExpiresAt, 0).Format(time.RFC3339))
 					failCount = 0
 					nextAlarmCount = 1
+					delay = renewDelay(interval, result)
+					if lifetime := grantedLifetime(result); lifetime > 0 && interval >= lifetime && lifetime != warnedLifetime {
+						log.Warnf("interval %d seconds of port %d cannot keep the %s authorization alive, re-auth every %s instead",
+							*cfg.Interval, cfg.Port, lifetime, delay)
+						warnedLifetime = lifetime
+					}
 				}
+				wait := nextAuthDelay(delay, failCount)
+				authLoops.expect(loop, time.Now().Add(wait+maxAuthTime(server)))
 				select {
 				case <-stop:
 					break Loop
-				case <-ticker.C:
+				case <-time.After(wait):
 					continue
 				}
 			}
-			log.Debug("ticker stopped")
+			log.Debug("auth loop stopped")
 		}(server.AuthConfigs[i])
 	}
 	go func() {
@@ -182,3 +360,30 @@ func startAllAuth(stop <-chan struct{}) {
 		startAuthOfServer(server, stop)
 	}
 }
+
+// authOnce auths every authconfig of every server once, one after another so
+// otpprompt asks for one code at a time
+func authOnce() error {
+	failed := 0
+	for i := range globalConfig.Servers {
+		server := &globalConfig.Servers[i]
+		for j := range server.AuthConfigs {
+			cfg := &server.AuthConfigs[j]
+			request := utils.NewAuthConfig(cfg.Token, cfg.Port)
+			request.BindAddr = cfg.BindAddr
+			request.OTP = otpSource(server, cfg)
+			result, err := auth(server, request)
+			if err != nil {
+				log.Warnf("auth to port %d of %s failed: %v", cfg.Port, server.Addr, err)
+				failed++
+				continue
+			}
+			log.Infof("auth port %d of %s %s, expires at %s", cfg.Port, server.Addr, result.Result,
+				time.Unix(result.ExpiresAt, 0).Format(time.RFC3339))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d auths failed", failed)
+	}
+	return nil
+}
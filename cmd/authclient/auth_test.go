@@ -27,7 +27,7 @@ func TestAuthPerformsChallengeResponseHandshake(t *testing.T) {
 	addr := <-ready
 	globalConfig = &config{ClientID: clientID}
 
-	err := auth(&serverConfig{
+	result, err := auth(&serverConfig{
 		Addr:     addr,
 		ServerID: serverID,
 		KeyID:    "primary-2026-06",
@@ -36,6 +36,9 @@ func TestAuthPerformsChallengeResponseHandshake(t *testing.T) {
 	if err != nil {
 		t.Fatalf("auth failed: %v", err)
 	}
+	if result.Result != authproto.AuthResultAuthorized || result.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("unexpected auth result: %+v", result)
+	}
 
 	select {
 	case err := <-errs:
@@ -52,6 +55,42 @@ func TestAuthPerformsChallengeResponseHandshake(t *testing.T) {
 	}
 }
 
+func TestAuthUsesBinaryWireFormat(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", 40022)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation"}
+
+	server := &serverConfig{
+		Addr:       addr,
+		ServerID:   "connauth-server",
+		KeyID:      "primary-2026-06",
+		Key:        key,
+		WireFormat: authproto.WireFormatBinary,
+	}
+	buf, err := sealMessage(server, authproto.ChallengeRequest{Type: authproto.MessageTypeChallengeRequest})
+	if err != nil || buf[0] != authproto.BinaryVersion {
+		t.Fatalf("expected binary envelope: %v", err)
+	}
+	result, err := auth(server, utils.NewAuthConfig("token-abcdefghijklmnopqrstuvwxyz", 40022))
+	if err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	if !result.Authorized() {
+		t.Fatalf("unexpected auth result: %+v", result)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("stub server failed: %v", err)
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for challenge response")
+	}
+}
+
 func TestAuthRejectsChallengeWithWrongClientNonce(t *testing.T) {
 	key := "abcdefghijklmnopqrstuvwxyz123456"
 	token := "token-abcdefghijklmnopqrstuvwxyz"
@@ -61,11 +100,11 @@ func TestAuthRejectsChallengeWithWrongClientNonce(t *testing.T) {
 	ready := make(chan string, 1)
 	done := make(chan authproto.ChallengeResponse, 1)
 	errs := make(chan error, 1)
-	go runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, "primary-2026-06", serverID, clientID, port, "wrong-client-nonce")
+	go runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, "primary-2026-06", serverID, clientID, port, "wrong-client-nonce", authproto.AuthResultAuthorized)
 	addr := <-ready
 	globalConfig = &config{ClientID: clientID}
 
-	err := auth(&serverConfig{
+	_, err := auth(&serverConfig{
 		Addr:     addr,
 		ServerID: serverID,
 		KeyID:    "primary-2026-06",
@@ -81,6 +120,96 @@ func TestAuthRejectsChallengeWithWrongClientNonce(t *testing.T) {
 	}
 }
 
+func TestAuthReportsServerDenial(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	serverID := "connauth-server"
+	clientID := "workstation"
+	port := uint16(40022)
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, "primary-2026-06", serverID, clientID, port, "", authproto.AuthResultDenied)
+	addr := <-ready
+	globalConfig = &config{ClientID: clientID}
+
+	result, err := auth(&serverConfig{
+		Addr:     addr,
+		ServerID: serverID,
+		KeyID:    "primary-2026-06",
+		Key:      key,
+	}, utils.NewAuthConfig(token, port))
+	if err == nil {
+		t.Fatal("expected denied auth to fail")
+	}
+	if result.Result != authproto.AuthResultDenied || result.Reason != authproto.AuthReasonNotAllowed {
+		t.Fatalf("unexpected auth result: %+v", result)
+	}
+}
+
+func TestAuthFailsWithoutAuthResult(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	serverID := "connauth-server"
+	clientID := "workstation"
+	port := uint16(40022)
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, "primary-2026-06", serverID, clientID, port, "", "")
+	addr := <-ready
+	globalConfig = &config{ClientID: clientID}
+	previousTimeout := replyTimeout
+	replyTimeout = 200 * time.Millisecond
+	defer func() {
+		replyTimeout = previousTimeout
+	}()
+
+	_, err := auth(&serverConfig{
+		Addr:     addr,
+		ServerID: serverID,
+		KeyID:    "primary-2026-06",
+		Key:      key,
+	}, utils.NewAuthConfig("token-abcdefghijklmnopqrstuvwxyz", port))
+	if err == nil {
+		t.Fatal("expected auth without server result to fail")
+	}
+}
+
+func TestAuthFailsOverToAltAddr(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", 40022)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation"}
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	_ = dead.Close()
+	previousTimeout := replyTimeout
+	replyTimeout = 200 * time.Millisecond
+	defer func() {
+		replyTimeout = previousTimeout
+	}()
+
+	result, used, err := authAnyAddr(&serverConfig{
+		Addr:     deadAddr,
+		AltAddrs: []string{addr},
+		ServerID: "connauth-server",
+		KeyID:    "primary-2026-06",
+		Key:      key,
+	}, utils.NewAuthConfig("token-abcdefghijklmnopqrstuvwxyz", 40022))
+	if err != nil || !result.Authorized() {
+		t.Fatalf("expected auth at altaddr, got %+v %v", result, err)
+	}
+	if used != addr {
+		t.Fatalf("expected altaddr %s to answer, got %s", addr, used)
+	}
+}
+
 func TestStartAuthOfServerDoesNotLogToken(t *testing.T) {
 	var buf bytes.Buffer
 	previousOut := log.StandardLogger().Out
@@ -115,10 +244,10 @@ func TestStartAuthOfServerDoesNotLogToken(t *testing.T) {
 
 func runChallengeServerForClientTest(t *testing.T, ready chan<- string, done chan<- authproto.ChallengeResponse, errs chan<- error, key string, keyID string, serverID string, clientID string, port uint16) {
 	t.Helper()
-	runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, keyID, serverID, clientID, port, "")
+	runChallengeServerWithNonceOverrideForClientTest(t, ready, done, errs, key, keyID, serverID, clientID, port, "", authproto.AuthResultAuthorized)
 }
 
-func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<- string, done chan<- authproto.ChallengeResponse, errs chan<- error, key string, keyID string, serverID string, clientID string, port uint16, clientNonceOverride string) {
+func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<- string, done chan<- authproto.ChallengeResponse, errs chan<- error, key string, keyID string, serverID string, clientID string, port uint16, clientNonceOverride string, resultValue string) {
 	t.Helper()
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
 	if err != nil {
@@ -135,12 +264,12 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		errs <- err
 		return
 	}
-	var reqEnv authproto.Envelope
-	if err := json.Unmarshal(buf[:n], &reqEnv); err != nil {
+	reqEnv, format, err := authproto.DecodeEnvelope(buf[:n])
+	if err != nil {
 		errs <- err
 		return
 	}
-	if reqEnv.KeyID != keyID || reqEnv.ServerID != serverID {
+	if reqEnv.KeyID != keyID || !reqEnv.MatchServer(serverID) {
 		errs <- fmt.Errorf("request envelope mismatch: %+v", reqEnv)
 		return
 	}
@@ -150,7 +279,7 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		return
 	}
 	var req authproto.ChallengeRequest
-	if err := json.Unmarshal(plain, &req); err != nil {
+	if err := authproto.DecodeMessage(plain, format, &req); err != nil {
 		errs <- err
 		return
 	}
@@ -171,7 +300,7 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		ServerNonce: "server-nonce",
 		ExpiresAt:   time.Now().Add(authproto.ChallengeTTL).Unix(),
 	}
-	challengeBody, err := json.Marshal(challenge)
+	challengeBody, err := authproto.EncodeMessage(challenge, format)
 	if err != nil {
 		errs <- err
 		return
@@ -181,7 +310,7 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		errs <- err
 		return
 	}
-	respEnv, err := json.Marshal(authproto.Envelope{KeyID: keyID, ServerID: serverID, Payload: sealed})
+	respEnv, err := authproto.EncodeEnvelope(authproto.Envelope{KeyID: keyID, ServerID: serverID, Payload: sealed}, format)
 	if err != nil {
 		errs <- err
 		return
@@ -196,8 +325,8 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		errs <- err
 		return
 	}
-	var finalEnv authproto.Envelope
-	if err := json.Unmarshal(buf[:n], &finalEnv); err != nil {
+	finalEnv, _, err := authproto.DecodeEnvelope(buf[:n])
+	if err != nil {
 		errs <- err
 		return
 	}
@@ -207,9 +336,95 @@ func runChallengeServerWithNonceOverrideForClientTest(t *testing.T, ready chan<-
 		return
 	}
 	var final authproto.ChallengeResponse
-	if err := json.Unmarshal(finalPlain, &final); err != nil {
+	if err := authproto.DecodeMessage(finalPlain, format, &final); err != nil {
 		errs <- err
 		return
 	}
 	done <- final
+	if resultValue == "" {
+		return
+	}
+	result := authproto.AuthResult{
+		Type:        authproto.MessageTypeAuthResult,
+		ServerID:    serverID,
+		ClientID:    clientID,
+		Port:        port,
+		ClientNonce: final.ClientNonce,
+		ServerNonce: final.ServerNonce,
+		Result:      resultValue,
+		Reason:      authproto.AuthReasonOK,
+		Timestamp:   time.Now().Unix(),
+	}
+	if resultValue == authproto.AuthResultDenied {
+		result.Reason = authproto.AuthReasonNotAllowed
+	} else {
+		result.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		if final.WantTicket {
+			result.Ticket = "stub-ticket"
+		}
+	}
+	resultBody, err := authproto.EncodeMessage(result, format)
+	if err != nil {
+		errs <- err
+		return
+	}
+	sealed, err = authproto.Seal([]byte(key), authproto.Context{KeyID: keyID, ServerID: serverID}, resultBody)
+	if err != nil {
+		errs <- err
+		return
+	}
+	resultEnv, err := authproto.EncodeEnvelope(authproto.Envelope{KeyID: keyID, ServerID: serverID, Payload: sealed}, format)
+	if err != nil {
+		errs <- err
+		return
+	}
+	if _, err := conn.WriteToUDP(resultEnv, peer); err != nil {
+		errs <- err
+	}
+}
+
+func TestOpenChallengeVerifiesPinnedServerKey(t *testing.T) {
+	pubText, privText, _ := authproto.GenerateKey()
+	priv, _ := authproto.ParsePrivateKey(privText)
+	_, otherText, _ := authproto.GenerateKey()
+	other, _ := authproto.ParsePrivateKey(otherText)
+	server := &serverConfig{
+		Addr:            "127.0.0.1:40100",
+		ServerID:        "connauth-server",
+		KeyID:           "primary-2026-06",
+		Key:             "abcdefghijklmnopqrstuvwxyz123456",
+		ServerPublicKey: pubText,
+	}
+	if err := server.CheckValid(); err != nil {
+		t.Fatalf("expected pinned server key to be valid: %v", err)
+	}
+	ctx := authproto.Context{KeyID: server.KeyID, ServerID: server.ServerID}
+	challengePacket := func(signer []byte) []byte {
+		challenge := authproto.Challenge{
+			Type:        authproto.MessageTypeChallenge,
+			ServerID:    server.ServerID,
+			ClientID:    "workstation",
+			Port:        40022,
+			ClientNonce: "client-nonce",
+			ServerNonce: "server-nonce",
+			ExpiresAt:   time.Now().Add(authproto.ChallengeTTL).Unix(),
+		}
+		if signer != nil {
+			challenge.Signature, _ = authproto.SignServerMessage(signer, ctx, []byte(server.Key), challenge)
+		}
+		body, _ := json.Marshal(challenge)
+		sealed, _ := authproto.Seal([]byte(server.Key), ctx, body)
+		packet, _ := json.Marshal(authproto.Envelope{KeyID: server.KeyID, ServerID: server.ServerID, Payload: sealed})
+		return packet
+	}
+	channel := pskChannel{server: server}
+	if _, err := openChallenge(channel, challengePacket(priv)); err != nil {
+		t.Fatalf("expected signed challenge to be accepted: %v", err)
+	}
+	if _, err := openChallenge(channel, challengePacket(nil)); err == nil {
+		t.Fatal("expected unsigned challenge to be rejected")
+	}
+	if _, err := openChallenge(channel, challengePacket(other)); err == nil {
+		t.Fatal("expected challenge signed by another key to be rejected")
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"connauth/utils/authproto"
+	"crypto/ed25519"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
@@ -21,32 +23,77 @@ func newUint32(x uint32) *uint32 {
 }
 
 type serverConfig struct {
-	Addr        string
-	ServerID    string
-	KeyID       string
-	Key         string
-	AuthConfigs []authConfig
+	Addr     string
+	AltAddrs []string // other addresses of the same server, tried in order when addr does not answer
+	ServerID string
+	KeyID    string // keyid of a shared authkey, leave keyid and key empty to auth with privatekey
+	Key      string
+	// wire format of auth packets, json or binary, binary needs a server that accepts it, can be omit, default: json
+	WireFormat string
+	// base64 public identity key of the server, challenges and results must be signed with it, empty to disable
+	ServerPublicKey string
+	AuthConfigs     []authConfig
+
+	serverPublicKey ed25519.PublicKey
+}
+
+// addrs returns addr followed by the altaddrs
+func (c *serverConfig) addrs() []string {
+	return append([]string{c.Addr}, c.AltAddrs...)
+}
+
+func (c *serverConfig) wireFormat() string {
+	if c.WireFormat == "" {
+		return authproto.WireFormatJSON
+	}
+	return c.WireFormat
+}
+
+// keypair tells whether the server is authed with the privatekey of the
+// client instead of a shared authkey
+func (c *serverConfig) keypair() bool {
+	return c.KeyID == "" && c.Key == ""
 }
 
 func (c *serverConfig) CheckValid() error {
 	if c.Addr == "" {
 		return fmt.Errorf("addr cannot be empty")
 	}
-	if c.Key == "" {
-		return fmt.Errorf("key cannot be empty")
-	}
 	if err := validateIdentifier("serverid", c.ServerID); err != nil {
 		return err
 	}
-	if err := validateIdentifier("keyid", c.KeyID); err != nil {
-		return err
-	}
-	if err := validateSecret("key", c.Key); err != nil {
-		return err
+	if !c.keypair() {
+		if c.Key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+		if err := validateIdentifier("keyid", c.KeyID); err != nil {
+			return err
+		}
+		if err := validateSecret("key", c.Key); err != nil {
+			return err
+		}
 	}
 	if _, err := net.ResolveUDPAddr("udp", c.Addr); err != nil {
 		return fmt.Errorf("cannot resolve addr %s: %v", c.Addr, err)
 	}
+	for _, addr := range c.AltAddrs {
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("cannot resolve altaddr %s: %v", addr, err)
+		}
+	}
+	if c.ServerPublicKey != "" {
+		key, err := authproto.ParsePublicKey(c.ServerPublicKey)
+		if err != nil {
+			return fmt.Errorf("serverpublickey invalid: %v", err)
+		}
+		c.serverPublicKey = key
+	}
+	if c.WireFormat == "" {
+		c.WireFormat = authproto.WireFormatJSON
+	}
+	if !authproto.ValidWireFormat(c.WireFormat) {
+		return fmt.Errorf("wireformat %s is invalid, allow json or binary", c.WireFormat)
+	}
 	for i := range c.AuthConfigs {
 		if err := c.AuthConfigs[i].CheckValid(); err != nil {
 			return fmt.Errorf("authconfig %d invalid: %v", i+1, err)
@@ -62,6 +109,16 @@ type authConfig struct {
 	Port  uint16
 	// re-auth interval by second, not less then 10, can be omit, default: 60
 	Interval *uint32
+	// command that prints the totp code for a token with totp on the server, can be omit, default: empty
+	OTPCommand string
+	// ask for the totp code on the terminal before each auth instead, can be omit, default: false
+	OTPPrompt bool
+	// listen on this address and auth on each connection instead of every interval, can be omit, default: empty
+	LocalAddr string
+	// let localaddr listen on an address other hosts can reach, they use the auth of this client, can be omit, default: false
+	AllowRemote bool
+	// auth only the forward of port with this bindaddr on the server, can be omit, default: every forward of port
+	BindAddr string
 }
 
 func (c *authConfig) CheckValid() error {
@@ -77,6 +134,24 @@ func (c *authConfig) CheckValid() error {
 	if c.Interval != nil && *c.Interval < 10 {
 		return fmt.Errorf("interval must not less then 10")
 	}
+	if c.OTPCommand != "" && c.OTPPrompt {
+		return fmt.Errorf("otpcommand and otpprompt cannot both be set")
+	}
+	if c.LocalAddr != "" {
+		addr, err := net.ResolveTCPAddr("tcp", c.LocalAddr)
+		if err != nil {
+			return fmt.Errorf("cannot resolve localaddr %s: %v", c.LocalAddr, err)
+		}
+		// every connection accepted on localaddr is authed as this client
+		if !c.AllowRemote && (addr.IP == nil || !addr.IP.IsLoopback()) {
+			return fmt.Errorf("localaddr %s is not a loopback address, set allowremote to listen on it", c.LocalAddr)
+		}
+	} else if c.AllowRemote {
+		return fmt.Errorf("allowremote needs localaddr")
+	}
+	if c.BindAddr != "" && net.ParseIP(c.BindAddr) == nil {
+		return fmt.Errorf("bindaddr %s is not an IP address", c.BindAddr)
+	}
 	return nil
 }
 
@@ -95,6 +170,10 @@ type config struct {
 		Description string
 	}
 	Servers []serverConfig
+
+	// base64 Ed25519 private key of this client for servers without keyid and key
+	PrivateKey string
+	privateKey ed25519.PrivateKey
 }
 
 func validateIdentifier(kind string, value string) error {
@@ -136,10 +215,20 @@ func (c *config) CheckValid() error {
 	if err := validateIdentifier("clientid", c.ClientID); err != nil {
 		return err
 	}
+	if c.PrivateKey != "" {
+		key, err := authproto.ParsePrivateKey(c.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("privatekey invalid: %v", err)
+		}
+		c.privateKey = key
+	}
 	for i := range c.Servers {
 		if err := c.Servers[i].CheckValid(); err != nil {
 			return fmt.Errorf("server %d invalid: %v", i+1, err)
 		}
+		if c.Servers[i].keypair() && c.privateKey == nil {
+			return fmt.Errorf("server %d invalid: key cannot be empty without privatekey", i+1)
+		}
 	}
 	return nil
 }
@@ -33,6 +33,20 @@ func TestClientConfigRejectsUnsafeAuthSettings(t *testing.T) {
 				}},
 			}}},
 		},
+		{
+			name: "altaddr missing port",
+			cfg: config{ClientID: "workstation", Servers: []serverConfig{{
+				Addr:     "127.0.0.1:40100",
+				AltAddrs: []string{"[::1]"},
+				ServerID: "connauth-server",
+				KeyID:    "primary-2026-06",
+				Key:      "abcdefghijklmnopqrstuvwxyz123456",
+				AuthConfigs: []authConfig{{
+					Token: "token-abcdefghijklmnopqrstuvwxyz",
+					Port:  40022,
+				}},
+			}}},
+		},
 		{
 			name: "weak key",
 			cfg: config{ClientID: "workstation", Servers: []serverConfig{{
@@ -59,6 +73,34 @@ func TestClientConfigRejectsUnsafeAuthSettings(t *testing.T) {
 				}},
 			}}},
 		},
+		{
+			name: "bindaddr not an IP",
+			cfg: config{ClientID: "workstation", Servers: []serverConfig{{
+				Addr:     "127.0.0.1:40100",
+				ServerID: "connauth-server",
+				KeyID:    "primary-2026-06",
+				Key:      "abcdefghijklmnopqrstuvwxyz123456",
+				AuthConfigs: []authConfig{{
+					Token:    "token-abcdefghijklmnopqrstuvwxyz",
+					Port:     40022,
+					BindAddr: "example.com",
+				}},
+			}}},
+		},
+		{
+			name: "localaddr not loopback",
+			cfg: config{ClientID: "workstation", Servers: []serverConfig{{
+				Addr:     "127.0.0.1:40100",
+				ServerID: "connauth-server",
+				KeyID:    "primary-2026-06",
+				Key:      "abcdefghijklmnopqrstuvwxyz123456",
+				AuthConfigs: []authConfig{{
+					Token:     "token-abcdefghijklmnopqrstuvwxyz",
+					Port:      40022,
+					LocalAddr: ":2222",
+				}},
+			}}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -138,3 +180,45 @@ func TestClientConfigRequiresServerID(t *testing.T) {
 		t.Fatalf("expected server id config to be valid: %v", err)
 	}
 }
+
+func TestClientConfigDefaultsWireFormatToJSON(t *testing.T) {
+	cfg := config{
+		ClientID: "workstation",
+		Servers: []serverConfig{{
+			Addr:     "127.0.0.1:40100",
+			ServerID: "connauth-server",
+			KeyID:    "primary-2026-06",
+			Key:      "abcdefghijklmnopqrstuvwxyz123456",
+		}},
+	}
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatalf("expected config to be valid: %v", err)
+	}
+	if cfg.Servers[0].WireFormat != "json" {
+		t.Fatalf("expected json default, got %s", cfg.Servers[0].WireFormat)
+	}
+	cfg.Servers[0].WireFormat = "protobuf"
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected unknown wire format to be rejected")
+	}
+}
+
+func TestClientConfigLocalAddrIsLoopbackUnlessAllowRemote(t *testing.T) {
+	for _, c := range []struct {
+		localAddr   string
+		allowRemote bool
+		valid       bool
+	}{
+		{"127.0.0.1:2222", false, true},
+		{"[::1]:2222", false, true},
+		{"0.0.0.0:2222", false, false},
+		{"192.0.2.10:2222", false, false},
+		{"0.0.0.0:2222", true, true},
+		{"", true, false},
+	} {
+		cfg := authConfig{Token: "token-abcdefghijklmnopqrstuvwxyz", Port: 40022, LocalAddr: c.localAddr, AllowRemote: c.allowRemote}
+		if err := cfg.CheckValid(); (err == nil) != c.valid {
+			t.Fatalf("localaddr %q allowremote %v: expected valid %v, got %v", c.localAddr, c.allowRemote, c.valid, err)
+		}
+	}
+}
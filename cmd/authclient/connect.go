@@ -0,0 +1,87 @@
+package main
+
+import (
+	"connauth/utils"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// findAuthConfig returns the authconfig of port on the server named name,
+// name is the serverid, an addr or the host of an addr of a server
+func findAuthConfig(name string, port uint16) (*serverConfig, *authConfig, error) {
+	found := false
+	for i := range globalConfig.Servers {
+		server := &globalConfig.Servers[i]
+		if !serverNamed(server, name) {
+			continue
+		}
+		found = true
+		for j := range server.AuthConfigs {
+			if server.AuthConfigs[j].Port == port {
+				return server, &server.AuthConfigs[j], nil
+			}
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("no server %s in config", name)
+	}
+	return nil, nil, fmt.Errorf("no authconfig for port %d of server %s", port, name)
+}
+
+func serverNamed(server *serverConfig, name string) bool {
+	if name == server.ServerID {
+		return true
+	}
+	for _, addr := range server.addrs() {
+		host, _, _ := net.SplitHostPort(addr)
+		if name == addr || name == host {
+			return true
+		}
+	}
+	return false
+}
+
+// runConnect auths the authconfig of port on the server named name and pipes
+// in and out to the forwarded port, for use as ssh ProxyCommand
+func runConnect(name string, portText string, in io.Reader, out io.Writer) error {
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port %s", portText)
+	}
+	server, cfg, err := findAuthConfig(name, uint16(port))
+	if err != nil {
+		return err
+	}
+	if cfg.OTPPrompt {
+		// stdin carries the connection, ask on the terminal instead
+		if err := usePromptTerminal(); err != nil {
+			return err
+		}
+	}
+	remote, err := dialForward(server, cfg)
+	if err != nil {
+		return err
+	}
+	return pipeConn(remote, in, out)
+}
+
+// pipeConn copies in to remote and remote to out until remote is closed. The
+// end of in only shuts down the write half of remote, so the reply can still
+// be read.
+func pipeConn(remote net.Conn, in io.Reader, out io.Writer) error {
+	defer remote.Close()
+	go func() {
+		_, _ = io.Copy(remote, in)
+		if cw, ok := remote.(utils.CloseWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = remote.Close()
+		}
+	}()
+	if _, err := io.Copy(out, remote); err != nil {
+		return fmt.Errorf("connection closed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"connauth/utils/authproto"
+)
+
+func TestConnectPipesStdioAfterAuth(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	backend := startTicketBackendForTest(t)
+	port := uint16(backend.Addr().(*net.TCPAddr).Port)
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", port)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation", Servers: []serverConfig{{
+		Addr:        addr,
+		ServerID:    "connauth-server",
+		KeyID:       "primary-2026-06",
+		Key:         key,
+		AuthConfigs: []authConfig{{Token: "token-abcdefghijklmnopqrstuvwxyz", Port: port}},
+	}}}
+
+	var out bytes.Buffer
+	if err := runConnect("connauth-server", strconv.Itoa(int(port)), strings.NewReader("SSH-2.0-test\r\n"), &out); err != nil {
+		select {
+		case err := <-errs:
+			t.Fatalf("stub server failed: %v", err)
+		default:
+		}
+		t.Fatalf("connect: %v", err)
+	}
+	if out.String() != "SSH-2.0-test\r\n" {
+		t.Fatalf("expected stdin to be echoed through the forward, got %q", out.String())
+	}
+}
+
+func TestFindAuthConfigMatchesServerByIDOrHost(t *testing.T) {
+	globalConfig = &config{ClientID: "workstation", Servers: []serverConfig{
+		{Addr: "203.0.113.10:40100", ServerID: "connauth-server", AuthConfigs: []authConfig{{Port: 40022}}},
+		{Addr: "198.51.100.20:40100", ServerID: "connauth-backup", AuthConfigs: []authConfig{{Port: 40023}}},
+	}}
+	for _, name := range []string{"connauth-backup", "198.51.100.20", "198.51.100.20:40100"} {
+		server, cfg, err := findAuthConfig(name, 40023)
+		if err != nil || server.ServerID != "connauth-backup" || cfg.Port != 40023 {
+			t.Fatalf("expected %s to find the backup server, got %v", name, err)
+		}
+	}
+	if _, _, err := findAuthConfig("connauth-server", 40023); err == nil {
+		t.Fatal("expected unknown port to fail")
+	}
+	if _, _, err := findAuthConfig("prod", 40022); err == nil {
+		t.Fatal("expected unknown server to fail")
+	}
+	if err := runConnect("connauth-server", "0", nil, nil); err == nil {
+		t.Fatal("expected invalid port to fail")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"connauth/utils/authproto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"fmt"
+)
+
+// keypairChannel auths with the private key of the client, the messages after
+// the challenge request are sealed with a key agreed from ephemeral keys
+type keypairChannel struct {
+	server          *serverConfig
+	ctx             authproto.Context
+	key             ed25519.PrivateKey
+	ephemeral       *ecdh.PrivateKey
+	session         []byte
+	serverEphemeral []byte
+}
+
+func newKeypairChannel(server *serverConfig, clientID string, key ed25519.PrivateKey) (*keypairChannel, error) {
+	if key == nil {
+		return nil, fmt.Errorf("privatekey is required by server %s", server.ServerID)
+	}
+	ephemeral, err := authproto.NewEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	return &keypairChannel{
+		server:    server,
+		ctx:       authproto.Context{KeyID: clientID, ServerID: server.ServerID},
+		key:       key,
+		ephemeral: ephemeral,
+	}, nil
+}
+
+func (c *keypairChannel) seal(msg interface{}) ([]byte, error) {
+	format := c.server.wireFormat()
+	body, err := authproto.EncodeMessage(msg, format)
+	if err != nil {
+		return nil, err
+	}
+	env := authproto.Envelope{ServerID: c.ctx.ServerID, ClientID: c.ctx.KeyID, EphemeralKey: c.ephemeral.PublicKey().Bytes()}
+	if c.session == nil {
+		// the challenge request goes out signed before a session key exists
+		env.Payload = body
+		env.Signature = authproto.SignHello(c.key, env)
+	} else if env.Payload, err = authproto.Seal(c.session, c.ctx, body); err != nil {
+		return nil, err
+	}
+	return authproto.EncodeEnvelope(env, format)
+}
+
+func (c *keypairChannel) open(packet []byte) ([]byte, string, error) {
+	env, format, err := authproto.DecodeEnvelope(packet)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := env.Validate(); err != nil {
+		return nil, "", err
+	}
+	if env.ClientID != c.ctx.KeyID || !env.MatchServer(c.ctx.ServerID) || len(env.EphemeralKey) == 0 {
+		return nil, "", fmt.Errorf("envelope mismatch")
+	}
+	session := c.session
+	if session == nil {
+		session, err = authproto.SessionKey(c.ephemeral, env.EphemeralKey, c.ctx, c.ephemeral.PublicKey().Bytes(), env.EphemeralKey)
+		if err != nil {
+			return nil, "", err
+		}
+	} else if !bytes.Equal(env.EphemeralKey, c.serverEphemeral) {
+		return nil, "", fmt.Errorf("envelope mismatch")
+	}
+	plain, err := authproto.Open(session, c.ctx, env.Payload)
+	if err != nil {
+		return nil, "", err
+	}
+	c.session, c.serverEphemeral = session, env.EphemeralKey
+	return plain, format, nil
+}
+
+func (c *keypairChannel) sign(resp *authproto.ChallengeResponse, challenge authproto.Challenge) {
+	resp.Signature = authproto.SignChallenge(c.key, c.ctx, c.ephemeral.PublicKey().Bytes(), c.serverEphemeral, challenge)
+}
+
+func (c *keypairChannel) verify(msg interface{}, signature []byte) error {
+	return verifyServerSignature(c.server, c.ctx, c.session, msg, signature)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"connauth/utils"
+	"connauth/utils/authproto"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthPerformsKeypairHandshake(t *testing.T) {
+	pubText, privText, err := authproto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate client key: %v", err)
+	}
+	pub, _ := authproto.ParsePublicKey(pubText)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- runKeypairServerForClientTest(conn, pub)
+	}()
+
+	globalConfig = &config{
+		ClientID:   "laptop",
+		PrivateKey: privText,
+		Servers: []serverConfig{{
+			Addr:       conn.LocalAddr().String(),
+			ServerID:   "connauth-server",
+			WireFormat: authproto.WireFormatBinary,
+		}},
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected keypair config to be valid: %v", err)
+	}
+	result, err := auth(&globalConfig.Servers[0], utils.NewAuthConfig("token-abcdefghijklmnopqrstuvwxyz", 40022))
+	if err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	if !result.Authorized() {
+		t.Fatalf("unexpected auth result: %+v", result)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("stub server failed: %v", err)
+	}
+}
+
+func TestClientConfigRequiresPrivateKeyForKeypairServer(t *testing.T) {
+	cfg := config{
+		ClientID: "laptop",
+		Servers:  []serverConfig{{Addr: "127.0.0.1:40100", ServerID: "connauth-server"}},
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected server without key and privatekey to be rejected")
+	}
+	cfg.PrivateKey = "not-a-key"
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected invalid privatekey to be rejected")
+	}
+}
+
+// runKeypairServerForClientTest answers one keypair handshake of client laptop
+func runKeypairServerForClientTest(conn *net.UDPConn, pub []byte) error {
+	buf := make([]byte, authproto.MaxPacketSize)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, peer, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return err
+	}
+	hello, format, err := authproto.DecodeEnvelope(buf[:n])
+	if err != nil {
+		return err
+	}
+	hello.ServerID = "connauth-server"
+	if !authproto.VerifyHello(pub, hello) {
+		return fmt.Errorf("hello signature invalid")
+	}
+	var req authproto.ChallengeRequest
+	if err := authproto.DecodeMessage(hello.Payload, format, &req); err != nil {
+		return err
+	}
+	ephemeral, err := authproto.NewEphemeralKey()
+	if err != nil {
+		return err
+	}
+	ctx := hello.Context()
+	serverEphemeral := ephemeral.PublicKey().Bytes()
+	session, err := authproto.SessionKey(ephemeral, hello.EphemeralKey, ctx, hello.EphemeralKey, serverEphemeral)
+	if err != nil {
+		return err
+	}
+	reply := func(msg interface{}) error {
+		body, err := authproto.EncodeMessage(msg, format)
+		if err != nil {
+			return err
+		}
+		sealed, err := authproto.Seal(session, ctx, body)
+		if err != nil {
+			return err
+		}
+		packet, err := authproto.EncodeEnvelope(authproto.Envelope{ServerID: ctx.ServerID, ClientID: ctx.KeyID, EphemeralKey: serverEphemeral, Payload: sealed}, format)
+		if err != nil {
+			return err
+		}
+		_, err = conn.WriteToUDP(packet, peer)
+		return err
+	}
+	challenge := authproto.Challenge{
+		Type:        authproto.MessageTypeChallenge,
+		ServerID:    req.ServerID,
+		ClientID:    req.ClientID,
+		Port:        req.Port,
+		ClientNonce: req.ClientNonce,
+		ServerNonce: "server-nonce",
+		ExpiresAt:   time.Now().Add(authproto.ChallengeTTL).Unix(),
+	}
+	if err := reply(challenge); err != nil {
+		return err
+	}
+	n, _, err = conn.ReadFromUDP(buf)
+	if err != nil {
+		return err
+	}
+	env, _, err := authproto.DecodeEnvelope(buf[:n])
+	if err != nil {
+		return err
+	}
+	plain, err := authproto.Open(session, ctx, env.Payload)
+	if err != nil {
+		return err
+	}
+	var resp authproto.ChallengeResponse
+	if err := authproto.DecodeMessage(plain, format, &resp); err != nil {
+		return err
+	}
+	if !authproto.VerifyChallenge(pub, ctx, hello.EphemeralKey, serverEphemeral, challenge, resp.Signature) {
+		return fmt.Errorf("challenge signature invalid")
+	}
+	return reply(authproto.AuthResult{
+		Type:        authproto.MessageTypeAuthResult,
+		ServerID:    resp.ServerID,
+		ClientID:    resp.ClientID,
+		Port:        resp.Port,
+		ClientNonce: resp.ClientNonce,
+		ServerNonce: resp.ServerNonce,
+		Result:      authproto.AuthResultAuthorized,
+		Reason:      authproto.AuthReasonOK,
+		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
+		Timestamp:   time.Now().Unix(),
+	})
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"connauth/utils/authproto"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	_log "log"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"connauth/utils/service"
 )
@@ -31,22 +34,57 @@ func Main(exit <-chan struct{}) {
 	log.Info("Log level:", log.GetLevel())
 
 	stop := make(chan struct{})
-	go func() {
-		startAllAuth(stop)
-	}()
+	startAllAuth(stop)
+	_ = service.Notify("READY=1")
+	go service.KeepAlive(func() error { return authLoops.check(time.Now()) }, stop)
 
 	// waiting for the exit signal
 	<-exit
 	close(stop)
 }
 
+// controlService installs or uninstalls the service that runs with
+// configFile
+func controlService(command string, configFile string) error {
+	if command == "uninstall" {
+		return service.Uninstall()
+	}
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	return service.Install([]string{"-c", abs})
+}
+
 func main() {
 	var err error
 	var configFile string
 	var checkConfig bool
+	var genKey bool
+	var once bool
 	flag.StringVar(&configFile, "c", DefaultConfigFile, "path of config file")
 	flag.BoolVar(&checkConfig, "check-config", false, "validate config and exit")
+	flag.BoolVar(&genKey, "genkey", false, "generate a keypair for privatekey and clientkeys and exit")
+	flag.BoolVar(&once, "once", false, "auth every authconfig once and exit instead of running as service")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s [flags] connect <server> <port>\n       %s [flags] install|uninstall\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if genKey {
+		pub, priv, err := authproto.GenerateKey()
+		if err != nil {
+			_log.Fatalln("Generate key fail:", err)
+		}
+		fmt.Printf("# client_config.yaml\nprivatekey: %q\n# clientkeys of authserver\npublickey: %q\n", priv, pub)
+		return
+	}
+	command := flag.Arg(0)
+	if command == "connect" && flag.NArg() != 3 {
+		_log.Fatalln("Usage: authclient [-c config] connect <server> <port>")
+	} else if command != "" && command != "connect" && command != "install" && command != "uninstall" {
+		_log.Fatalln("Unknown command:", command)
+	}
 	if configFile == "" {
 		configFile = path.Join(getCurrentPath(), DefaultConfigFile)
 	}
@@ -60,12 +98,31 @@ func main() {
 	if err := initLogger(globalConfig); err != nil {
 		_log.Fatalln("Config logger fail:", err)
 	}
+	if command == "connect" {
+		if err := runConnect(flag.Arg(1), flag.Arg(2), os.Stdin, os.Stdout); err != nil {
+			_log.Fatalln("Connect fail:", err)
+		}
+		return
+	}
+	if once {
+		if err := authOnce(); err != nil {
+			_log.Fatalln("Auth fail:", err)
+		}
+		return
+	}
 
 	_ = service.Init(service.Option{
 		Name:        globalConfig.Service.ServiceName,
 		DisplayName: globalConfig.Service.DisplayName,
 		Description: globalConfig.Service.Description,
 	})
+	if command != "" {
+		if err := controlService(command, configFile); err != nil {
+			_log.Fatalf("%s service fail: %v", command, err)
+		}
+		_log.Printf("%s service %s done", command, globalConfig.Service.ServiceName)
+		return
+	}
 	err = service.Run(Main)
 	if err != nil {
 		log.Error(err)
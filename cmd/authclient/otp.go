@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"connauth/utils/authproto"
+	"connauth/utils/service"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long otpcommand may run
+var otpCommandTimeout = 10 * time.Second
+
+// prompts of concurrent auths are asked one after another
+var muxPrompt sync.Mutex
+var promptReader = bufio.NewReader(os.Stdin)
+
+// otpSource returns the reader of the totp code of cfg, nil without a second
+// factor
+func otpSource(server *serverConfig, cfg *authConfig) func() (string, error) {
+	if cfg.OTPCommand != "" {
+		return func() (string, error) {
+			return runOTPCommand(cfg.OTPCommand)
+		}
+	}
+	if cfg.OTPPrompt {
+		return func() (string, error) {
+			return promptOTP(fmt.Sprintf("totp code for port %d of %s: ", cfg.Port, server.Addr))
+		}
+	}
+	return nil
+}
+
+func runOTPCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), otpCommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("otpcommand failed: %v", err)
+	}
+	return checkOTPCode(string(out))
+}
+
+func promptOTP(prompt string) (string, error) {
+	if !service.Interactive() {
+		return "", fmt.Errorf("otpprompt needs a terminal, use otpcommand when running as service")
+	}
+	muxPrompt.Lock()
+	defer muxPrompt.Unlock()
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := promptReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read totp code failed: %v", err)
+	}
+	return checkOTPCode(line)
+}
+
+// usePromptTerminal reads the answers of otpprompt from the terminal
+// instead of stdin
+func usePromptTerminal() error {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	tty, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("otpprompt needs a terminal: %v", err)
+	}
+	promptReader = bufio.NewReader(tty)
+	return nil
+}
+
+func checkOTPCode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != authproto.OTPDigits {
+		return "", fmt.Errorf("totp code must be %d digits", authproto.OTPDigits)
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("totp code must be %d digits", authproto.OTPDigits)
+		}
+	}
+	return code, nil
+}
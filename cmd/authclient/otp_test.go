@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"connauth/utils"
+	"connauth/utils/authproto"
+)
+
+func TestAuthSendsOTPBoundToServerNonce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("otpcommand test uses sh")
+	}
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", 40022)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation"}
+	server := &serverConfig{Addr: addr, ServerID: "connauth-server", KeyID: "primary-2026-06", Key: key}
+
+	request := utils.NewAuthConfig("token-abcdefghijklmnopqrstuvwxyz", 40022)
+	request.OTP = otpSource(server, &authConfig{Port: 40022, OTPCommand: "echo ' 123456'"})
+	if _, err := auth(server, request); err != nil {
+		t.Fatalf("auth failed: %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("stub server failed: %v", err)
+	case resp := <-done:
+		if !bytes.Equal(resp.OTP, authproto.OTPProof("123456", resp.ServerNonce)) {
+			t.Fatal("expected otp proof of the command output bound to the server nonce")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for challenge response")
+	}
+}
+
+func TestOTPCommandOutputMustBeACode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("otpcommand test uses sh")
+	}
+	for _, command := range []string{"echo 12345", "echo abcdef", "exit 1"} {
+		if _, err := runOTPCommand(command); err == nil {
+			t.Fatalf("expected otpcommand %q to fail", command)
+		}
+	}
+	if otpSource(&serverConfig{}, &authConfig{}) != nil {
+		t.Fatal("expected no otp source without otpcommand or otpprompt")
+	}
+}
+
+func TestClientConfigRejectsBothOTPSources(t *testing.T) {
+	cfg := authConfig{Token: "token-abcdefghijklmnopqrstuvwxyz", Port: 40022, OTPCommand: "echo 123456", OTPPrompt: true}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected otpcommand and otpprompt together to be rejected")
+	}
+}
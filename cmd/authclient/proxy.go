@@ -0,0 +1,99 @@
+package main
+
+import (
+	"connauth/utils"
+	"connauth/utils/authproto"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"time"
+)
+
+// how long to wait for the TCP connection to a forwarded port
+var dialTimeout = 10 * time.Second
+
+// forwardAddr is the address of the forwarded port: bindAddr when the forward
+// is bound to a single address, else the host of the auth address authAddr
+func forwardAddr(authAddr string, bindAddr string, port uint16) (string, error) {
+	if ip := net.ParseIP(bindAddr); ip != nil && !ip.IsUnspecified() {
+		return net.JoinHostPort(bindAddr, strconv.Itoa(int(port))), nil
+	}
+	host, _, err := net.SplitHostPort(authAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid server addr %s: %v", authAddr, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// dialForward auths cfg and connects to its forwarded port on the bindaddr of
+// cfg or the address that answered the auth, the server only allows the IP
+// it was authed from.
+// The ticket of the auth result is sent first when the forward requires one.
+func dialForward(server *serverConfig, cfg *authConfig) (net.Conn, error) {
+	request := utils.NewAuthConfig(cfg.Token, cfg.Port)
+	request.BindAddr = cfg.BindAddr
+	request.OTP = otpSource(server, cfg)
+	request.WantTicket = true
+	result, authAddr, err := authAnyAddr(server, request)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := forwardAddr(authAddr, cfg.BindAddr, cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s failed: %v", addr, err)
+	}
+	if result.Ticket != "" {
+		if err := authproto.WriteTicket(conn, result.Ticket); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("send ticket to %s failed: %v", addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// listenLocalProxy listens on the localaddr of cfg
+func listenLocalProxy(server *serverConfig, cfg authConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", cfg.LocalAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed: %v", cfg.LocalAddr, err)
+	}
+	log.Infof("listening on %s, will auth and forward to port %d of %s", cfg.LocalAddr, cfg.Port, server.Addr)
+	return listener, nil
+}
+
+// serveLocalProxy accepts on listener until stop is closed, every accepted
+// connection is authed and spliced to the forwarded port
+func serveLocalProxy(server *serverConfig, cfg authConfig, listener net.Listener, stop <-chan struct{}) {
+	go func() {
+		<-stop
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			log.Warnf("accept on %s failed: %v", cfg.LocalAddr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go func() {
+			remote, err := dialForward(server, &cfg)
+			if err != nil {
+				log.Warnf("connection from %s to port %d closed: %v", conn.RemoteAddr(), cfg.Port, err)
+				_ = conn.Close()
+				return
+			}
+			log.Debugf("forward %s to port %d of %s", conn.RemoteAddr(), cfg.Port, server.Addr)
+			utils.Splice(conn, remote)
+		}()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"connauth/utils/authproto"
+)
+
+// startTicketBackendForTest stands in for a forward with requireticket, it
+// checks the ticket line and echoes the rest
+func startTicketBackendForTest(t *testing.T) net.Listener {
+	t.Helper()
+	return startTicketBackendOnForTest(t, "127.0.0.1")
+}
+
+func startTicketBackendOnForTest(t *testing.T, host string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if ticket, err := authproto.ReadTicket(conn); err != nil || ticket != "stub-ticket" {
+					return
+				}
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func freeLocalAddrForTest(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestLocalProxyAuthsOnConnectAndSendsTicket(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	backend := startTicketBackendForTest(t)
+	port := uint16(backend.Addr().(*net.TCPAddr).Port)
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", port)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation"}
+	server := &serverConfig{Addr: addr, ServerID: "connauth-server", KeyID: "primary-2026-06", Key: key}
+	cfg := authConfig{Token: "token-abcdefghijklmnopqrstuvwxyz", Port: port, LocalAddr: freeLocalAddrForTest(t), BindAddr: "127.0.0.1"}
+	stop := make(chan struct{})
+	defer close(stop)
+	server.AuthConfigs = []authConfig{cfg}
+	startAuthOfServer(server, stop)
+
+	// the proxy listens once startAuthOfServer returns
+	conn, err := net.Dial("tcp", cfg.LocalAddr)
+	if err != nil {
+		t.Fatalf("dial local proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		select {
+		case err := <-errs:
+			t.Fatalf("stub server failed: %v", err)
+		default:
+		}
+		t.Fatalf("expected proxied echo after auth, got %q %v", buf, err)
+	}
+	select {
+	case resp := <-done:
+		if resp.Port != port || resp.BindAddr != "127.0.0.1" {
+			t.Fatalf("unexpected auth of port %d bindaddr %q", resp.Port, resp.BindAddr)
+		}
+	default:
+		t.Fatal("expected the connection to be authed first")
+	}
+}
+
+func TestForwardAddrUsesBindAddrOrHostOfServer(t *testing.T) {
+	for _, c := range []struct {
+		bindAddr string
+		want     string
+	}{
+		{"", "[2001:db8::1]:40022"},
+		{"0.0.0.0", "[2001:db8::1]:40022"},
+		{"::", "[2001:db8::1]:40022"},
+		{"203.0.113.10", "203.0.113.10:40022"},
+		{"2001:db8::10", "[2001:db8::10]:40022"},
+	} {
+		addr, err := forwardAddr("[2001:db8::1]:40100", c.bindAddr, 40022)
+		if err != nil || addr != c.want {
+			t.Fatalf("bindaddr %q: expected %s, got %s %v", c.bindAddr, c.want, addr, err)
+		}
+	}
+}
+
+func TestDialForwardConnectsToBindAddrOtherThanAuthAddr(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	// the auth stub listens on 127.0.0.1, the forward on another address
+	backend := startTicketBackendOnForTest(t, "127.0.0.2")
+	port := uint16(backend.Addr().(*net.TCPAddr).Port)
+	ready := make(chan string, 1)
+	done := make(chan authproto.ChallengeResponse, 1)
+	errs := make(chan error, 1)
+	go runChallengeServerForClientTest(t, ready, done, errs, key, "primary-2026-06", "connauth-server", "workstation", port)
+	addr := <-ready
+	globalConfig = &config{ClientID: "workstation"}
+	server := &serverConfig{Addr: addr, ServerID: "connauth-server", KeyID: "primary-2026-06", Key: key}
+	cfg := &authConfig{Token: "token-abcdefghijklmnopqrstuvwxyz", Port: port, BindAddr: "127.0.0.2"}
+	conn, err := dialForward(server, cfg)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != backend.Addr().String() {
+		t.Fatalf("expected to connect to the bindaddr %s, got %s", backend.Addr(), got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo of the forward, got %q %v", buf, err)
+	}
+}
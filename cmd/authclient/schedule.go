@@ -0,0 +1,67 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// first retry delay after a failed auth, doubled on every further failure
+// up to the interval
+var retryBackoffMin = 2 * time.Second
+
+var (
+	muxJitter  sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randDuration returns a random duration in [0, d)
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	muxJitter.Lock()
+	defer muxJitter.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(d)))
+}
+
+// nextAuthDelay returns the wait before the next auth. After a success it is
+// the interval shortened by up to a tenth, so clients started together drift
+// apart. After failCount failures in a row it backs off exponentially from
+// retryBackoffMin, capped at interval, and waits a random time between half
+// and all of it, so clients do not retry in bursts after a server restart.
+func nextAuthDelay(interval time.Duration, failCount int) time.Duration {
+	if failCount == 0 {
+		return interval - randDuration(interval/10)
+	}
+	delay := retryBackoffMin
+	for i := 1; i < failCount && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		delay = interval
+	}
+	return delay/2 + randDuration(delay/2)
+}
+
+// renewDelay returns the wait before renewing the authorization of result,
+// the interval or half of the lifetime the server granted when that is
+// shorter, so a failed renewal still has time to be retried. The lifetime is
+// taken from the server clock, skew of the client clock does not matter.
+func renewDelay(interval time.Duration, result authproto.AuthResult) time.Duration {
+	lifetime := grantedLifetime(result)
+	if lifetime <= 0 {
+		return interval
+	}
+	if renew := lifetime / 2; renew < interval {
+		return renew
+	}
+	return interval
+}
+
+// grantedLifetime is how long the authorization of result lasts from the
+// time the server sent it
+func grantedLifetime(result authproto.AuthResult) time.Duration {
+	return time.Duration(result.ExpiresAt-result.Timestamp) * time.Second
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"connauth/utils/authproto"
+)
+
+func TestNextAuthDelayJittersInterval(t *testing.T) {
+	interval := 60 * time.Second
+	for i := 0; i < 100; i++ {
+		delay := nextAuthDelay(interval, 0)
+		if delay > interval || delay < interval-interval/10 {
+			t.Fatalf("delay %s out of jitter range", delay)
+		}
+	}
+}
+
+func TestNextAuthDelayBacksOffUpToInterval(t *testing.T) {
+	interval := 60 * time.Second
+	cases := []struct {
+		failCount int
+		max       time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{4, 16 * time.Second},
+		{6, interval},
+		{100, interval},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			delay := nextAuthDelay(interval, c.failCount)
+			if delay > c.max || delay < c.max/2 {
+				t.Fatalf("delay %s after %d failures out of [%s, %s]", delay, c.failCount, c.max/2, c.max)
+			}
+		}
+	}
+}
+
+func TestRenewDelayFollowsGrantedLifetime(t *testing.T) {
+	now := time.Now().Unix()
+	interval := 60 * time.Second
+	cases := []struct {
+		name     string
+		lifetime int64
+		want     time.Duration
+	}{
+		{"long lifetime keeps interval", 3600, interval},
+		{"short lifetime renews at half", 90, 45 * time.Second},
+		{"lifetime below interval renews at half", 30, 15 * time.Second},
+		{"no expiry keeps interval", -now, interval},
+	}
+	for _, c := range cases {
+		result := authproto.AuthResult{Timestamp: now, ExpiresAt: now + c.lifetime}
+		if got := renewDelay(interval, result); got != c.want {
+			t.Fatalf("%s: expected %s, got %s", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// authLoops holds when every background auth loop must be back for its next
+// auth, it backs the liveness check of the systemd watchdog
+var authLoops = newAuthLoopDeadlines()
+
+type authLoopDeadline struct {
+	port uint16
+	due  time.Time
+}
+
+type authLoopDeadlines struct {
+	mux   sync.Mutex
+	next  int
+	items map[int]authLoopDeadline
+}
+
+func newAuthLoopDeadlines() *authLoopDeadlines {
+	return &authLoopDeadlines{items: make(map[int]authLoopDeadline)}
+}
+
+// add registers the auth loop of port, it returns the id of the loop
+func (d *authLoopDeadlines) add(port uint16) int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.next++
+	d.items[d.next] = authLoopDeadline{port: port}
+	return d.next
+}
+
+// expect records that loop id comes round again before due
+func (d *authLoopDeadlines) expect(id int, due time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if item, ok := d.items[id]; ok {
+		item.due = due
+		d.items[id] = item
+	}
+}
+
+func (d *authLoopDeadlines) remove(id int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.items, id)
+}
+
+// check fails when an auth loop is overdue
+func (d *authLoopDeadlines) check(now time.Time) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for _, item := range d.items {
+		if !item.due.IsZero() && now.After(item.due) {
+			return fmt.Errorf("auth loop of port %d overdue since %s", item.port, item.due.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// maxAuthTime bounds one auth to server: the otp command and a challenge and
+// a result from every address
+func maxAuthTime(server *serverConfig) time.Duration {
+	return otpCommandTimeout + time.Duration(len(server.addrs()))*2*replyTimeout
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLoopDeadlinesFailOnlyWhenOverdue(t *testing.T) {
+	loops := newAuthLoopDeadlines()
+	now := time.Now()
+	id := loops.add(40022)
+	if err := loops.check(now); err != nil {
+		t.Fatalf("expected a loop without deadline to pass: %v", err)
+	}
+	loops.expect(id, now.Add(time.Minute))
+	if err := loops.check(now); err != nil {
+		t.Fatalf("expected a loop within its deadline to pass: %v", err)
+	}
+	if err := loops.check(now.Add(2 * time.Minute)); err == nil {
+		t.Fatal("expected an overdue loop to fail the check")
+	}
+	loops.remove(id)
+	if err := loops.check(now.Add(2 * time.Minute)); err != nil {
+		t.Fatalf("expected a stopped loop not to be checked: %v", err)
+	}
+}
+
+func TestMaxAuthTimeCoversEveryAddress(t *testing.T) {
+	server := &serverConfig{Addr: "127.0.0.1:40100", AltAddrs: []string{"[::1]:40100"}}
+	if got, want := maxAuthTime(server), otpCommandTimeout+4*replyTimeout; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminGrantRuleID      = "admin_grant"
+	adminUnixPrefix       = "unix:"
+	maxAdminGrantSeconds  = 7 * 24 * 3600
+	maxAdminRequestLength = 4096
+)
+
+type adminClient struct {
+	IP        string `json:"ip"`
+	ClientID  string `json:"client_id"`
+	RuleID    string `json:"rule_id"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type adminPortClients struct {
+	Port     uint16        `json:"port"`
+	BindAddr string        `json:"bind_addr,omitempty"`
+	Protocol string        `json:"protocol"`
+	Clients  []adminClient `json:"clients"`
+}
+
+type adminForwardKey struct {
+	Port     uint16
+	BindAddr string
+	Protocol string
+}
+
+// less orders forwards by port, then by bindaddr and protocol
+func (k adminForwardKey) less(other adminForwardKey) bool {
+	if k.Port != other.Port {
+		return k.Port < other.Port
+	}
+	if k.BindAddr != other.BindAddr {
+		return k.BindAddr < other.BindAddr
+	}
+	return k.Protocol < other.Protocol
+}
+
+type adminChallenge struct {
+	IP        string `json:"ip"`
+	KeyID     string `json:"key_id"`
+	ClientID  string `json:"client_id"`
+	Port      uint16 `json:"port"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type adminConnection struct {
+	SourceAddr string `json:"source_addr"`
+	ClientID   string `json:"client_id"`
+	RuleID     string `json:"rule_id"`
+	Static     bool   `json:"static"`
+	Since      string `json:"since"`
+}
+
+type adminPortConnections struct {
+	Port        uint16            `json:"port"`
+	BindAddr    string            `json:"bind_addr,omitempty"`
+	Protocol    string            `json:"protocol"`
+	Active      int               `json:"active"`
+	ByIP        map[string]int    `json:"by_ip"`
+	Connections []adminConnection `json:"connections"`
+}
+
+type adminBan struct {
+	IP    string `json:"ip"`
+	Until string `json:"until"`
+}
+
+type adminUnbanRequest struct {
+	IP string `json:"ip"`
+}
+
+type adminRevokeRequest struct {
+	IP       string `json:"ip"`
+	ClientID string `json:"client_id"`
+	Port     uint16 `json:"port"`
+}
+
+type adminGrantRequest struct {
+	IP       string `json:"ip"`
+	ClientID string `json:"client_id"`
+	Port     uint16 `json:"port"`
+	Seconds  uint32 `json:"seconds"`
+}
+
+// validateAdminAddr only allows a unix socket or a loopback address, the
+// admin API must never be reachable from the network
+func validateAdminAddr(addr string) error {
+	if strings.HasPrefix(addr, adminUnixPrefix) {
+		if strings.TrimPrefix(addr, adminUnixPrefix) == "" {
+			return fmt.Errorf("admin unix socket path cannot be empty")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("admin addr is invalid: %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin addr must be a loopback address or unix socket")
+	}
+	return nil
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, adminUnixPrefix) {
+		return sockets.listenTCP(addr)
+	}
+	path := strings.TrimPrefix(addr, adminUnixPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		// stale socket of a previous run
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func startAdmin(addr string, runtime *serverRuntime, stop <-chan struct{}) (<-chan struct{}, error) {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen admin addr %s failed: %v", addr, err)
+	}
+	server := &http.Server{
+		Handler:           newAdminHandler(runtime),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+	done := make(chan struct{})
+	go func() {
+		<-stop
+		_ = server.Close()
+	}()
+	go func() {
+		defer close(done)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Warnf("admin server on %s stopped: %v", addr, err)
+		}
+	}()
+	return done, nil
+}
+
+func newAdminHandler(runtime *serverRuntime) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", adminOnly(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		byForward := make(map[adminForwardKey][]adminClient)
+		for _, entry := range listAuthorizedClients(time.Now()) {
+			forward := adminForwardKey{Port: entry.Port, BindAddr: entry.BindAddr, Protocol: entry.Protocol}
+			byForward[forward] = append(byForward[forward], adminClient{
+				IP:        entry.IP,
+				ClientID:  entry.ClientID,
+				RuleID:    entry.RuleID,
+				ExpiresAt: entry.ExpiresAt.Format(time.RFC3339),
+			})
+		}
+		ports := make([]adminPortClients, 0, len(byForward))
+		for forward, clients := range byForward {
+			sort.Slice(clients, func(i, j int) bool {
+				return clients[i].IP+clients[i].ClientID < clients[j].IP+clients[j].ClientID
+			})
+			ports = append(ports, adminPortClients{Port: forward.Port, BindAddr: forward.BindAddr, Protocol: forward.Protocol, Clients: clients})
+		}
+		sort.Slice(ports, func(i, j int) bool {
+			return adminForwardKey{ports[i].Port, ports[i].BindAddr, ports[i].Protocol}.less(
+				adminForwardKey{ports[j].Port, ports[j].BindAddr, ports[j].Protocol})
+		})
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"ports": ports})
+	}))
+	mux.HandleFunc("/challenges", adminOnly(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		entries := pendingChallenges.snapshot()
+		challenges := make([]adminChallenge, 0, len(entries))
+		for _, entry := range entries {
+			challenges = append(challenges, adminChallenge{
+				IP:        entry.IP,
+				KeyID:     entry.KeyID,
+				ClientID:  entry.ClientID,
+				Port:      entry.Port,
+				ExpiresAt: entry.ExpiresAt.Format(time.RFC3339),
+			})
+		}
+		sort.Slice(challenges, func(i, j int) bool { return challenges[i].ExpiresAt < challenges[j].ExpiresAt })
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"challenges": challenges})
+	}))
+	mux.HandleFunc("/connections", adminOnly(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		stats := runtime.connections()
+		ports := make([]adminPortConnections, 0, len(stats))
+		for _, stat := range stats {
+			conns := make([]adminConnection, 0, len(stat.Conns))
+			for _, c := range stat.Conns {
+				conns = append(conns, adminConnection{
+					SourceAddr: c.SourceAddr,
+					ClientID:   c.Grant.ClientID,
+					RuleID:     c.Grant.RuleID,
+					Static:     c.Grant.Static,
+					Since:      c.Since.Format(time.RFC3339),
+				})
+			}
+			sort.Slice(conns, func(i, j int) bool { return conns[i].Since < conns[j].Since })
+			ports = append(ports, adminPortConnections{Port: stat.Port, BindAddr: stat.BindAddr, Protocol: stat.Protocol, Active: stat.Active, ByIP: stat.ByIP, Connections: conns})
+		}
+		sort.Slice(ports, func(i, j int) bool {
+			return adminForwardKey{ports[i].Port, ports[i].BindAddr, ports[i].Protocol}.less(
+				adminForwardKey{ports[j].Port, ports[j].BindAddr, ports[j].Protocol})
+		})
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"ports": ports})
+	}))
+	mux.HandleFunc("/bans", adminOnly(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		entries := authBans.snapshot(time.Now())
+		bans := make([]adminBan, 0, len(entries))
+		for _, entry := range entries {
+			bans = append(bans, adminBan{IP: entry.IP, Until: entry.Until.Format(time.RFC3339)})
+		}
+		sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"bans": bans})
+	}))
+	mux.HandleFunc("/unban", adminOnly(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var req adminUnbanRequest
+		if !readAdminJSON(w, r, &req) {
+			return
+		}
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeAdminError(w, http.StatusBadRequest, "ip is invalid")
+			return
+		}
+		unbanned := authBans.unban(ip.String())
+		log.WithFields(log.Fields{
+			"event":     "admin_unban",
+			"source_ip": ip.String(),
+			"result":    "success",
+			"unbanned":  unbanned,
+		}).Infof("admin unbanned %s", ip.String())
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"unbanned": unbanned})
+	}))
+	mux.HandleFunc("/revoke", adminOnly(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var req adminRevokeRequest
+		if !readAdminJSON(w, r, &req) {
+			return
+		}
+		if req.IP == "" && req.ClientID == "" {
+			writeAdminError(w, http.StatusBadRequest, "ip or client_id is required")
+			return
+		}
+		revoked := revokeAuthorizedClients(req.IP, req.ClientID, req.Port)
+		terminated := runtime.terminateRevoked()
+		log.WithFields(log.Fields{
+			"event":      "admin_revoke",
+			"source_ip":  req.IP,
+			"client_id":  req.ClientID,
+			"port":       req.Port,
+			"result":     "success",
+			"revoked":    revoked,
+			"terminated": terminated,
+		}).Infof("admin revoked %d authorizations", revoked)
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"revoked": revoked, "terminated": terminated})
+	}))
+	mux.HandleFunc("/grant", adminOnly(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var req adminGrantRequest
+		if !readAdminJSON(w, r, &req) {
+			return
+		}
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeAdminError(w, http.StatusBadRequest, "ip is invalid")
+			return
+		}
+		if req.ClientID == "" {
+			req.ClientID = "admin"
+		}
+		if err := validateIdentifier("client_id", req.ClientID); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Seconds == 0 || req.Seconds > maxAdminGrantSeconds {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("seconds allow range 1~%d", maxAdminGrantSeconds))
+			return
+		}
+		expiresAt := time.Now().Add(time.Duration(req.Seconds) * time.Second)
+		if err := grantAuthorizedClient(ip.String(), req.ClientID, req.Port, expiresAt); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.WithFields(log.Fields{
+			"event":     "admin_grant",
+			"source_ip": ip.String(),
+			"client_id": req.ClientID,
+			"port":      req.Port,
+			"result":    "success",
+			"rule_id":   adminGrantRuleID,
+		}).Infof("admin granted %s to port %d until %s", ip, req.Port, expiresAt.Format(time.RFC3339))
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"expires_at": expiresAt.Format(time.RFC3339)})
+	}))
+	return mux
+}
+
+// adminOnly checks the method and the admin token before calling next
+func adminOnly(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().Admin.Token
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			log.WithFields(log.Fields{
+				"event":  "admin_unauthorized",
+				"path":   r.URL.Path,
+				"result": "rejected",
+			}).Warnf("admin request to %s rejected: invalid token", r.URL.Path)
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if r.Method != method {
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func readAdminJSON(w http.ResponseWriter, r *http.Request, out interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestLength))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const adminTokenForTest = "admin-token-abcdefghijklmnopqrstuvwxyz"
+
+func setupAdminForTest(t *testing.T) http.Handler {
+	t.Helper()
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	expiry := uint32(60)
+	conf := &config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		ForwardConfigs: []forwardConfig{
+			{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+			{BindPort: 40023, ForwardAddr: "127.0.0.1:23", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+		},
+	}
+	conf.Admin.Addr = "127.0.0.1:40180"
+	conf.Admin.Token = adminTokenForTest
+	globalConfig = conf
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized ||
+		!authorizeClient("192.0.2.10", "workstation", 40023, token).Authorized ||
+		!authorizeClient("192.0.2.11", "laptop", 40022, token).Authorized {
+		t.Fatal("expected clients to be authorized")
+	}
+	return newAdminHandler(newServerRuntime(""))
+}
+
+func adminRequestForTest(t *testing.T, handler http.Handler, method string, path string, token string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var out map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode admin response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, out
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	handler := setupAdminForTest(t)
+	for _, token := range []string{"", "wrong-token-abcdefghijklmnopqrstuvwxyz"} {
+		if code, _ := adminRequestForTest(t, handler, http.MethodGet, "/clients", token, ""); code != http.StatusUnauthorized {
+			t.Fatalf("expected token %q to be rejected, got %d", token, code)
+		}
+	}
+	if code, _ := adminRequestForTest(t, handler, http.MethodPost, "/revoke", "", `{"ip":"192.0.2.10"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoke without token to be rejected, got %d", code)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("rejected admin request must not revoke")
+	}
+}
+
+func TestAdminListsClientsPerPort(t *testing.T) {
+	handler := setupAdminForTest(t)
+	code, out := adminRequestForTest(t, handler, http.MethodGet, "/clients", adminTokenForTest, "")
+	if code != http.StatusOK {
+		t.Fatalf("list clients failed: %d %v", code, out)
+	}
+	ports := out["ports"].([]interface{})
+	if len(ports) != 2 {
+		t.Fatalf("expected two ports, got %v", ports)
+	}
+	first := ports[0].(map[string]interface{})
+	if first["port"].(float64) != 40022 || len(first["clients"].([]interface{})) != 2 {
+		t.Fatalf("unexpected clients of port 40022: %v", first)
+	}
+	client := first["clients"].([]interface{})[0].(map[string]interface{})
+	if client["ip"] != "192.0.2.10" || client["client_id"] != "workstation" || client["expires_at"] == "" {
+		t.Fatalf("unexpected client entry: %v", client)
+	}
+	if code, _ := adminRequestForTest(t, handler, http.MethodPost, "/clients", adminTokenForTest, ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected wrong method to be rejected, got %d", code)
+	}
+}
+
+func TestAdminRevokesByIPAndClientID(t *testing.T) {
+	handler := setupAdminForTest(t)
+	code, out := adminRequestForTest(t, handler, http.MethodPost, "/revoke", adminTokenForTest, `{"client_id":"workstation"}`)
+	if code != http.StatusOK || out["revoked"].(float64) != 2 {
+		t.Fatalf("expected both authorizations of workstation to be revoked: %d %v", code, out)
+	}
+	if isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected revoked client to lose authorization")
+	}
+	code, out = adminRequestForTest(t, handler, http.MethodPost, "/revoke", adminTokenForTest, `{"ip":"192.0.2.11"}`)
+	if code != http.StatusOK || out["revoked"].(float64) != 1 {
+		t.Fatalf("expected authorization of ip to be revoked: %d %v", code, out)
+	}
+	if code, _ := adminRequestForTest(t, handler, http.MethodPost, "/revoke", adminTokenForTest, `{}`); code != http.StatusBadRequest {
+		t.Fatalf("expected revoke without filter to be rejected, got %d", code)
+	}
+}
+
+func TestAdminGrantsTimeLimitedAccess(t *testing.T) {
+	handler := setupAdminForTest(t)
+	code, out := adminRequestForTest(t, handler, http.MethodPost, "/grant", adminTokenForTest, `{"ip":"198.51.100.7","port":40023,"seconds":60}`)
+	if code != http.StatusOK {
+		t.Fatalf("grant failed: %d %v", code, out)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("198.51.100.7"), "admin") {
+		t.Fatal("expected granted ip to be authorized")
+	}
+	if isIPAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("198.51.100.7")) {
+		t.Fatal("grant must be limited to its port")
+	}
+	expiresAt, err := time.Parse(time.RFC3339, out["expires_at"].(string))
+	if err != nil || expiresAt.After(time.Now().Add(61*time.Second)) {
+		t.Fatalf("unexpected grant expiry %v: %v", out["expires_at"], err)
+	}
+	for _, body := range []string{
+		`{"ip":"198.51.100.7","port":29999,"seconds":60}`,
+		`{"ip":"not-an-ip","port":40023,"seconds":60}`,
+		`{"ip":"198.51.100.7","port":40023,"seconds":0}`,
+		`{"ip":"198.51.100.7","port":40023,"seconds":60,"token":"x"}`,
+	} {
+		if code, _ := adminRequestForTest(t, handler, http.MethodPost, "/grant", adminTokenForTest, body); code != http.StatusBadRequest {
+			t.Fatalf("expected grant %s to be rejected, got %d", body, code)
+		}
+	}
+}
+
+func TestAdminListsPendingChallengesAndConnections(t *testing.T) {
+	handler := setupAdminForTest(t)
+	previous := pendingChallenges
+	pendingChallenges = newPendingChallengeStore(10, 4)
+	defer func() {
+		pendingChallenges = previous
+	}()
+	pendingChallenges.add(pendingChallengeKey{IP: "192.0.2.10", KeyID: "primary-2026-06", ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce-value", ServerNonce: "server-nonce-value"}, time.Now().Add(time.Minute))
+	code, out := adminRequestForTest(t, handler, http.MethodGet, "/challenges", adminTokenForTest, "")
+	if code != http.StatusOK || len(out["challenges"].([]interface{})) != 1 {
+		t.Fatalf("expected one pending challenge: %d %v", code, out)
+	}
+	if strings.Contains(toJSONForTest(out), "nonce-value") {
+		t.Fatal("pending challenge list must not expose nonces")
+	}
+	code, out = adminRequestForTest(t, handler, http.MethodGet, "/connections", adminTokenForTest, "")
+	if code != http.StatusOK {
+		t.Fatalf("list connections failed: %d %v", code, out)
+	}
+}
+
+func TestAdminAddrMustBeLocal(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:40180", "[::1]:40180", "localhost:40180", "unix:/run/authserver/admin.sock"} {
+		if err := validateAdminAddr(addr); err != nil {
+			t.Fatalf("expected %s to be allowed: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:40180", ":40180", "192.0.2.10:40180", "unix:"} {
+		if err := validateAdminAddr(addr); err == nil {
+			t.Fatalf("expected %s to be rejected", addr)
+		}
+	}
+}
+
+func TestServerConfigValidatesAdminAPI(t *testing.T) {
+	cfg := config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+	}
+	cfg.Admin.Addr = "127.0.0.1:40180"
+	cfg.Admin.Token = "admin"
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected weak admin token to be rejected")
+	}
+	cfg.Admin.Token = adminTokenForTest
+	cfg.Admin.Addr = "0.0.0.0:40180"
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected public admin addr to be rejected")
+	}
+	cfg.Admin.Addr = "127.0.0.1:40180"
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatalf("expected admin config to be valid: %v", err)
+	}
+}
+
+func toJSONForTest(v interface{}) string {
+	content, _ := json.Marshal(v)
+	return string(content)
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"connauth/utils"
 	"connauth/utils/authproto"
-	"encoding/json"
+	"crypto/subtle"
 	"fmt"
 	"github.com/ryanuber/go-glob"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,25 +22,33 @@ type authorizedClientKey struct {
 
 type authorizedClientState struct {
 	ExpiresAt time.Time
+	RuleID    string
 }
 
 type authResult struct {
 	Authorized bool
 	Renewed    bool
+	ExpiresAt  time.Time
 	RuleScope  string
 	RuleID     string
 	RuleType   string
+	Ticket     string // one-time ticket of a forward with requireticket
 }
 
-var allClientList map[*forwardConfig]map[authorizedClientKey]authorizedClientState
+// authorized clients of each forward, keyed by the forward id so the state survives a config reload
+var allClientList map[string]map[authorizedClientKey]authorizedClientState
 var muxClient sync.Mutex
+
+// clientListAdds counts the clients added to allClientList, a udp forward
+// checks the sources it rejected again once it changed
+var clientListAdds uint64
 var pendingChallenges = newPendingChallengeStore(10000, 16)
 var maxAuthorizedClients = 10000
 
 func refreshClientList(cfg *forwardConfig) {
 	muxClient.Lock()
 	defer muxClient.Unlock()
-	list := allClientList[cfg]
+	list := allClientList[cfg.id()]
 	if len(list) == 0 {
 		return
 	}
@@ -72,40 +83,92 @@ func isIPMatchRule(ip net.IP, rule string) bool {
 	}
 }
 
-func isIPMatchRules(ip net.IP, rules []accessRule) bool {
+// matchIPRules returns the rule id of the first rule matching ip
+func matchIPRules(ip net.IP, rules []accessRule) (string, bool) {
 	for _, r := range rules {
 		value := r.resolvedValue
 		if value == "" && r.IP != "" {
 			value = r.IP
 		}
 		if isIPMatchRule(ip, value) {
-			return true
+			return r.ruleID, true
 		}
 	}
-	return false
+	return "", false
 }
 
-func isIPAuthed(cfg *forwardConfig, ip net.IP) bool {
+func isIPMatchRules(ip net.IP, rules []accessRule) bool {
+	_, ok := matchIPRules(ip, rules)
+	return ok
+}
+
+// connectionGrant is the authorization that allowed a forwarded connection
+type connectionGrant struct {
+	IP       string
+	ClientID string
+	RuleID   string
+	Static   bool // allowed by allowips or globalallowips instead of a token
+}
+
+// grantConnection returns the authorization that allows ip to connect to cfg.
+// When several clients share the IP, the one that expires last is used.
+func grantConnection(cfg *forwardConfig, ip net.IP) (connectionGrant, bool) {
 	if isIPDenied(ip) {
-		return false
+		return connectionGrant{}, false
 	}
-	if isStaticIPAllowed(cfg, ip) {
-		return true
+	if ruleID, ok := staticIPRule(cfg, ip); ok {
+		return connectionGrant{IP: ip.String(), RuleID: ruleID, Static: true}, true
 	}
 	muxClient.Lock()
 	defer muxClient.Unlock()
-	list := allClientList[cfg]
+	list := allClientList[cfg.id()]
 	now := time.Now()
+	var grant connectionGrant
+	var latest time.Time
 	for key, state := range list {
 		if key.IP != ip.String() {
 			continue
 		}
-		if state.ExpiresAt.After(now) {
-			return true
+		if !state.ExpiresAt.After(now) {
+			delete(list, key)
+			continue
+		}
+		if state.ExpiresAt.After(latest) {
+			latest = state.ExpiresAt
+			grant = connectionGrant{IP: key.IP, ClientID: key.ClientID, RuleID: state.RuleID}
 		}
-		delete(list, key)
 	}
-	return false
+	return grant, !latest.IsZero()
+}
+
+// revokedReason tells why grant no longer allows a connection to cfg, it
+// returns an empty string while the grant is still valid
+func revokedReason(cfg *forwardConfig, grant connectionGrant, now time.Time) string {
+	ip := net.ParseIP(grant.IP)
+	if isIPDenied(ip) {
+		return "ip_denied"
+	}
+	if grant.Static {
+		if _, ok := staticIPRule(cfg, ip); ok {
+			return ""
+		}
+		return "ip_not_allowed"
+	}
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	state, ok := allClientList[cfg.id()][authorizedClientKey{IP: grant.IP, ClientID: grant.ClientID}]
+	if !ok {
+		return "auth_revoked"
+	}
+	if !state.ExpiresAt.After(now) {
+		return "auth_expired"
+	}
+	return ""
+}
+
+func isIPAuthed(cfg *forwardConfig, ip net.IP) bool {
+	_, ok := grantConnection(cfg, ip)
+	return ok
 }
 
 func isClientAuthed(cfg *forwardConfig, ip net.IP, clientID string) bool {
@@ -117,7 +180,7 @@ func isClientAuthed(cfg *forwardConfig, ip net.IP, clientID string) bool {
 	}
 	muxClient.Lock()
 	defer muxClient.Unlock()
-	list := allClientList[cfg]
+	list := allClientList[cfg.id()]
 	key := authorizedClientKey{IP: ip.String(), ClientID: clientID}
 	state, ok := list[key]
 	if !ok {
@@ -131,73 +194,174 @@ func isClientAuthed(cfg *forwardConfig, ip net.IP, clientID string) bool {
 }
 
 func isStaticIPAllowed(cfg *forwardConfig, ip net.IP) bool {
-	if isIPMatchRules(ip, globalConfig.GlobalAllowIPs) {
-		return true
-	}
-	if isIPMatchRules(ip, cfg.AllowIPs) {
-		return true
+	_, ok := staticIPRule(cfg, ip)
+	return ok
+}
+
+func staticIPRule(cfg *forwardConfig, ip net.IP) (string, bool) {
+	if ruleID, ok := matchIPRules(ip, currentConfig().GlobalAllowIPs); ok {
+		return ruleID, true
 	}
-	return false
+	return matchIPRules(ip, cfg.AllowIPs)
 }
 
+// isIPDenied checks globaldenyips and the IPs banned for failing auth too often
 func isIPDenied(ip net.IP) bool {
-	return isIPMatchRules(ip, globalConfig.GlobalDenyIPs)
+	return isIPMatchRules(ip, currentConfig().GlobalDenyIPs) || authBans.isBanned(ip.String(), time.Now())
 }
 
-func matchTokenRules(token string, scope string, rules []accessRule) (authResult, bool) {
+// clientCredentials are the factors a client proves in a challenge response
+type clientCredentials struct {
+	Token       string
+	OTP         []byte // see authproto.OTPProof, empty without a second factor
+	ServerNonce string
+	Client      authorizedClientKey // a totp code is good for this client only
+}
+
+// tokenRule returns the token, id and type of token rule index of scope, a
+// rule that was not resolved by CheckValid is an inline token
+func (r accessRule) tokenRule(scope string, index int) (string, string, string) {
+	if r.resolvedValue == "" && r.Token != "" {
+		return r.Token, inlineRuleID(scope, "", "token", index), "inline_token"
+	}
+	return r.resolvedValue, r.ruleID, r.ruleType
+}
+
+// hasTokenRule tells whether ruleID is one of the token rules that authorize
+// clients on cfg
+func hasTokenRule(conf *config, cfg *forwardConfig, ruleID string) bool {
+	for scope, rules := range map[string][]accessRule{"global": conf.GlobalAllowTokens, "forward": cfg.AllowTokens} {
+		for i, r := range rules {
+			if _, id, _ := r.tokenRule(scope, i+1); id != "" && id == ruleID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchTokenRules returns the first rule matching the token, a rule with a
+// totp secret also needs a current code bound to the server nonce and not used
+// by another client, see usedOTPCodes. Every rule is evaluated so the time
+// taken does not tell which rule matched, tokens only runs argon2id once per
+// distinct tokenhash.
+func matchTokenRules(creds clientCredentials, tokens *tokenCheck, scope string, rules []accessRule, now time.Time) (authResult, bool) {
+	var matched authResult
+	found := false
 	for i, r := range rules {
-		value := r.resolvedValue
-		ruleID := r.ruleID
-		ruleType := r.ruleType
-		if value == "" && r.Token != "" {
-			value = r.Token
-			ruleID = inlineRuleID(scope, 0, "token", i+1)
-			ruleType = "inline_token"
-		}
-		if glob.Glob(value, token) {
-			return authResult{
+		value, ruleID, ruleType := r.tokenRule(scope, i+1)
+		var ok bool
+		switch {
+		case r.tokenHash != nil:
+			ok = tokens.verify(r.tokenHash)
+		case r.glob:
+			ok = glob.Glob(value, creds.Token)
+		default:
+			ok = value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(creds.Token)) == 1
+		}
+		if ok && r.totpSecret != nil {
+			step, valid := authproto.MatchOTP(r.totpSecret, creds.OTP, creds.ServerNonce, now)
+			// the code is only taken by the rule that authorizes the client
+			if !valid || !found && !usedOTPCodes.use(r.totpSecret, step, creds.Client) {
+				log.Debugf("token rule %s matched without a valid totp code", ruleID)
+				ok = false
+			}
+		}
+		if ok && !found {
+			matched = authResult{
 				Authorized: true,
 				RuleScope:  scope,
 				RuleID:     ruleID,
 				RuleType:   ruleType,
-			}, true
+			}
+			found = true
 		}
 	}
-	return authResult{}, false
+	return matched, found
 }
 
 func authClient(req utils.AuthConfig, ip string) bool {
 	return authorizeClient(ip, "", req.Port, req.Token).Authorized
 }
 
+// authorizeClient authorizes a client by token alone, rules with totp never
+// match it
 func authorizeClient(ip string, clientID string, port uint16, token string) authResult {
-	for i := range globalConfig.ForwardConfigs {
-		cfg := &globalConfig.ForwardConfigs[i]
+	return authorizeCredentials(ip, clientID, port, "", clientCredentials{Token: token}, false)
+}
+
+// authorizeCredentials authorizes the client on every forward of port whose
+// rules accept creds, or only on the forward bound to bindAddr when set. The
+// result is that of the first such forward, with the earliest expiry so a
+// renewal in time keeps all of them. A ticket is only issued when the client
+// wants one, renewals never use it.
+func authorizeCredentials(ip string, clientID string, port uint16, bindAddr string, creds clientCredentials, wantTicket bool) authResult {
+	conf := currentConfig()
+	now := time.Now()
+	var authorized authResult
+	creds.Client = authorizedClientKey{IP: ip, ClientID: clientID}
+	tokens := newTokenCheck(creds.Token)
+	var globalResult authResult
+	globalOK, globalChecked := false, false
+	for i := range conf.ForwardConfigs {
+		cfg := &conf.ForwardConfigs[i]
 		if cfg.BindPort != port {
 			continue
 		}
-		result, ok := matchTokenRules(token, "global", globalConfig.GlobalAllowTokens)
+		if bindAddr != "" && !sameListenAddr(net.ParseIP(bindAddr), 0, net.ParseIP(cfg.BindAddr), 0) {
+			continue
+		}
+		if !globalChecked {
+			globalResult, globalOK = matchTokenRules(creds, tokens, "global", conf.GlobalAllowTokens, now)
+			globalChecked = true
+		}
+		// forward rules are evaluated even after a global match, see
+		// matchTokenRules
+		result, ok := matchTokenRules(creds, tokens, "forward", cfg.AllowTokens, now)
+		if globalOK {
+			result, ok = globalResult, true
+		}
 		if !ok {
-			result, ok = matchTokenRules(token, "forward", cfg.AllowTokens)
+			continue
 		}
-		if ok {
-			muxClient.Lock()
-			key := authorizedClientKey{IP: ip, ClientID: clientID}
-			list := allClientList[cfg]
-			now := time.Now()
-			cleanupAuthorizedClientList(list, now)
-			_, exists := list[key]
-			if !exists && maxAuthorizedClients > 0 && len(list) >= maxAuthorizedClients {
-				muxClient.Unlock()
-				return authResult{}
-			}
-			list[key] = authorizedClientState{ExpiresAt: now.Add(time.Second * time.Duration(*cfg.AuthExpiredTime))}
+		muxClient.Lock()
+		key := authorizedClientKey{IP: ip, ClientID: clientID}
+		list := allClientList[cfg.id()]
+		cleanupAuthorizedClientList(list, now)
+		_, exists := list[key]
+		if !exists && maxAuthorizedClients > 0 && len(list) >= maxAuthorizedClients {
 			muxClient.Unlock()
-			result.Renewed = exists
-			return result
+			continue
+		}
+		expiresAt := now.Add(time.Second * time.Duration(*cfg.AuthExpiredTime))
+		list[key] = authorizedClientState{ExpiresAt: expiresAt, RuleID: result.RuleID}
+		if !exists {
+			atomic.AddUint64(&clientListAdds, 1)
+		}
+		muxClient.Unlock()
+		result.Renewed = exists
+		result.ExpiresAt = expiresAt
+		if !authorized.Authorized {
+			authorized = result
+		} else if expiresAt.Before(authorized.ExpiresAt) {
+			authorized.ExpiresAt = expiresAt
+		}
+		if wantTicket && cfg.RequireTicket && authorized.Ticket == "" {
+			// a ticket is good for every forward of the port the client is authorized on
+			ticket, err := connectionTickets.issue(connectionTicket{
+				BindPort:  cfg.BindPort,
+				IP:        ip,
+				ClientID:  clientID,
+				RuleID:    result.RuleID,
+				ExpiresAt: expiresAt,
+			})
+			if err != nil {
+				log.Warnf("ticket for %s to port %d not issued: %v", ip, cfg.BindPort, err)
+			}
+			authorized.Ticket = ticket
 		}
 	}
-	return authResult{}
+	return authorized
 }
 
 func cleanupAuthorizedClientList(list map[authorizedClientKey]authorizedClientState, now time.Time) {
@@ -213,7 +377,7 @@ func waitForAuth(addr string, stop <-chan struct{}) (<-chan struct{}, error) {
 	if err != nil {
 		return nil, fmt.Errorf("resolve authaddr %s failed: %v", addr, err)
 	}
-	authWaiter, err := net.ListenUDP("udp", udpAddr)
+	authWaiter, err := sockets.listenUDP(udpAddr)
 	if err != nil {
 		return nil, fmt.Errorf("bind to authaddr %s failed: %v", addr, err)
 	}
@@ -227,9 +391,18 @@ func waitForAuth(addr string, stop <-chan struct{}) (<-chan struct{}, error) {
 	}()
 	go func() {
 		defer wg.Done()
+		defer atomic.StoreInt64(&authLoopBeat, 0)
 		for {
+			// the deadline lets the loop report that it is alive while idle,
+			// see checkAlive
+			now := time.Now()
+			atomic.StoreInt64(&authLoopBeat, now.UnixNano())
+			_ = authWaiter.SetReadDeadline(now.Add(authLoopTick))
 			buf := make([]byte, 4096)
 			n, peer, err := authWaiter.ReadFromUDP(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
 			if err != nil {
 				select {
 				case <-stop:
@@ -252,6 +425,9 @@ func waitForAuth(addr string, stop <-chan struct{}) (<-chan struct{}, error) {
 		for {
 			deleted := pendingChallenges.cleanup(time.Now())
 			log.Debugf("pending challenge count delete: %d", deleted)
+			keypairSessions.cleanup(time.Now())
+			connectionTickets.cleanup(time.Now())
+			cleanupAuthLimits(time.Now())
 			select {
 			case <-stop:
 				return
@@ -267,58 +443,95 @@ func waitForAuth(addr string, stop <-chan struct{}) (<-chan struct{}, error) {
 }
 
 func handleAuthPacket(conn *net.UDPConn, peer *net.UDPAddr, packet []byte) {
-	var env authproto.Envelope
-	if err := json.Unmarshal(packet, &env); err != nil {
+	now := time.Now()
+	if authBans.isBanned(peer.IP.String(), now) {
+		authPacketsIgnored.Inc("banned")
+		log.Debugf("auth packet from %s ignored: banned", peer.IP.String())
+		return
+	}
+	if !allowAuthPacket(peer.IP, now) {
+		authPacketsIgnored.Inc("rate_limited")
+		log.Debugf("auth packet from %s ignored: rate limited", peer.IP.String())
+		return
+	}
+	env, format, err := authproto.DecodeEnvelope(packet)
+	if err != nil {
+		authPacketsIgnored.Inc("invalid_envelope")
 		log.Debugf("auth packet from %s ignored: invalid envelope", peer.IP.String())
 		return
 	}
+	authPacketsReceived.Inc(format)
 	if err := env.Validate(); err != nil {
+		authPacketsIgnored.Inc("invalid_envelope")
 		log.Debugf("auth packet from %s ignored: invalid envelope", peer.IP.String())
 		return
 	}
-	if env.ServerID != globalConfig.ServerID {
+	conf := currentConfig()
+	if !conf.acceptsWireFormat(format) {
+		authPacketsIgnored.Inc("wire_format_disabled")
+		log.Debugf("auth packet from %s ignored: %s wire format disabled", peer.IP.String(), format)
+		return
+	}
+	if !env.MatchServer(conf.ServerID) {
+		authPacketsIgnored.Inc("server_mismatch")
 		log.Debugf("auth packet from %s ignored: server mismatch", peer.IP.String())
 		return
 	}
-	key, ok := globalConfig.authKeyByID(env.KeyID)
+	env.ServerID = conf.ServerID
+	if env.Keypair() {
+		handleKeypairPacket(conn, peer, env, format, now)
+		return
+	}
+	key, ok := conf.authKeyByID(env.KeyID)
 	if !ok {
+		authPacketsIgnored.Inc("unknown_key_id")
 		log.Debugf("auth packet from %s ignored: unknown key id", peer.IP.String())
 		return
 	}
 	plain, err := authproto.Open([]byte(key), authproto.Context{KeyID: env.KeyID, ServerID: env.ServerID}, env.Payload)
 	if err != nil {
+		authPacketsIgnored.Inc("decrypt_failed")
 		log.Debugf("auth packet from %s ignored: decrypt failed", peer.IP.String())
+		recordDecryptFailure(peer.IP, "decrypt_failed", now)
 		return
 	}
-	var header struct {
-		Type string `json:"type"`
-	}
-	if err := json.Unmarshal(plain, &header); err != nil {
+	msgType, err := authproto.MessageTypeOf(plain, format)
+	if err != nil {
+		authPacketsIgnored.Inc("invalid_payload")
 		log.Debugf("auth packet from %s ignored: invalid payload", peer.IP.String())
 		return
 	}
-	switch header.Type {
+	switch msgType {
 	case authproto.MessageTypeChallengeRequest:
-		handleChallengeRequest(conn, peer, env, key, plain)
+		handleChallengeRequest(conn, peer, env, format, key, plain)
 	case authproto.MessageTypeChallengeResponse:
-		handleChallengeResponse(peer, env, plain)
+		handleChallengeResponse(conn, peer, env, format, key, plain)
 	default:
+		authPacketsIgnored.Inc("unknown_message_type")
 		log.Debugf("auth packet from %s ignored: unknown message type", peer.IP.String())
 	}
 }
 
-func handleChallengeRequest(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, key string, plain []byte) {
+func handleChallengeRequest(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, key string, plain []byte) {
 	var req authproto.ChallengeRequest
-	if err := json.Unmarshal(plain, &req); err != nil || req.Validate(time.Now()) != nil {
+	if err := authproto.DecodeMessage(plain, format, &req); err != nil || req.Validate(time.Now()) != nil {
+		authPacketsIgnored.Inc("invalid_request")
 		log.Debugf("challenge request from %s ignored: invalid request", peer.IP.String())
 		return
 	}
-	if req.ServerID != globalConfig.ServerID {
+	if req.ServerID != currentConfig().ServerID {
+		authPacketsIgnored.Inc("server_mismatch")
 		log.Debugf("challenge request from %s ignored: server mismatch", peer.IP.String())
 		return
 	}
+	if env.Keypair() && req.ClientID != env.ClientID {
+		authPacketsIgnored.Inc("client_mismatch")
+		log.Debugf("challenge request from %s ignored: client mismatch", peer.IP.String())
+		return
+	}
 	serverNonce, err := authproto.RandomNonceString()
 	if err != nil {
+		authPacketsIgnored.Inc("nonce_generation_failed")
 		log.Warnf("challenge request from %s ignored: nonce generation failed", peer.IP.String())
 		return
 	}
@@ -333,6 +546,7 @@ func handleChallengeRequest(conn *net.UDPConn, peer *net.UDPAddr, env authproto.
 		ServerNonce: serverNonce,
 	}
 	if !pendingChallenges.add(pendingKey, expiresAt) {
+		authPacketsIgnored.Inc("pending_limit_reached")
 		log.Debugf("challenge request from %s ignored: pending limit reached", peer.IP.String())
 		return
 	}
@@ -345,31 +559,58 @@ func handleChallengeRequest(conn *net.UDPConn, peer *net.UDPAddr, env authproto.
 		ServerNonce: serverNonce,
 		ExpiresAt:   expiresAt.Unix(),
 	}
-	body, err := json.Marshal(challenge)
-	if err != nil {
-		log.Warnf("challenge request from %s ignored: marshal failed", peer.IP.String())
+	challenge.Signature = signServerMessage(env, key, challenge)
+	if err := writeSealedMessage(conn, peer, env, format, key, challenge); err != nil {
+		log.Warnf("challenge request from %s ignored: %v", peer.IP.String(), err)
 		return
 	}
-	sealed, err := authproto.Seal([]byte(key), authproto.Context{KeyID: env.KeyID, ServerID: env.ServerID}, body)
+	authChallengesIssued.Inc()
+}
+
+// signServerMessage signs a Challenge or AuthResult with the identity key so
+// clients can verify the server, it returns nil without an identity key
+func signServerMessage(env authproto.Envelope, key string, msg interface{}) []byte {
+	identity := currentConfig().identityKey
+	if identity == nil {
+		return nil
+	}
+	signature, err := authproto.SignServerMessage(identity, env.Context(), []byte(key), msg)
 	if err != nil {
-		log.Warnf("challenge request from %s ignored: seal failed", peer.IP.String())
-		return
+		log.Warnf("sign %T failed: %v", msg, err)
+		return nil
 	}
-	resp, err := json.Marshal(authproto.Envelope{KeyID: env.KeyID, ServerID: env.ServerID, Payload: sealed})
+	return signature
+}
+
+// writeSealedMessage replies in the wire format of the request
+func writeSealedMessage(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, key string, msg interface{}) error {
+	body, err := authproto.EncodeMessage(msg, format)
 	if err != nil {
-		log.Warnf("challenge request from %s ignored: envelope failed", peer.IP.String())
-		return
+		return fmt.Errorf("marshal failed")
+	}
+	sealed, err := authproto.Seal([]byte(key), env.Context(), body)
+	if err != nil {
+		return fmt.Errorf("seal failed")
+	}
+	reply := authproto.Envelope{KeyID: env.KeyID, ServerID: env.ServerID, ClientID: env.ClientID, EphemeralKey: env.EphemeralKey, Payload: sealed}
+	resp, err := authproto.EncodeEnvelope(reply, format)
+	if err != nil {
+		return fmt.Errorf("envelope failed")
 	}
-	_, _ = conn.WriteToUDP(resp, peer)
+	if _, err := conn.WriteToUDP(resp, peer); err != nil {
+		return fmt.Errorf("write failed: %v", err)
+	}
+	return nil
 }
 
-func handleChallengeResponse(peer *net.UDPAddr, env authproto.Envelope, plain []byte) {
+func handleChallengeResponse(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, key string, plain []byte) {
 	var resp authproto.ChallengeResponse
-	if err := json.Unmarshal(plain, &resp); err != nil || resp.Validate(time.Now()) != nil {
+	if err := authproto.DecodeMessage(plain, format, &resp); err != nil || resp.Validate(time.Now()) != nil {
+		authPacketsIgnored.Inc("invalid_response")
 		log.Debugf("challenge response from %s ignored: invalid response", peer.IP.String())
 		return
 	}
-	key := pendingChallengeKey{
+	pendingKey := pendingChallengeKey{
 		IP:          peer.IP.String(),
 		KeyID:       env.KeyID,
 		ServerID:    resp.ServerID,
@@ -378,11 +619,37 @@ func handleChallengeResponse(peer *net.UDPAddr, env authproto.Envelope, plain []
 		ClientNonce: resp.ClientNonce,
 		ServerNonce: resp.ServerNonce,
 	}
-	if !pendingChallenges.consume(key, time.Now()) {
+	if !pendingChallenges.consume(pendingKey, time.Now()) {
+		authPacketsIgnored.Inc("no_pending_challenge")
 		log.Debugf("challenge response from %s ignored: no pending challenge", peer.IP.String())
 		return
 	}
-	result := authorizeClient(peer.IP.String(), resp.ClientID, resp.Port, resp.Token)
+	creds := clientCredentials{Token: resp.Token, OTP: resp.OTP, ServerNonce: resp.ServerNonce}
+	result := authorizeCredentials(peer.IP.String(), resp.ClientID, resp.Port, resp.BindAddr, creds, resp.WantTicket)
+	reply := authproto.AuthResult{
+		Type:        authproto.MessageTypeAuthResult,
+		ServerID:    resp.ServerID,
+		ClientID:    resp.ClientID,
+		Port:        resp.Port,
+		ClientNonce: resp.ClientNonce,
+		ServerNonce: resp.ServerNonce,
+		Result:      authproto.AuthResultDenied,
+		Reason:      authproto.AuthReasonNotAllowed,
+		Timestamp:   time.Now().Unix(),
+	}
+	if result.Authorized {
+		reply.Result = authproto.AuthResultAuthorized
+		reply.Reason = authproto.AuthReasonOK
+		reply.ExpiresAt = result.ExpiresAt.Unix()
+		reply.Ticket = result.Ticket
+		if result.Renewed {
+			reply.Result = authproto.AuthResultRenewed
+		}
+	}
+	reply.Signature = signServerMessage(env, key, reply)
+	if err := writeSealedMessage(conn, peer, env, format, key, reply); err != nil {
+		log.Warnf("auth result to %s not sent: %v", peer.IP.String(), err)
+	}
 	if result.Authorized {
 		fields := log.Fields{
 			"event":      "auth_success",
@@ -396,13 +663,16 @@ func handleChallengeResponse(peer *net.UDPAddr, env authproto.Envelope, plain []
 			"rule_type":  result.RuleType,
 		}
 		if result.Renewed {
+			authResults.Inc("renewed")
 			fields["event"] = "auth_renewed"
 			fields["result"] = "renewed"
 			log.WithFields(fields).Debugf("Auth IP %v renewed to port %d", peer.IP, resp.Port)
 		} else {
+			authResults.Inc("success")
 			log.WithFields(fields).Infof("Auth IP %v to port %d", peer.IP, resp.Port)
 		}
 	} else {
+		authResults.Inc("failed")
 		log.WithFields(log.Fields{
 			"event":     "auth_failed",
 			"source_ip": peer.IP.String(),
@@ -412,14 +682,159 @@ func handleChallengeResponse(peer *net.UDPAddr, env authproto.Envelope, plain []
 			"result":    "failed",
 			"reason":    "token_or_port_not_allowed",
 		}).Warnf("Auth IP %v failed: port %d", peer.IP, resp.Port)
+		recordAuthFailure(peer.IP, "auth_failed", time.Now())
 	}
 }
 
 func initClientList() {
 	muxClient.Lock()
 	defer muxClient.Unlock()
-	allClientList = make(map[*forwardConfig]map[authorizedClientKey]authorizedClientState)
-	for i := range globalConfig.ForwardConfigs {
-		allClientList[&globalConfig.ForwardConfigs[i]] = make(map[authorizedClientKey]authorizedClientState)
+	allClientList = make(map[string]map[authorizedClientKey]authorizedClientState)
+	conf := currentConfig()
+	for i := range conf.ForwardConfigs {
+		allClientList[conf.ForwardConfigs[i].id()] = make(map[authorizedClientKey]authorizedClientState)
+	}
+}
+
+// syncClientList keeps the authorizations of forwards that are still in conf,
+// drops forwards that were removed and prepares empty lists for new forwards
+func syncClientList(conf *config) {
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	ids := make(map[string]bool)
+	for i := range conf.ForwardConfigs {
+		id := conf.ForwardConfigs[i].id()
+		ids[id] = true
+		if _, ok := allClientList[id]; !ok {
+			allClientList[id] = make(map[authorizedClientKey]authorizedClientState)
+		}
+	}
+	for id := range allClientList {
+		if !ids[id] {
+			delete(allClientList, id)
+		}
+	}
+}
+
+// forwardID is the id of a forward, tcp forwards keep the plain address so
+// ids written before udp forwards existed stay valid
+func forwardID(bindAddr string, port uint16, protocol string) string {
+	id := net.JoinHostPort(bindAddr, strconv.Itoa(int(port)))
+	if protocol == "udp" {
+		id += "/udp"
+	}
+	return id
+}
+
+// splitForwardID returns the bindaddr, bindport and protocol of a forward id
+func splitForwardID(id string) (string, uint16, string) {
+	protocol := "tcp"
+	if strings.HasSuffix(id, "/udp") {
+		id = strings.TrimSuffix(id, "/udp")
+		protocol = "udp"
+	}
+	host, portText, _ := net.SplitHostPort(id)
+	port, _ := strconv.ParseUint(portText, 10, 16)
+	return host, uint16(port), protocol
+}
+
+type authorizedClientEntry struct {
+	Port      uint16
+	BindAddr  string
+	Protocol  string
+	IP        string
+	ClientID  string
+	RuleID    string
+	ExpiresAt time.Time
+}
+
+func listAuthorizedClients(now time.Time) []authorizedClientEntry {
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	var entries []authorizedClientEntry
+	for id, list := range allClientList {
+		bindAddr, port, protocol := splitForwardID(id)
+		for key, state := range list {
+			if !state.ExpiresAt.After(now) {
+				continue
+			}
+			entries = append(entries, authorizedClientEntry{
+				Port:      port,
+				BindAddr:  bindAddr,
+				Protocol:  protocol,
+				IP:        key.IP,
+				ClientID:  key.ClientID,
+				RuleID:    state.RuleID,
+				ExpiresAt: state.ExpiresAt,
+			})
+		}
+	}
+	return entries
+}
+
+// revokeAuthorizedClients removes the authorizations matching ip and clientID,
+// an empty value matches any, and port 0 matches all ports. A port covers
+// the forwards of all its bindaddrs.
+func revokeAuthorizedClients(ip string, clientID string, port uint16) int {
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	revoked := 0
+	for id, list := range allClientList {
+		if _, p, _ := splitForwardID(id); port != 0 && p != port {
+			continue
+		}
+		for key := range list {
+			if (ip == "" || key.IP == ip) && (clientID == "" || key.ClientID == clientID) {
+				delete(list, key)
+				revoked++
+			}
+		}
+	}
+	return revoked
+}
+
+// grantAuthorizedClient authorizes ip on the forwards of port until
+// expiresAt without a token
+func grantAuthorizedClient(ip string, clientID string, port uint16, expiresAt time.Time) error {
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	var lists []map[authorizedClientKey]authorizedClientState
+	for id, list := range allClientList {
+		if _, p, _ := splitForwardID(id); p == port {
+			lists = append(lists, list)
+		}
+	}
+	if len(lists) == 0 {
+		return fmt.Errorf("port %d is not forwarded", port)
+	}
+	key := authorizedClientKey{IP: ip, ClientID: clientID}
+	for _, list := range lists {
+		cleanupAuthorizedClientList(list, time.Now())
+		if _, exists := list[key]; !exists && maxAuthorizedClients > 0 && len(list) >= maxAuthorizedClients {
+			return fmt.Errorf("authorized clients of port %d reach the limit", port)
+		}
+	}
+	for _, list := range lists {
+		list[key] = authorizedClientState{ExpiresAt: expiresAt, RuleID: adminGrantRuleID}
+	}
+	atomic.AddUint64(&clientListAdds, 1)
+	return nil
+}
+
+// countAuthorizedClients returns the unexpired authorized clients per port,
+// summed over the bindaddrs of a port
+func countAuthorizedClients(now time.Time) map[uint16]int {
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	counts := make(map[uint16]int, len(allClientList))
+	for id, list := range allClientList {
+		_, port, _ := splitForwardID(id)
+		counts[port] += 0
+		for _, state := range list {
+			if state.ExpiresAt.After(now) {
+				counts[port]++
+			}
+		}
 	}
+	return counts
 }
@@ -55,7 +55,7 @@ func TestAuthClientDoesNotLogToken(t *testing.T) {
 	}
 }
 
-func TestChallengeRequestRespondsAndResponseSilentlyAuthorizes(t *testing.T) {
+func TestChallengeRequestRespondsAndResponseReturnsAuthResult(t *testing.T) {
 	token := "token-abcdefghijklmnopqrstuvwxyz"
 	authKey := "abcdefghijklmnopqrstuvwxyz123456"
 	authAddr := freeUDPAddr(t)
@@ -84,8 +84,19 @@ func TestChallengeRequestRespondsAndResponseSilentlyAuthorizes(t *testing.T) {
 	}
 
 	sendChallengeResponseForTest(t, conn, authKey, challenge, token)
-	if got := readUDPWithTimeout(conn, 100*time.Millisecond); len(got) != 0 {
-		t.Fatalf("challenge response must not produce UDP reply, got %d bytes", len(got))
+	result := readAuthResultForTest(t, conn, authKey)
+	if result.Result != authproto.AuthResultAuthorized || result.Reason != authproto.AuthReasonOK {
+		t.Fatalf("expected authorized result, got %+v", result)
+	}
+	if result.ClientNonce != clientNonce || result.ServerNonce != challenge.ServerNonce || result.Port != 40022 {
+		t.Fatalf("auth result binding mismatch: %+v", result)
+	}
+	if result.ExpiresAt < time.Now().Add(50*time.Second).Unix() {
+		t.Fatalf("expected expiry from authexpiredtime, got %d", result.ExpiresAt)
+	}
+	sendChallengeResponseForTest(t, conn, authKey, sendChallengeRequestForTest(t, conn, authKey, "client-nonce-2", 40022), token)
+	if renewed := readAuthResultForTest(t, conn, authKey); renewed.Result != authproto.AuthResultRenewed {
+		t.Fatalf("expected renewed result, got %+v", renewed)
 	}
 	if !isIPAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("127.0.0.1")) {
 		t.Fatal("expected loopback IP to be authorized after challenge response")
@@ -219,7 +230,7 @@ func TestChallengeAuthAllowsMultipleActiveKeysDuringRotation(t *testing.T) {
 	}
 }
 
-func TestChallengeResponseWithWrongTokenIsSilentAndDoesNotAuthorize(t *testing.T) {
+func TestChallengeResponseWithWrongTokenIsDeniedAndDoesNotAuthorize(t *testing.T) {
 	token := "token-abcdefghijklmnopqrstuvwxyz"
 	authKey := "abcdefghijklmnopqrstuvwxyz123456"
 	authAddr := freeUDPAddr(t)
@@ -244,8 +255,9 @@ func TestChallengeResponseWithWrongTokenIsSilentAndDoesNotAuthorize(t *testing.T
 	challenge := sendChallengeRequestForTest(t, conn, authKey, "client-nonce", 40022)
 	sendChallengeResponseForTest(t, conn, authKey, challenge, "wrong-token-abcdefghijklmnopqrstuvwxyz")
 
-	if got := readUDPWithTimeout(conn, 100*time.Millisecond); len(got) != 0 {
-		t.Fatalf("wrong token response must be silent, got %d bytes", len(got))
+	result := readAuthResultForTest(t, conn, authKey)
+	if result.Result != authproto.AuthResultDenied || result.Reason != authproto.AuthReasonNotAllowed || result.ExpiresAt != 0 {
+		t.Fatalf("expected generic denied result, got %+v", result)
 	}
 	if isIPAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("127.0.0.1")) {
 		t.Fatal("wrong token must not authorize loopback IP")
@@ -309,7 +321,7 @@ func TestCapturedChallengeResponseCannotBeReplayed(t *testing.T) {
 	if _, err := conn.Write(packet); err != nil {
 		t.Fatalf("write first response: %v", err)
 	}
-	time.Sleep(50 * time.Millisecond)
+	readAuthResultForTest(t, conn, authKey)
 	clearAuthedIPForTest(&globalConfig.ForwardConfigs[0], "127.0.0.1")
 	if _, err := conn.Write(packet); err != nil {
 		t.Fatalf("write replayed response: %v", err)
@@ -347,9 +359,9 @@ func TestAuthorizationStateSeparatesClientIDAndExpiresOnLookup(t *testing.T) {
 	}
 
 	muxClient.Lock()
-	for key, state := range allClientList[&globalConfig.ForwardConfigs[0]] {
+	for key, state := range allClientList[globalConfig.ForwardConfigs[0].id()] {
 		state.ExpiresAt = time.Now().Add(-time.Second)
-		allClientList[&globalConfig.ForwardConfigs[0]][key] = state
+		allClientList[globalConfig.ForwardConfigs[0].id()][key] = state
 	}
 	muxClient.Unlock()
 	if isClientAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
@@ -562,6 +574,30 @@ func buildChallengeResponsePacket(keyID string, key string, challenge authproto.
 	return env, nil
 }
 
+func readAuthResultForTest(t *testing.T, conn *net.UDPConn, key string) authproto.AuthResult {
+	t.Helper()
+	raw := readUDPWithTimeout(conn, time.Second)
+	if len(raw) == 0 {
+		t.Fatal("no auth result")
+	}
+	var env authproto.Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatalf("unmarshal auth result envelope: %v", err)
+	}
+	opened, err := authproto.Open([]byte(key), authproto.Context{KeyID: env.KeyID, ServerID: env.ServerID}, env.Payload)
+	if err != nil {
+		t.Fatalf("open auth result: %v", err)
+	}
+	var result authproto.AuthResult
+	if err := json.Unmarshal(opened, &result); err != nil {
+		t.Fatalf("unmarshal auth result: %v", err)
+	}
+	if err := result.Validate(time.Now()); err != nil {
+		t.Fatalf("invalid auth result: %v", err)
+	}
+	return result
+}
+
 func readUDPWithTimeout(conn *net.UDPConn, timeout time.Duration) []byte {
 	_ = conn.SetReadDeadline(time.Now().Add(timeout))
 	buf := make([]byte, 4096)
@@ -575,9 +611,9 @@ func readUDPWithTimeout(conn *net.UDPConn, timeout time.Duration) []byte {
 func clearAuthedIPForTest(cfg *forwardConfig, ip string) {
 	muxClient.Lock()
 	defer muxClient.Unlock()
-	for key := range allClientList[cfg] {
+	for key := range allClientList[cfg.id()] {
 		if key.IP == ip {
-			delete(allClientList[cfg], key)
+			delete(allClientList[cfg.id()], key)
 		}
 	}
 }
@@ -592,3 +628,293 @@ func waitForClientAuthForTest(cfg *forwardConfig, ip net.IP, clientID string) bo
 	}
 	return false
 }
+
+func TestRevokedReasonFollowsGrantKind(t *testing.T) {
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: token}},
+			AllowIPs:        []accessRule{{IP: "198.51.100.0/24"}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	initClientList()
+	cfg := &globalConfig.ForwardConfigs[0]
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	tokenGrant, ok := grantConnection(cfg, net.ParseIP("192.0.2.10"))
+	if !ok || tokenGrant.Static || tokenGrant.ClientID != "workstation" {
+		t.Fatalf("unexpected token grant: %+v", tokenGrant)
+	}
+	staticGrant, ok := grantConnection(cfg, net.ParseIP("198.51.100.7"))
+	if !ok || !staticGrant.Static {
+		t.Fatalf("unexpected static grant: %+v", staticGrant)
+	}
+	now := time.Now()
+	if reason := revokedReason(cfg, tokenGrant, now); reason != "" {
+		t.Fatalf("expected token grant to be valid, got %s", reason)
+	}
+	if reason := revokedReason(cfg, tokenGrant, now.Add(2*time.Minute)); reason != "auth_expired" {
+		t.Fatalf("expected token grant to expire, got %q", reason)
+	}
+	revokeAuthorizedClients("192.0.2.10", "", 0)
+	if reason := revokedReason(cfg, tokenGrant, now); reason != "auth_revoked" {
+		t.Fatalf("expected token grant to be revoked, got %q", reason)
+	}
+	if reason := revokedReason(cfg, staticGrant, now); reason != "" {
+		t.Fatalf("expected static grant to be valid, got %s", reason)
+	}
+	globalConfig.GlobalDenyIPs = []accessRule{{IP: "198.51.100.7"}}
+	if reason := revokedReason(cfg, staticGrant, now); reason != "ip_denied" {
+		t.Fatalf("expected denied ip to revoke static grant, got %q", reason)
+	}
+}
+
+func TestChallengeAuthOverBinaryWireFormat(t *testing.T) {
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	authKey := "abcdefghijklmnopqrstuvwxyz123456"
+	authAddr := freeUDPAddr(t)
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID:        "connauth-server",
+		AuthAddr:        authAddr,
+		AuthKeys:        []authKeyConfig{{ID: "primary-2026-06", Key: authKey}},
+		AuthWireFormats: []string{authproto.WireFormatBinary},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: token}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	initClientList()
+	stopAuth := startAuthForTest(t, authAddr)
+	defer stopAuth()
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+
+	disabled := authPacketsIgnored.Value("wire_format_disabled")
+	if _, err := sendChallengeRequest(conn, "primary-2026-06", authKey, "connauth-server", "workstation", "client-nonce", 40022); err == nil {
+		t.Fatal("expected json request to be ignored once json is disabled")
+	}
+	if authPacketsIgnored.Value("wire_format_disabled")-disabled != 1 {
+		t.Fatal("expected json request to be counted as disabled wire format")
+	}
+
+	var challenge authproto.Challenge
+	exchangeBinaryForTest(t, conn, authKey, authproto.ChallengeRequest{
+		Type:        authproto.MessageTypeChallengeRequest,
+		ServerID:    "connauth-server",
+		ClientID:    "workstation",
+		Port:        40022,
+		ClientNonce: "client-nonce",
+		Timestamp:   time.Now().Unix(),
+	}, &challenge)
+	var result authproto.AuthResult
+	exchangeBinaryForTest(t, conn, authKey, authproto.ChallengeResponse{
+		Type:        authproto.MessageTypeChallengeResponse,
+		ServerID:    "connauth-server",
+		ClientID:    "workstation",
+		Port:        40022,
+		ClientNonce: "client-nonce",
+		ServerNonce: challenge.ServerNonce,
+		Token:       token,
+		Timestamp:   time.Now().Unix(),
+	}, &result)
+	if result.Result != authproto.AuthResultAuthorized || result.ServerNonce != challenge.ServerNonce {
+		t.Fatalf("expected authorized result, got %+v", result)
+	}
+	if !isIPAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("127.0.0.1")) {
+		t.Fatal("expected loopback IP to be authorized over binary wire format")
+	}
+}
+
+// exchangeBinaryForTest sends msg in a binary envelope and decodes the binary
+// reply into out
+func exchangeBinaryForTest(t *testing.T, conn *net.UDPConn, key string, msg interface{}, out interface{}) {
+	t.Helper()
+	ctx := authproto.Context{KeyID: "primary-2026-06", ServerID: "connauth-server"}
+	plain, err := authproto.EncodeMessage(msg, authproto.WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode message: %v", err)
+	}
+	sealed, err := authproto.Seal([]byte(key), ctx, plain)
+	if err != nil {
+		t.Fatalf("seal message: %v", err)
+	}
+	packet, err := authproto.EncodeEnvelope(authproto.Envelope{KeyID: ctx.KeyID, ServerID: ctx.ServerID, Payload: sealed}, authproto.WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode envelope: %v", err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	raw := readUDPWithTimeout(conn, time.Second)
+	env, format, err := authproto.DecodeEnvelope(raw)
+	if err != nil || format != authproto.WireFormatBinary {
+		t.Fatalf("expected binary reply: %s %v", format, err)
+	}
+	opened, err := authproto.Open([]byte(key), ctx, env.Payload)
+	if err != nil {
+		t.Fatalf("open reply: %v", err)
+	}
+	if err := authproto.DecodeMessage(opened, format, out); err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+}
+
+func TestIdentityKeySignsChallengeAndResult(t *testing.T) {
+	pubText, privText, _ := authproto.GenerateKey()
+	pub, _ := authproto.ParsePublicKey(pubText)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	authKey := "abcdefghijklmnopqrstuvwxyz123456"
+	authAddr := freeUDPAddr(t)
+	expiry := uint32(60)
+	conf := &config{
+		ServerID:    "connauth-server",
+		AuthAddr:    authAddr,
+		AuthKeys:    []authKeyConfig{{ID: "primary-2026-06", Key: authKey}},
+		IdentityKey: privText,
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: token}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	if err := conf.CheckValid(); err != nil {
+		t.Fatalf("expected identity key config to be valid: %v", err)
+	}
+	globalConfig = conf
+	initClientList()
+	stopAuth := startAuthForTest(t, authAddr)
+	defer stopAuth()
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+
+	ctx := authproto.Context{KeyID: "primary-2026-06", ServerID: "connauth-server"}
+	challenge := sendChallengeRequestForTest(t, conn, authKey, "client-nonce", 40022)
+	if !authproto.VerifyServerMessage(pub, ctx, []byte(authKey), challenge, challenge.Signature) {
+		t.Fatal("expected challenge to be signed by the identity key")
+	}
+	sendChallengeResponseForTest(t, conn, authKey, challenge, token)
+	result := readAuthResultForTest(t, conn, authKey)
+	if !authproto.VerifyServerMessage(pub, ctx, []byte(authKey), result, result.Signature) {
+		t.Fatal("expected auth result to be signed by the identity key")
+	}
+
+	conf.IdentityKey = "not-a-key"
+	if err := conf.CheckValid(); err == nil {
+		t.Fatal("expected invalid identity key to be rejected")
+	}
+}
+
+func TestTokenRuleWithTOTPRequiresBothFactors(t *testing.T) {
+	usedOTPCodes = newOTPUses()
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	authKey := "abcdefghijklmnopqrstuvwxyz123456"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	authAddr := freeUDPAddr(t)
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: authAddr,
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: authKey}},
+		Tokens:   map[string]tokenConfig{"ssh-primary": {Token: token, TOTP: secret}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{TokenRef: "ssh-primary"}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected totp config to be valid: %v", err)
+	}
+	initClientList()
+	if authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized {
+		t.Fatal("expected token without totp code to be denied")
+	}
+	stopAuth := startAuthForTest(t, authAddr)
+	defer stopAuth()
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+
+	otpSecret, _ := authproto.ParseOTPSecret(secret)
+	for _, c := range []struct {
+		code   string
+		result string
+	}{
+		{"", authproto.AuthResultDenied},
+		{"000000", authproto.AuthResultDenied},
+		{authproto.TOTP(otpSecret, time.Now()), authproto.AuthResultAuthorized},
+	} {
+		var challenge authproto.Challenge
+		exchangeBinaryForTest(t, conn, authKey, authproto.ChallengeRequest{
+			Type:        authproto.MessageTypeChallengeRequest,
+			ServerID:    "connauth-server",
+			ClientID:    "workstation",
+			Port:        40022,
+			ClientNonce: "client-nonce",
+			Timestamp:   time.Now().Unix(),
+		}, &challenge)
+		response := authproto.ChallengeResponse{
+			Type:        authproto.MessageTypeChallengeResponse,
+			ServerID:    "connauth-server",
+			ClientID:    "workstation",
+			Port:        40022,
+			ClientNonce: "client-nonce",
+			ServerNonce: challenge.ServerNonce,
+			Token:       token,
+			Timestamp:   time.Now().Unix(),
+		}
+		if c.code != "" {
+			response.OTP = authproto.OTPProof(c.code, challenge.ServerNonce)
+		}
+		var result authproto.AuthResult
+		exchangeBinaryForTest(t, conn, authKey, response, &result)
+		if result.Result != c.result {
+			t.Fatalf("expected %s with code %q, got %+v", c.result, c.code, result)
+		}
+	}
+}
+
+func TestTOTPCodeCannotBeReusedByAnotherClient(t *testing.T) {
+	usedOTPCodes = newOTPUses()
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		Tokens:   map[string]tokenConfig{"ssh-primary": {Token: token, TOTP: secret}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:    40022,
+			ForwardAddr: "127.0.0.1:22",
+			AllowTokens: []accessRule{{TokenRef: "ssh-primary"}},
+		}},
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected totp config to be valid: %v", err)
+	}
+	initClientList()
+	otpSecret, _ := authproto.ParseOTPSecret(secret)
+	code := authproto.TOTP(otpSecret, time.Now())
+	creds := func(nonce string) clientCredentials {
+		return clientCredentials{Token: token, OTP: authproto.OTPProof(code, nonce), ServerNonce: nonce}
+	}
+	if !authorizeCredentials("192.0.2.10", "workstation", 40022, "", creds("nonce-1"), false).Authorized {
+		t.Fatal("expected first use of the code to be authorized")
+	}
+	if authorizeCredentials("198.51.100.7", "workstation", 40022, "", creds("nonce-2"), false).Authorized {
+		t.Fatal("expected the code to be refused for another client")
+	}
+	if !authorizeCredentials("192.0.2.10", "workstation", 40022, "", creds("nonce-3"), false).Authorized {
+		t.Fatal("expected the client that used the code to renew with it")
+	}
+}
@@ -85,3 +85,36 @@ func (s *pendingChallengeStore) cleanup(now time.Time) int {
 	}
 	return deleted
 }
+
+type pendingChallengeEntry struct {
+	IP        string
+	KeyID     string
+	ClientID  string
+	Port      uint16
+	ExpiresAt time.Time
+}
+
+// snapshot lists the pending challenges without their nonces
+func (s *pendingChallengeStore) snapshot() []pendingChallengeEntry {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entries := make([]pendingChallengeEntry, 0, len(s.items))
+	for key, item := range s.items {
+		entries = append(entries, pendingChallengeEntry{
+			IP:        key.IP,
+			KeyID:     key.KeyID,
+			ClientID:  key.ClientID,
+			Port:      key.Port,
+			ExpiresAt: item.ExpiresAt,
+		})
+	}
+	return entries
+}
+
+// count returns the pending challenges, including expired ones that were
+// not cleaned up yet since they still take capacity
+func (s *pendingChallengeStore) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.items)
+}
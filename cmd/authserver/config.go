@@ -1,10 +1,15 @@
 package main
 
 import (
+	"connauth/utils/authproto"
+	"crypto/ed25519"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -12,6 +17,21 @@ import (
 )
 
 var globalConfig *config
+var muxConfig sync.RWMutex
+
+// currentConfig returns the active config. A loaded config is never modified,
+// a reload replaces it as a whole with setConfig.
+func currentConfig() *config {
+	muxConfig.RLock()
+	defer muxConfig.RUnlock()
+	return globalConfig
+}
+
+func setConfig(c *config) {
+	muxConfig.Lock()
+	defer muxConfig.Unlock()
+	globalConfig = c
+}
 
 // const value
 const (
@@ -23,16 +43,24 @@ func newUint32(x uint32) *uint32 {
 }
 
 type forwardConfig struct {
-	BindPort        uint16       // listening port, eg: 80, will bind to all interfaces
+	BindPort        uint16       // listening port, eg: 80
+	BindAddr        string       // IP address to listen on, eg: 203.0.113.10 or 2001:db8::1, default: empty for all interfaces
+	Protocol        string       // tcp or udp, default: tcp
 	ForwardAddr     string       // address of real backend, eg: 127.0.0.1:8080
 	AllowTokens     []accessRule // client can be auth by tokens list here, default: empty
 	AllowIPs        []accessRule // IP white list that can always connect and never expired, support CIDR notation, default: empty
 	DropDelayTime   *uint32      // milliseconds before close an unauth connection, 0 for close immediately, default: 0
 	AuthExpiredTime *uint32      // seconds before an auth by token is expired, default 3600
-	MaxConnPerIP    *uint32
-	MaxConnGlobal   *uint32
+	MaxConnPerIP    *uint32      // max active connections, or udp flows, per source IP, default: 16
+	MaxConnGlobal   *uint32      // max active connections, or udp flows, of the forward, default: 1024
 	DialTimeoutMS   *uint32
-	IdleTimeoutMS   *uint32
+	IdleTimeoutMS   *uint32 // milliseconds without traffic in either direction before close a forwarded connection, 0 for never, default: 300000
+	MaxSessionTime  *uint32 // seconds before close a forwarded connection regardless of traffic, 0 for unlimited, default: 0
+	// close forwarded connections once the authorization that allowed them expires, is revoked or the IP is denied, default: false
+	TerminateOnExpiry bool
+	// connections must start with the one-time ticket of an auth result, which ties them to the client id instead of
+	// the source IP, statically allowed IPs connect without one, default: false
+	RequireTicket bool
 }
 
 func (c *forwardConfig) CheckValid() error {
@@ -48,10 +76,67 @@ func (c *forwardConfig) CheckValid() error {
 	if _, _, err := net.SplitHostPort(c.ForwardAddr); err != nil {
 		return fmt.Errorf("forwardaddr is invalid %v", err)
 	}
+	if c.BindAddr != "" {
+		ip := net.ParseIP(c.BindAddr)
+		if ip == nil {
+			return fmt.Errorf("bindaddr %s is not an IP address", c.BindAddr)
+		}
+		c.BindAddr = ip.String()
+	}
+	switch strings.ToLower(c.Protocol) {
+	case "", "tcp":
+		c.Protocol = "tcp"
+	case "udp":
+		c.Protocol = "udp"
+		if c.RequireTicket {
+			return fmt.Errorf("requireticket is only supported with protocol tcp")
+		}
+	default:
+		return fmt.Errorf("protocol %s is not supported, use tcp or udp", c.Protocol)
+	}
 	return nil
 }
 
+// id identifies the forward among the authorized clients and the running
+// forwards, forwards on different bindaddrs or protocols can share a port
+func (c *forwardConfig) id() string {
+	return forwardID(c.BindAddr, c.BindPort, c.Protocol)
+}
+
+func (c *forwardConfig) listenAddr() string {
+	return net.JoinHostPort(c.BindAddr, strconv.Itoa(int(c.BindPort)))
+}
+
+func (c *forwardConfig) isUDP() bool {
+	return c.Protocol == "udp"
+}
+
+// conflicts tells whether c and other cannot listen at the same time
+func (c *forwardConfig) conflicts(other *forwardConfig) bool {
+	if c.BindPort != other.BindPort || c.isUDP() != other.isUDP() {
+		return false
+	}
+	if c.BindAddr == "" || other.BindAddr == "" {
+		return true
+	}
+	ip, otherIP := net.ParseIP(c.BindAddr), net.ParseIP(other.BindAddr)
+	return ip.Equal(otherIP) || ip.IsUnspecified() || otherIP.IsUnspecified()
+}
+
+// authListenConfig describes the socket of authaddr like a udp forward, to
+// check it for conflicts
+func authListenConfig(addr *net.UDPAddr) *forwardConfig {
+	cfg := &forwardConfig{BindPort: uint16(addr.Port), Protocol: "udp"}
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		cfg.BindAddr = addr.IP.String()
+	}
+	return cfg
+}
+
 func (c *forwardConfig) SetDefaultValue() {
+	if c.Protocol == "" {
+		c.Protocol = "tcp"
+	}
 	if c.DropDelayTime == nil {
 		c.DropDelayTime = newUint32(0)
 	}
@@ -70,6 +155,9 @@ func (c *forwardConfig) SetDefaultValue() {
 	if c.IdleTimeoutMS == nil {
 		c.IdleTimeoutMS = newUint32(300000)
 	}
+	if c.MaxSessionTime == nil {
+		c.MaxSessionTime = newUint32(0)
+	}
 }
 
 type config struct {
@@ -91,14 +179,39 @@ type config struct {
 			AccessKeySecret string
 		}
 	}
-	AuthAddr          string // UDP addr for auth by token
+	Admin struct {
+		Addr  string // loopback TCP address or unix:/path of the admin API, empty to disable
+		Token string // bearer token required by every admin request
+	}
+	MetricsAddr   string // TCP addr of the prometheus /metrics endpoint, empty to disable
+	AuthAddr      string // UDP addr for auth by token
+	AuthRateLimit struct {
+		Rate       *uint32 // auth packets per second accepted from one source prefix, 0 to disable, default: 10
+		Burst      *uint32 // auth packets accepted at once before rate applies, default: twice the rate
+		IPv4Prefix *uint32 // IPv4 addresses sharing this prefix share one limit, default: 32
+		IPv6Prefix *uint32 // IPv6 addresses sharing this prefix share one limit, default: 64
+	}
+	AuthBan struct {
+		MaxFailures        *uint32 // failed auths of an IP before it is banned, 0 to disable, default: 10
+		MaxDecryptFailures *uint32 // packets of an IP that do not decrypt or verify before it is banned, 0 to disable, default: 100
+		Window             *uint32 // seconds in which the failures are counted, default: 300
+		BanTime            *uint32 // seconds an IP stays banned, default: 900
+	}
 	AuthKeys          []authKeyConfig
-	Tokens            map[string]string
+	ClientKeys        []clientKeyConfig // public keys of clients in keypair mode, by clientid
+	IdentityKey       string            // base64 Ed25519 private key that signs challenges and results, empty to disable
+	AuthWireFormats   []string          // wire formats accepted on authaddr, drop json once all clients use binary, default: [json, binary]
+	Tokens            map[string]tokenConfig
 	IPRules           map[string]string
 	ForwardConfigs    []forwardConfig
 	GlobalAllowTokens []accessRule // token rules that can auth any port
 	GlobalAllowIPs    []accessRule // add to all ForwardConfigs
 	GlobalDenyIPs     []accessRule // black list of IP addresses to connect to any port, support CIDR notation
+	StateFile         string       // file to keep authorized clients across restarts, empty to disable
+	StateSaveInterval *uint32      // seconds between two snapshots of StateFile, default: 60
+	ShutdownGrace     *uint32      // seconds to wait for forwarded connections to finish on shutdown, 0 to close them at once, default: 10
+
+	identityKey ed25519.PrivateKey
 }
 
 type accessRule struct {
@@ -107,10 +220,18 @@ type accessRule struct {
 	IP       string
 	IPRef    string
 	Inline   string `yaml:"-"`
+	// argon2id hash of the token from authserver hash-token, instead of token
+	TokenHash string
+	// how the token is compared, exact or glob. glob allows * wildcards but is
+	// not constant time, can be omit, default: exact
+	Match string
 
 	resolvedValue string
 	ruleID        string
 	ruleType      string
+	totpSecret    []byte     // second factor of a tokenref with totp
+	tokenHash     *tokenHash // set for rules with a hashed token, they match exactly
+	glob          bool       // match: glob
 }
 
 func (r *accessRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -163,6 +284,81 @@ func (c *authKeyConfig) CheckValid(now time.Time) error {
 	return nil
 }
 
+// tokenConfig is a token of the tokens section, either the token alone or
+// the token with the totp secret of a second factor
+type tokenConfig struct {
+	Token     string
+	TokenHash string // argon2id hash of the token from authserver hash-token, instead of token
+	TOTP      string // base32 RFC 6238 secret, clients must also send a current code, empty to disable
+
+	totpSecret []byte
+	tokenHash  *tokenHash
+}
+
+func (t *tokenConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var token string
+	if err := unmarshal(&token); err == nil {
+		t.Token = token
+		return nil
+	}
+	type raw tokenConfig
+	var out raw
+	if err := unmarshal(&out); err != nil {
+		return err
+	}
+	*t = tokenConfig(out)
+	return nil
+}
+
+func (t *tokenConfig) CheckValid(id string) error {
+	if t.TokenHash != "" {
+		if t.Token != "" {
+			return fmt.Errorf("token %s cannot have both token and tokenhash", id)
+		}
+		hash, err := parseTokenHash(t.TokenHash)
+		if err != nil {
+			return fmt.Errorf("token %s: %v", id, err)
+		}
+		t.tokenHash = hash
+	} else {
+		if t.Token == "*" {
+			return fmt.Errorf("token %s cannot contain wildcard *", id)
+		}
+		if err := validateSecret("token "+id, t.Token); err != nil {
+			return err
+		}
+	}
+	if t.TOTP != "" {
+		secret, err := authproto.ParseOTPSecret(t.TOTP)
+		if err != nil {
+			return fmt.Errorf("token %s: %v", id, err)
+		}
+		t.totpSecret = secret
+	}
+	return nil
+}
+
+// clientKeyConfig is the public key of one client in keypair mode, removing
+// it revokes that client only
+type clientKeyConfig struct {
+	ClientID  string
+	PublicKey string
+
+	key ed25519.PublicKey
+}
+
+func (c *clientKeyConfig) CheckValid() error {
+	if err := validateIdentifier("client id", c.ClientID); err != nil {
+		return err
+	}
+	key, err := authproto.ParsePublicKey(c.PublicKey)
+	if err != nil {
+		return fmt.Errorf("publickey of %s invalid: %v", c.ClientID, err)
+	}
+	c.key = key
+	return nil
+}
+
 func validateIdentifier(kind string, value string) error {
 	if value == "" {
 		return fmt.Errorf("%s cannot be empty", kind)
@@ -211,11 +407,45 @@ func (c *config) CheckValid() error {
 	if err := validateIdentifier("serverid", c.ServerID); err != nil {
 		return err
 	}
-	if _, err := net.ResolveUDPAddr("udp", c.AuthAddr); err != nil {
+	authAddr, err := net.ResolveUDPAddr("udp", c.AuthAddr)
+	if err != nil {
 		return fmt.Errorf("authaddr is invalid: %v", err)
 	}
-	if len(c.AuthKeys) == 0 {
-		return fmt.Errorf("authkeys cannot be empty")
+	if len(c.AuthKeys) == 0 && len(c.ClientKeys) == 0 {
+		return fmt.Errorf("authkeys and clientkeys cannot both be empty")
+	}
+	if c.Admin.Addr != "" {
+		if err := validateAdminAddr(c.Admin.Addr); err != nil {
+			return err
+		}
+		if err := validateSecret("admin token", c.Admin.Token); err != nil {
+			return err
+		}
+	}
+	if c.MetricsAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", c.MetricsAddr); err != nil {
+			return fmt.Errorf("metricsaddr is invalid: %v", err)
+		}
+	}
+	if err := c.checkAuthLimits(); err != nil {
+		return err
+	}
+	if len(c.AuthWireFormats) == 0 {
+		c.AuthWireFormats = []string{authproto.WireFormatJSON, authproto.WireFormatBinary}
+	}
+	for _, format := range c.AuthWireFormats {
+		if !authproto.ValidWireFormat(format) {
+			return fmt.Errorf("authwireformats %s is invalid, allow json or binary", format)
+		}
+	}
+	if c.StateSaveInterval == nil {
+		c.StateSaveInterval = newUint32(60)
+	}
+	if *c.StateSaveInterval == 0 {
+		return fmt.Errorf("statesaveinterval must be greater than 0")
+	}
+	if c.ShutdownGrace == nil {
+		c.ShutdownGrace = newUint32(10)
 	}
 	seenKeys := map[string]bool{}
 	now := time.Now()
@@ -228,16 +458,31 @@ func (c *config) CheckValid() error {
 		}
 		seenKeys[c.AuthKeys[i].ID] = true
 	}
+	if c.IdentityKey != "" {
+		key, err := authproto.ParsePrivateKey(c.IdentityKey)
+		if err != nil {
+			return fmt.Errorf("identitykey invalid: %v", err)
+		}
+		c.identityKey = key
+	}
+	seenClients := map[string]bool{}
+	for i := range c.ClientKeys {
+		if err := c.ClientKeys[i].CheckValid(); err != nil {
+			return fmt.Errorf("clientkeys %d error: %v", i+1, err)
+		}
+		if seenClients[c.ClientKeys[i].ClientID] {
+			return fmt.Errorf("duplicate clientkey of client %s", c.ClientKeys[i].ClientID)
+		}
+		seenClients[c.ClientKeys[i].ClientID] = true
+	}
 	for id, token := range c.Tokens {
 		if err := validateIdentifier("token id", id); err != nil {
 			return err
 		}
-		if token == "*" {
-			return fmt.Errorf("token %s cannot contain wildcard *", id)
-		}
-		if err := validateSecret("token "+id, token); err != nil {
+		if err := token.CheckValid(id); err != nil {
 			return err
 		}
+		c.Tokens[id] = token
 	}
 	for id, rule := range c.IPRules {
 		if err := validateIdentifier("ip rule id", id); err != nil {
@@ -247,23 +492,33 @@ func (c *config) CheckValid() error {
 			return err
 		}
 	}
-	if err := c.resolveTokenRules(c.GlobalAllowTokens, "global", 0); err != nil {
+	if err := c.resolveTokenRules(c.GlobalAllowTokens, "global", ""); err != nil {
 		return err
 	}
-	if err := c.resolveIPRules(c.GlobalAllowIPs, "global", 0); err != nil {
+	if err := c.resolveIPRules(c.GlobalAllowIPs, "global", ""); err != nil {
 		return err
 	}
-	if err := c.resolveIPRules(c.GlobalDenyIPs, "global_deny", 0); err != nil {
+	if err := c.resolveIPRules(c.GlobalDenyIPs, "global_deny", ""); err != nil {
 		return err
 	}
 	for i := range c.ForwardConfigs {
 		if err := c.ForwardConfigs[i].CheckValid(); err != nil {
 			return fmt.Errorf("forwardconfigs %d error: %v", i+1, err)
 		}
-		if err := c.resolveTokenRules(c.ForwardConfigs[i].AllowTokens, "forward", c.ForwardConfigs[i].BindPort); err != nil {
+		for j := 0; j < i; j++ {
+			if c.ForwardConfigs[i].conflicts(&c.ForwardConfigs[j]) {
+				return fmt.Errorf("forwardconfigs %d error: %s conflicts with forwardconfigs %d", i+1, c.ForwardConfigs[i].id(), j+1)
+			}
+		}
+		if authAddr != nil && c.ForwardConfigs[i].conflicts(authListenConfig(authAddr)) {
+			return fmt.Errorf("forwardconfigs %d error: %s conflicts with authaddr", i+1, c.ForwardConfigs[i].id())
+		}
+		// inline rule ids keep the bare port of forwards without bindaddr
+		forward := strings.TrimPrefix(c.ForwardConfigs[i].id(), ":")
+		if err := c.resolveTokenRules(c.ForwardConfigs[i].AllowTokens, "forward", forward); err != nil {
 			return fmt.Errorf("forwardconfigs %d error: %v", i+1, err)
 		}
-		if err := c.resolveIPRules(c.ForwardConfigs[i].AllowIPs, "forward", c.ForwardConfigs[i].BindPort); err != nil {
+		if err := c.resolveIPRules(c.ForwardConfigs[i].AllowIPs, "forward", forward); err != nil {
 			return fmt.Errorf("forwardconfigs %d error: %v", i+1, err)
 		}
 		c.ForwardConfigs[i].SetDefaultValue()
@@ -271,9 +526,51 @@ func (c *config) CheckValid() error {
 	return nil
 }
 
-func (c *config) resolveTokenRules(rules []accessRule, scope string, port uint16) error {
+func (c *config) checkAuthLimits() error {
+	limit := &c.AuthRateLimit
+	if limit.Rate == nil {
+		limit.Rate = newUint32(10)
+	}
+	if limit.Burst == nil {
+		limit.Burst = newUint32(2 * *limit.Rate)
+	}
+	if limit.IPv4Prefix == nil {
+		limit.IPv4Prefix = newUint32(32)
+	}
+	if limit.IPv6Prefix == nil {
+		limit.IPv6Prefix = newUint32(64)
+	}
+	if *limit.Rate > 0 && *limit.Burst == 0 {
+		return fmt.Errorf("authratelimit burst must be greater than 0")
+	}
+	if *limit.IPv4Prefix == 0 || *limit.IPv4Prefix > 32 {
+		return fmt.Errorf("authratelimit ipv4prefix allow range 1~32")
+	}
+	if *limit.IPv6Prefix == 0 || *limit.IPv6Prefix > 128 {
+		return fmt.Errorf("authratelimit ipv6prefix allow range 1~128")
+	}
+	ban := &c.AuthBan
+	if ban.MaxFailures == nil {
+		ban.MaxFailures = newUint32(10)
+	}
+	if ban.MaxDecryptFailures == nil {
+		ban.MaxDecryptFailures = newUint32(100)
+	}
+	if ban.Window == nil {
+		ban.Window = newUint32(300)
+	}
+	if ban.BanTime == nil {
+		ban.BanTime = newUint32(900)
+	}
+	if (*ban.MaxFailures > 0 || *ban.MaxDecryptFailures > 0) && (*ban.Window == 0 || *ban.BanTime == 0) {
+		return fmt.Errorf("authban window and bantime must be greater than 0")
+	}
+	return nil
+}
+
+func (c *config) resolveTokenRules(rules []accessRule, scope string, forward string) error {
 	for i := range rules {
-		rule, err := c.resolveTokenRule(rules[i], scope, port, i+1)
+		rule, err := c.resolveTokenRule(rules[i], scope, forward, i+1)
 		if err != nil {
 			return err
 		}
@@ -282,19 +579,42 @@ func (c *config) resolveTokenRules(rules []accessRule, scope string, port uint16
 	return nil
 }
 
-func (c *config) resolveTokenRule(rule accessRule, scope string, port uint16, index int) (accessRule, error) {
+func (c *config) resolveTokenRule(rule accessRule, scope string, forward string, index int) (accessRule, error) {
+	switch rule.Match {
+	case "", "exact":
+	case "glob":
+		rule.glob = true
+	default:
+		return rule, fmt.Errorf("match %s is invalid, allow exact or glob", rule.Match)
+	}
 	if rule.TokenRef != "" {
-		if rule.Token != "" || rule.IP != "" || rule.IPRef != "" || rule.Inline != "" {
+		if rule.Token != "" || rule.TokenHash != "" || rule.IP != "" || rule.IPRef != "" || rule.Inline != "" {
 			return rule, fmt.Errorf("tokenref cannot be combined with inline rule")
 		}
-		value, ok := c.Tokens[rule.TokenRef]
+		token, ok := c.Tokens[rule.TokenRef]
 		if !ok {
 			return rule, fmt.Errorf("unknown tokenref %s", rule.TokenRef)
 		}
-		rule.resolvedValue = value
+		rule.resolvedValue = token.Token
+		rule.totpSecret = token.totpSecret
+		rule.tokenHash = token.tokenHash
 		rule.ruleID = rule.TokenRef
 		rule.ruleType = "token_ref"
-		return rule, nil
+		return checkTokenMatch(rule)
+	}
+	if rule.TokenHash != "" {
+		// a hash cannot be matched as a glob pattern
+		if rule.Token != "" || rule.Inline != "" || rule.IP != "" || rule.IPRef != "" {
+			return rule, fmt.Errorf("tokenhash cannot be combined with token")
+		}
+		hash, err := parseTokenHash(rule.TokenHash)
+		if err != nil {
+			return rule, err
+		}
+		rule.tokenHash = hash
+		rule.ruleID = inlineRuleID(scope, forward, "token", index)
+		rule.ruleType = "inline_token_hash"
+		return checkTokenMatch(rule)
 	}
 	value := rule.Token
 	if value == "" {
@@ -310,14 +630,29 @@ func (c *config) resolveTokenRule(rule accessRule, scope string, port uint16, in
 		return rule, err
 	}
 	rule.resolvedValue = value
-	rule.ruleID = inlineRuleID(scope, port, "token", index)
+	rule.ruleID = inlineRuleID(scope, forward, "token", index)
 	rule.ruleType = "inline_token"
+	return checkTokenMatch(rule)
+}
+
+// checkTokenMatch checks the match of a token rule, a wildcard is only
+// allowed with an explicit match: glob
+func checkTokenMatch(rule accessRule) (accessRule, error) {
+	if !rule.glob && strings.Contains(rule.resolvedValue, "*") {
+		return rule, fmt.Errorf("token rule %s contains wildcard *, set match: glob to match it as a pattern", rule.ruleID)
+	}
+	if rule.glob {
+		if rule.tokenHash != nil {
+			return rule, fmt.Errorf("token rule %s: match glob cannot be used with tokenhash", rule.ruleID)
+		}
+		log.Warnf("token rule %s uses match: glob, its token is not compared in constant time", rule.ruleID)
+	}
 	return rule, nil
 }
 
-func (c *config) resolveIPRules(rules []accessRule, scope string, port uint16) error {
+func (c *config) resolveIPRules(rules []accessRule, scope string, forward string) error {
 	for i := range rules {
-		rule, err := c.resolveIPRule(rules[i], scope, port, i+1)
+		rule, err := c.resolveIPRule(rules[i], scope, forward, i+1)
 		if err != nil {
 			return err
 		}
@@ -326,7 +661,7 @@ func (c *config) resolveIPRules(rules []accessRule, scope string, port uint16) e
 	return nil
 }
 
-func (c *config) resolveIPRule(rule accessRule, scope string, port uint16, index int) (accessRule, error) {
+func (c *config) resolveIPRule(rule accessRule, scope string, forward string, index int) (accessRule, error) {
 	if rule.IPRef != "" {
 		if rule.IP != "" || rule.Token != "" || rule.TokenRef != "" || rule.Inline != "" {
 			return rule, fmt.Errorf("ipref cannot be combined with inline rule")
@@ -351,16 +686,28 @@ func (c *config) resolveIPRule(rule accessRule, scope string, port uint16, index
 		return rule, err
 	}
 	rule.resolvedValue = value
-	rule.ruleID = inlineRuleID(scope, port, "ip", index)
+	rule.ruleID = inlineRuleID(scope, forward, "ip", index)
 	rule.ruleType = "inline_ip"
 	return rule, nil
 }
 
-func inlineRuleID(scope string, port uint16, kind string, index int) string {
-	if port == 0 {
+func inlineRuleID(scope string, forward string, kind string, index int) string {
+	if forward == "" {
 		return fmt.Sprintf("inline:%s:%s:%d", scope, kind, index)
 	}
-	return fmt.Sprintf("inline:%s:%d:%s:%d", scope, port, kind, index)
+	return fmt.Sprintf("inline:%s:%s:%s:%d", scope, forward, kind, index)
+}
+
+func (c *config) acceptsWireFormat(format string) bool {
+	if len(c.AuthWireFormats) == 0 {
+		return true
+	}
+	for _, f := range c.AuthWireFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *config) activeAuthKey() string {
@@ -393,6 +740,15 @@ func (c *config) authKeyByID(keyID string) (string, bool) {
 	return "", false
 }
 
+func (c *config) clientKeyByID(clientID string) (ed25519.PublicKey, bool) {
+	for _, key := range c.ClientKeys {
+		if key.ClientID == clientID && key.key != nil {
+			return key.key, true
+		}
+	}
+	return nil, false
+}
+
 func readConfig(fileName string) (*config, error) {
 	content, err := ioutil.ReadFile(fileName)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
@@ -81,6 +82,91 @@ func TestServerConfigAcceptsConfirmedSSHMigrationConfig(t *testing.T) {
 	}
 }
 
+func TestServerConfigValidatesBindAddrAndConflicts(t *testing.T) {
+	expiry := uint32(60)
+	forward := func(port uint16, bindAddr string) forwardConfig {
+		return forwardConfig{
+			BindPort:        port,
+			BindAddr:        bindAddr,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}},
+			AuthExpiredTime: &expiry,
+		}
+	}
+	tests := []struct {
+		name     string
+		forwards []forwardConfig
+		valid    bool
+	}{
+		{name: "different addrs share a port", forwards: []forwardConfig{forward(40022, "127.0.0.1"), forward(40022, "2001:db8::1")}, valid: true},
+		{name: "different ports", forwards: []forwardConfig{forward(40022, ""), forward(40023, "")}, valid: true},
+		{name: "not an ip", forwards: []forwardConfig{forward(40022, "localhost")}},
+		{name: "same port", forwards: []forwardConfig{forward(40022, ""), forward(40022, "")}},
+		{name: "all interfaces and an addr", forwards: []forwardConfig{forward(40022, "127.0.0.1"), forward(40022, "")}},
+		{name: "unspecified addr", forwards: []forwardConfig{forward(40022, "0.0.0.0"), forward(40022, "127.0.0.1")}},
+		{name: "same addr spelled differently", forwards: []forwardConfig{forward(40022, "2001:db8::1"), forward(40022, "2001:db8:0::1")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{
+				ServerID:       "connauth-server",
+				AuthKeys:       []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+				ForwardConfigs: tt.forwards,
+			}
+			err := cfg.CheckValid()
+			if tt.valid && err != nil {
+				t.Fatalf("expected config to be valid: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected config to be rejected")
+			}
+		})
+	}
+}
+
+func TestServerConfigValidatesForwardProtocol(t *testing.T) {
+	expiry := uint32(60)
+	forward := func(port uint16, protocol string) forwardConfig {
+		return forwardConfig{
+			BindPort:        port,
+			Protocol:        protocol,
+			ForwardAddr:     "127.0.0.1:51820",
+			AllowTokens:     []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}},
+			AuthExpiredTime: &expiry,
+		}
+	}
+	ticket := forward(51820, "udp")
+	ticket.RequireTicket = true
+	tests := []struct {
+		name     string
+		forwards []forwardConfig
+		valid    bool
+	}{
+		{name: "tcp and udp share a port", forwards: []forwardConfig{forward(51820, "TCP"), forward(51820, "udp")}, valid: true},
+		{name: "same udp port", forwards: []forwardConfig{forward(51820, "udp"), forward(51820, "UDP")}},
+		{name: "udp port of authaddr", forwards: []forwardConfig{forward(40100, "udp")}},
+		{name: "ticket over udp", forwards: []forwardConfig{ticket}},
+		{name: "unknown protocol", forwards: []forwardConfig{forward(51820, "sctp")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{
+				ServerID:       "connauth-server",
+				AuthAddr:       "0.0.0.0:40100",
+				AuthKeys:       []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+				ForwardConfigs: tt.forwards,
+			}
+			err := cfg.CheckValid()
+			if tt.valid && err != nil {
+				t.Fatalf("expected config to be valid: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected config to be rejected")
+			}
+		})
+	}
+}
+
 func TestServerTemplateRequiresReplacingSecrets(t *testing.T) {
 	if _, err := readConfig("config.yaml.template"); err == nil {
 		t.Fatal("expected template config to be rejected until secrets are replaced")
@@ -162,8 +248,8 @@ func TestServerConfigResolvesTokenAndIPReferences(t *testing.T) {
 		ServerID: "connauth-server",
 		AuthAddr: "127.0.0.1:40100",
 		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
-		Tokens: map[string]string{
-			"ssh-primary": "token-abcdefghijklmnopqrstuvwxyz",
+		Tokens: map[string]tokenConfig{
+			"ssh-primary": {Token: "token-abcdefghijklmnopqrstuvwxyz"},
 		},
 		IPRules: map[string]string{
 			"office-primary": "198.51.100.10",
@@ -251,3 +337,120 @@ logger:
 func newAuthConfigForTest(token string, port uint16) *utils.AuthConfig {
 	return utils.NewAuthConfig(token, port)
 }
+
+func TestServerConfigAcceptsBothWireFormatsByDefault(t *testing.T) {
+	cfg := config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+	}
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatalf("expected config to be valid: %v", err)
+	}
+	if !cfg.acceptsWireFormat("json") || !cfg.acceptsWireFormat("binary") {
+		t.Fatalf("expected both wire formats by default, got %v", cfg.AuthWireFormats)
+	}
+	cfg.AuthWireFormats = []string{"binary"}
+	if err := cfg.CheckValid(); err != nil || cfg.acceptsWireFormat("json") {
+		t.Fatalf("expected json to be disabled: %v", err)
+	}
+	cfg.AuthWireFormats = []string{"xml"}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected unknown wire format to be rejected")
+	}
+}
+
+func TestServerConfigReadsTokensWithTOTP(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "server.yaml")
+	content := `
+serverid: "connauth-server"
+authaddr: "127.0.0.1:40100"
+authkeys:
+  - id: "primary-2026-06"
+    key: "abcdefghijklmnopqrstuvwxyz123456"
+tokens:
+  ssh-primary: "token-abcdefghijklmnopqrstuvwxyz"
+  ssh-otp:
+    token: "otp-token-abcdefghijklmnopqrstuvwxyz"
+    totp: "%s"
+forwardconfigs:
+  - bindport: 40022
+    forwardaddr: "127.0.0.1:22"
+    allowtokens:
+      - tokenref: "ssh-primary"
+      - tokenref: "ssh-otp"
+`
+	if err := ioutil.WriteFile(cfgFile, []byte(fmt.Sprintf(content, "gezd gnbv gy3t qojq gezd gnbv gy3t qojq")), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := readConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("expected tokens with totp to be valid: %v", err)
+	}
+	rules := cfg.ForwardConfigs[0].AllowTokens
+	if rules[0].resolvedValue != "token-abcdefghijklmnopqrstuvwxyz" || rules[0].totpSecret != nil ||
+		rules[1].resolvedValue != "otp-token-abcdefghijklmnopqrstuvwxyz" || string(rules[1].totpSecret) != "12345678901234567890" {
+		t.Fatalf("unexpected resolved token rules: %#v", rules)
+	}
+	if err := ioutil.WriteFile(cfgFile, []byte(fmt.Sprintf(content, "GEZDGNBV")), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := readConfig(cfgFile); err == nil {
+		t.Fatal("expected short totp secret to be rejected")
+	}
+}
+
+func TestServerConfigKeepsGlobBehindMatchAttribute(t *testing.T) {
+	expiry := uint32(60)
+	encoded, _ := hashToken("token-abcdefghijklmnopqrstuvwxyz")
+	newConfig := func(rule accessRule) *config {
+		return &config{
+			ServerID: "connauth-server",
+			AuthAddr: "127.0.0.1:40100",
+			AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+			Tokens:   map[string]tokenConfig{"ssh-hashed": {TokenHash: encoded}},
+			ForwardConfigs: []forwardConfig{{
+				BindPort:        40022,
+				ForwardAddr:     "127.0.0.1:22",
+				AllowTokens:     []accessRule{rule},
+				AuthExpiredTime: &expiry,
+			}},
+		}
+	}
+	for _, rule := range []accessRule{
+		{Token: "token-abcdefghijklmnopqrstuvwxyz*", Match: "exact"},
+		{Inline: "token-abcdefghijklmnopqrstuvwxyz*", Match: "exact"},
+		{Token: "token-abcdefghijklmnopqrstuvwxyz*", Match: "regex"},
+		{TokenRef: "ssh-hashed", Match: "glob"},
+	} {
+		if err := newConfig(rule).CheckValid(); err == nil {
+			t.Fatalf("expected rule %#v to be rejected", rule)
+		}
+	}
+
+	globalConfig = newConfig(accessRule{Token: "token-abcdefghijklmnopqrstuvwxyz"})
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected exact rule to be valid: %v", err)
+	}
+	initClientList()
+	if authorizeClient("192.0.2.10", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxyz-2").Authorized ||
+		!authorizeClient("192.0.2.10", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+		t.Fatal("expected exact rule to accept only its token")
+	}
+
+	globalConfig = newConfig(accessRule{Token: "token-abcdefghijklmnopqrstuvwxyz*", Match: "glob"})
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected glob rule to be valid: %v", err)
+	}
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxyz-2").Authorized {
+		t.Fatal("expected glob rule to accept a matching token")
+	}
+	// wildcards are only patterns with an explicit match: glob
+	for _, rule := range []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz*"}, {Inline: "token-abcdefghijklmnopqrstuvwxyz*"}} {
+		if err := newConfig(rule).CheckValid(); err == nil {
+			t.Fatalf("expected wildcard rule %#v without match to be rejected", rule)
+		}
+	}
+}
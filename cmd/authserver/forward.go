@@ -1,11 +1,10 @@
 package main
 
 import (
+	"connauth/utils"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -13,6 +12,143 @@ import (
 type forwardRuntime struct {
 	Stop chan struct{}
 	Done <-chan struct{}
+
+	mux     sync.Mutex
+	cfg     *forwardConfig
+	limiter *connectionLimiter
+	conns   *connectionRegistry
+}
+
+func (r *forwardRuntime) config() *forwardConfig {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.cfg
+}
+
+// update switches a running forward to the reloaded config of the same port
+func (r *forwardRuntime) update(cfg *forwardConfig) {
+	r.mux.Lock()
+	r.cfg = cfg
+	r.mux.Unlock()
+	r.limiter.setLimits(*cfg.MaxConnGlobal, *cfg.MaxConnPerIP)
+}
+
+// terminateRevoked closes the connections whose authorization expired, was
+// revoked or whose IP is denied now. Nothing is closed unless
+// terminateonexpiry is enabled.
+func (r *forwardRuntime) terminateRevoked(now time.Time) int {
+	cfg := r.config()
+	if !cfg.TerminateOnExpiry {
+		return 0
+	}
+	terminated := 0
+	for _, c := range r.conns.list() {
+		reason := revokedReason(cfg, c.grant, now)
+		if reason == "" {
+			continue
+		}
+		r.conns.remove(c)
+		log.WithFields(log.Fields{
+			"event":       "forward_terminated",
+			"source_ip":   c.grant.IP,
+			"source_addr": c.conn.RemoteAddr().String(),
+			"client_id":   c.grant.ClientID,
+			"rule_id":     c.grant.RuleID,
+			"port":        cfg.BindPort,
+			"result":      "closed",
+			"reason":      reason,
+		}).Infof("close connection from %s to port %d: %s", c.conn.RemoteAddr().String(), cfg.BindPort, reason)
+		_ = c.conn.Close()
+		terminated++
+	}
+	return terminated
+}
+
+// drain waits until deadline for the connections of a stopped forward to
+// finish, and closes those still open then. It returns how many were closed.
+func (r *forwardRuntime) drain(deadline time.Time) int {
+	if r.conns.wait(deadline) {
+		return 0
+	}
+	closed := 0
+	for _, c := range r.conns.list() {
+		r.conns.remove(c)
+		_ = c.conn.Close()
+		closed++
+	}
+	return closed
+}
+
+// trackedConn is an active forwarded connection and the authorization that
+// allowed it
+type trackedConn struct {
+	conn  net.Conn
+	grant connectionGrant
+	since time.Time
+}
+
+type connectionRegistry struct {
+	mux   sync.Mutex
+	conns map[*trackedConn]struct{}
+	// closed when the last connection is removed
+	empty chan struct{}
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{conns: make(map[*trackedConn]struct{})}
+}
+
+func (r *connectionRegistry) add(conn net.Conn, grant connectionGrant) *trackedConn {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	c := &trackedConn{conn: conn, grant: grant, since: time.Now()}
+	if len(r.conns) == 0 {
+		r.empty = make(chan struct{})
+	}
+	r.conns[c] = struct{}{}
+	return c
+}
+
+func (r *connectionRegistry) remove(c *trackedConn) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.conns[c]; !ok {
+		return
+	}
+	delete(r.conns, c)
+	if len(r.conns) == 0 {
+		close(r.empty)
+	}
+}
+
+// wait returns true once no connection is left, or false when deadline
+// passes first
+func (r *connectionRegistry) wait(deadline time.Time) bool {
+	r.mux.Lock()
+	if len(r.conns) == 0 {
+		r.mux.Unlock()
+		return true
+	}
+	empty := r.empty
+	r.mux.Unlock()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-empty:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (r *connectionRegistry) list() []*trackedConn {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	conns := make([]*trackedConn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
 }
 
 type connectionLimiter struct {
@@ -31,6 +167,24 @@ func newConnectionLimiter(maxGlobal uint32, maxPerIP uint32) *connectionLimiter
 	}
 }
 
+func (l *connectionLimiter) setLimits(maxGlobal uint32, maxPerIP uint32) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.maxGlobal = int(maxGlobal)
+	l.maxPerIP = int(maxPerIP)
+}
+
+// snapshot returns the active connections in total and per source IP
+func (l *connectionLimiter) snapshot() (int, map[string]int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	byIP := make(map[string]int, len(l.byIP))
+	for ip, count := range l.byIP {
+		byIP[ip] = count
+	}
+	return l.global, byIP
+}
+
 func (l *connectionLimiter) acquire(ip net.IP) bool {
 	l.mux.Lock()
 	defer l.mux.Unlock()
@@ -60,52 +214,123 @@ func (l *connectionLimiter) release(ip net.IP) {
 	}
 }
 
-func forward(source io.ReadWriteCloser, dest io.ReadWriteCloser) {
-	defer dest.Close()
-	defer source.Close()
-	_, _ = io.Copy(dest, source)
+// idleDeadline pushes the deadline of both sides of a forwarded connection
+// forward on every read and write, so only a connection without traffic in
+// either direction runs into the idle timeout. The deadline never passes
+// sessionEnd when that is set.
+type idleDeadline struct {
+	mux        sync.Mutex
+	conns      []net.Conn
+	idle       time.Duration
+	sessionEnd time.Time
+	lastPush   time.Time
+}
+
+func newIdleDeadline(idle time.Duration, maxSession time.Duration, conns ...net.Conn) *idleDeadline {
+	d := &idleDeadline{conns: conns, idle: idle}
+	if maxSession > 0 {
+		d.sessionEnd = time.Now().Add(maxSession)
+	}
+	d.push(true)
+	return d
+}
+
+func (d *idleDeadline) push(force bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	now := time.Now()
+	// avoid touching the sockets for every small chunk of a busy connection
+	if !force && now.Sub(d.lastPush) < d.idle/10 {
+		return
+	}
+	d.lastPush = now
+	var deadline time.Time
+	if d.idle > 0 {
+		deadline = now.Add(d.idle)
+	}
+	if !d.sessionEnd.IsZero() && (deadline.IsZero() || d.sessionEnd.Before(deadline)) {
+		deadline = d.sessionEnd
+	}
+	for _, c := range d.conns {
+		_ = c.SetDeadline(deadline)
+	}
+}
+
+type idleConn struct {
+	net.Conn
+	deadline *idleDeadline
+}
+
+func (c idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.deadline.idle > 0 {
+		c.deadline.push(false)
+	}
+	return n, err
+}
+
+func (c idleConn) Write(b []byte) (int, error) {
+	if c.deadline.idle > 0 {
+		c.deadline.push(false)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(utils.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// forwardStats describes a finished forwarded connection
+type forwardStats struct {
+	Dialed       bool
+	DialDuration time.Duration
+	Upstream     int64 // bytes from the client to the backend
+	Downstream   int64 // bytes from the backend to the client
 }
 
-func handleConn(source *net.TCPConn, forwardDestAddr string, dialTimeout time.Duration, idleTimeout time.Duration) error {
+func handleConn(source *net.TCPConn, forwardDestAddr string, dialTimeout time.Duration, idleTimeout time.Duration, maxSessionTime time.Duration) (forwardStats, error) {
+	var stats forwardStats
+	dialStart := time.Now()
 	dest, err := net.DialTimeout("tcp", forwardDestAddr, dialTimeout)
+	stats.DialDuration = time.Since(dialStart)
 	if err != nil {
 		_ = source.Close()
-		return fmt.Errorf("connect to %s failed: %v", forwardDestAddr, err)
+		return stats, fmt.Errorf("connect to %s failed: %v", forwardDestAddr, err)
 	}
+	stats.Dialed = true
 
 	_ = source.SetKeepAlive(true)
 	_ = source.SetKeepAlivePeriod(time.Second * 60)
-	if idleTimeout > 0 {
-		deadline := time.Now().Add(idleTimeout)
-		_ = source.SetDeadline(deadline)
-		if tcpDest, ok := dest.(*net.TCPConn); ok {
-			_ = tcpDest.SetDeadline(deadline)
-		}
-	}
+	deadline := newIdleDeadline(idleTimeout, maxSessionTime, source, dest)
+	src := idleConn{Conn: source, deadline: deadline}
+	dst := idleConn{Conn: dest, deadline: deadline}
 
-	go forward(source, dest)
-	forward(dest, source)
-	return nil
-}
-
-func startForward(cfg *forwardConfig) error {
-	_, err := startForwardWithStop(cfg, make(chan struct{}))
-	return err
+	stats.Upstream, stats.Downstream = utils.Splice(src, dst)
+	return stats, nil
 }
 
 func startForwardWithStop(cfg *forwardConfig, stop chan struct{}) (*forwardRuntime, error) {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(int(cfg.BindPort)))
+	if cfg.isUDP() {
+		return startUDPForwardWithStop(cfg, stop)
+	}
+	listener, err := sockets.listenTCP(cfg.listenAddr())
 	if err != nil {
-		return nil, fmt.Errorf("listen on port %d failed: %v", cfg.BindPort, err)
+		return nil, fmt.Errorf("listen on %s failed: %v", cfg.listenAddr(), err)
 	}
 	log.WithFields(log.Fields{
 		"event":        "forward_listening",
 		"port":         cfg.BindPort,
+		"bind_addr":    cfg.BindAddr,
+		"protocol":     cfg.Protocol,
 		"forward_addr": cfg.ForwardAddr,
 		"result":       "success",
-	}).Infof("listening on %d, will forward to %s", cfg.BindPort, cfg.ForwardAddr)
+	}).Infof("listening on %s, will forward to %s", cfg.listenAddr(), cfg.ForwardAddr)
 	limiter := newConnectionLimiter(*cfg.MaxConnGlobal, *cfg.MaxConnPerIP)
 	done := make(chan struct{})
+	runtime := &forwardRuntime{Stop: stop, Done: done, cfg: cfg, limiter: limiter, conns: newConnectionRegistry()}
 	var wg sync.WaitGroup
 	wg.Add(3)
 	go func() {
@@ -117,6 +342,7 @@ func startForwardWithStop(cfg *forwardConfig, stop chan struct{}) (*forwardRunti
 		defer wg.Done()
 		for {
 			conn, err := listener.Accept()
+			cfg := runtime.config()
 			if err != nil {
 				select {
 				case <-stop:
@@ -131,87 +357,157 @@ func startForwardWithStop(cfg *forwardConfig, stop chan struct{}) (*forwardRunti
 				}).Warnf("accept new connection on port %d fail: %v", cfg.BindPort, err)
 				continue
 			}
-			remoteAddr := conn.RemoteAddr().String()
 			remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
-			if isIPAuthed(cfg, remoteIP) {
-				log.WithFields(log.Fields{
-					"event":       "forward_authorized",
-					"source_ip":   remoteIP.String(),
-					"source_addr": remoteAddr,
-					"port":        cfg.BindPort,
-					"result":      "authorized",
-				}).Infof("port %d receive authorized connection from %v", cfg.BindPort, conn.RemoteAddr())
+			if cfg.RequireTicket {
+				// count the connection before its ticket arrives, so sockets
+				// that never send one are held to the limits as well
+				if !runtime.acquire(cfg, conn) {
+					continue
+				}
+				// the ticket is read off the accept loop, a client may be slow to send it
 				go func() {
-					if !limiter.acquire(remoteIP) {
-						log.WithFields(log.Fields{
-							"event":       "forward_rejected",
-							"source_ip":   remoteIP.String(),
-							"source_addr": remoteAddr,
-							"port":        cfg.BindPort,
-							"result":      "rejected",
-							"reason":      "resource_limit",
-						}).Warnf("connection from %s rejected by resource limit", conn.RemoteAddr().String())
-						_ = conn.Close()
-						return
-					}
-					defer limiter.release(remoteIP)
-					if err := handleConn(conn.(*net.TCPConn), cfg.ForwardAddr, time.Duration(*cfg.DialTimeoutMS)*time.Millisecond, time.Duration(*cfg.IdleTimeoutMS)*time.Millisecond); err != nil {
-						log.WithFields(log.Fields{
-							"event":        "forward_failed",
-							"source_ip":    remoteIP.String(),
-							"source_addr":  remoteAddr,
-							"port":         cfg.BindPort,
-							"forward_addr": cfg.ForwardAddr,
-							"result":       "failed",
-							"error":        err.Error(),
-						}).Warnf("handle connection (from %s to %d) failed: %v", conn.RemoteAddr().String(), cfg.BindPort, err)
-						_ = conn.Close()
+					defer runtime.limiter.release(remoteIP)
+					if grant, reason := grantTicketConnection(cfg, conn, remoteIP); reason != "" {
+						rejectConnection(cfg, conn, reason)
+					} else {
+						runtime.forward(cfg, conn, grant)
 					}
 				}()
+				continue
+			}
+			if grant, ok := grantConnection(cfg, remoteIP); ok {
+				go runtime.serve(cfg, conn, grant)
 			} else {
-				log.WithFields(log.Fields{
-					"event":         "forward_unauthorized",
-					"source_ip":     remoteIP.String(),
-					"source_addr":   remoteAddr,
-					"port":          cfg.BindPort,
-					"result":        "rejected",
-					"reason":        "not_authed",
-					"drop_delay_ms": *cfg.DropDelayTime,
-				}).Warnf("%v haven't auth yet, close after %d ms", conn.RemoteAddr(), *cfg.DropDelayTime)
-				if *cfg.DropDelayTime == 0 {
-					_ = conn.Close()
-				} else {
-					time.AfterFunc(time.Duration(*cfg.DropDelayTime)*time.Millisecond, func() {
-						log.WithFields(log.Fields{
-							"event":       "forward_closed",
-							"source_ip":   remoteIP.String(),
-							"source_addr": remoteAddr,
-							"port":        cfg.BindPort,
-							"result":      "closed",
-							"reason":      "drop_delay_elapsed",
-						}).Debugf("%v was closed", conn.RemoteAddr())
-						_ = conn.Close()
-					})
-				}
+				rejectConnection(cfg, conn, "not_authed")
 			}
 		}
 	}()
 	go func() {
 		defer wg.Done()
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-		for {
-			refreshClientList(cfg)
-			select {
-			case <-stop:
-				return
-			case <-ticker.C:
-			}
-		}
+		runtime.refreshUntil(stop)
 	}()
 	go func() {
 		wg.Wait()
 		close(done)
 	}()
-	return &forwardRuntime{Stop: stop, Done: done}, nil
+	return runtime, nil
+}
+
+// refreshUntil drops expired clients and terminates revoked connections
+// every second until stop is closed
+func (r *forwardRuntime) refreshUntil(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		// before refreshClientList drops the expired clients, so the
+		// reason of a closed connection is still known
+		r.terminateRevoked(time.Now())
+		refreshClientList(r.config())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serve forwards an authorized connection to the backend of cfg within the
+// connection limits
+func (r *forwardRuntime) serve(cfg *forwardConfig, conn net.Conn, grant connectionGrant) {
+	if !r.acquire(cfg, conn) {
+		return
+	}
+	defer r.limiter.release(conn.RemoteAddr().(*net.TCPAddr).IP)
+	r.forward(cfg, conn, grant)
+}
+
+// acquire counts conn against the connection limits, a connection above them
+// is closed
+func (r *forwardRuntime) acquire(cfg *forwardConfig, conn net.Conn) bool {
+	remoteAddr := conn.RemoteAddr().String()
+	remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	if r.limiter.acquire(remoteIP) {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"event":       "forward_rejected",
+		"source_ip":   remoteIP.String(),
+		"source_addr": remoteAddr,
+		"port":        cfg.BindPort,
+		"result":      "rejected",
+		"reason":      "resource_limit",
+	}).Warnf("connection from %s rejected by resource limit", remoteAddr)
+	_ = conn.Close()
+	return false
+}
+
+// forward forwards a counted, authorized connection to the backend of cfg
+func (r *forwardRuntime) forward(cfg *forwardConfig, conn net.Conn, grant connectionGrant) {
+	remoteAddr := conn.RemoteAddr().String()
+	remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	select {
+	case <-r.Stop:
+		// granted after a ticket that arrived while shutting down
+		_ = conn.Close()
+		return
+	default:
+	}
+	log.WithFields(log.Fields{
+		"event":       "forward_authorized",
+		"source_ip":   remoteIP.String(),
+		"source_addr": remoteAddr,
+		"client_id":   grant.ClientID,
+		"rule_id":     grant.RuleID,
+		"port":        cfg.BindPort,
+		"result":      "authorized",
+	}).Infof("port %d receive authorized connection from %v", cfg.BindPort, conn.RemoteAddr())
+	tracked := r.conns.add(conn, grant)
+	defer r.conns.remove(tracked)
+	stats, err := handleConn(conn.(*net.TCPConn), cfg.ForwardAddr,
+		time.Duration(*cfg.DialTimeoutMS)*time.Millisecond,
+		time.Duration(*cfg.IdleTimeoutMS)*time.Millisecond,
+		time.Duration(*cfg.MaxSessionTime)*time.Second)
+	observeForward(cfg.BindPort, stats)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":        "forward_failed",
+			"source_ip":    remoteIP.String(),
+			"source_addr":  remoteAddr,
+			"port":         cfg.BindPort,
+			"forward_addr": cfg.ForwardAddr,
+			"result":       "failed",
+			"error":        err.Error(),
+		}).Warnf("handle connection (from %s to %d) failed: %v", remoteAddr, cfg.BindPort, err)
+		_ = conn.Close()
+	}
+}
+
+// rejectConnection closes an unauthorized connection after dropdelaytime
+func rejectConnection(cfg *forwardConfig, conn net.Conn, reason string) {
+	remoteAddr := conn.RemoteAddr().String()
+	remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	log.WithFields(log.Fields{
+		"event":         "forward_unauthorized",
+		"source_ip":     remoteIP.String(),
+		"source_addr":   remoteAddr,
+		"port":          cfg.BindPort,
+		"result":        "rejected",
+		"reason":        reason,
+		"drop_delay_ms": *cfg.DropDelayTime,
+	}).Warnf("%v haven't auth yet (%s), close after %d ms", conn.RemoteAddr(), reason, *cfg.DropDelayTime)
+	if *cfg.DropDelayTime == 0 {
+		_ = conn.Close()
+		return
+	}
+	time.AfterFunc(time.Duration(*cfg.DropDelayTime)*time.Millisecond, func() {
+		log.WithFields(log.Fields{
+			"event":       "forward_closed",
+			"source_ip":   remoteIP.String(),
+			"source_addr": remoteAddr,
+			"port":        cfg.BindPort,
+			"result":      "closed",
+			"reason":      "drop_delay_elapsed",
+		}).Debugf("%v was closed", conn.RemoteAddr())
+		_ = conn.Close()
+	})
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"testing"
@@ -28,6 +30,9 @@ func TestForwardConfigSetsResourceLimitDefaults(t *testing.T) {
 	if *cfg.IdleTimeoutMS != 300000 {
 		t.Fatalf("expected idle timeout default 300000ms, got %d", *cfg.IdleTimeoutMS)
 	}
+	if *cfg.MaxSessionTime != 0 {
+		t.Fatalf("expected unlimited max session time by default, got %d", *cfg.MaxSessionTime)
+	}
 }
 
 func TestForwardConfigRejectsUnsafeDropDelay(t *testing.T) {
@@ -85,7 +90,7 @@ func TestHandleConnUsesDialTimeout(t *testing.T) {
 	if err != nil {
 		t.Fatalf("accept source: %v", err)
 	}
-	err = handleConn(accepted, "127.0.0.1:1", 10*time.Millisecond, time.Second)
+	_, err = handleConn(accepted, "127.0.0.1:1", 10*time.Millisecond, time.Second, 0)
 	if err == nil {
 		t.Fatal("expected backend dial to fail")
 	}
@@ -94,6 +99,166 @@ func TestHandleConnUsesDialTimeout(t *testing.T) {
 	}
 }
 
+func TestHandleConnKeepsActiveConnectionPastIdleTimeout(t *testing.T) {
+	backend := startEchoBackendForTest(t)
+	defer backend.Close()
+	client, accepted := tcpPairForTest(t)
+	defer client.Close()
+	go func() {
+		_, _ = handleConn(accepted, backend.Addr().String(), time.Second, 150*time.Millisecond, 0)
+	}()
+
+	buf := make([]byte, 4)
+	for i := 0; i < 8; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("active connection closed after %d round trips: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("expected idle connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected idle timeout to close the forwarded connection")
+	}
+}
+
+func TestHandleConnClosesActiveConnectionAtMaxSessionTime(t *testing.T) {
+	backend := startEchoBackendForTest(t)
+	defer backend.Close()
+	client, accepted := tcpPairForTest(t)
+	defer client.Close()
+	go func() {
+		_, _ = handleConn(accepted, backend.Addr().String(), time.Second, time.Minute, time.Second)
+	}()
+
+	started := time.Now()
+	buf := make([]byte, 4)
+	for time.Since(started) < 3*time.Second {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			break
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(started); elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected connection to be closed at max session time, lasted %v", elapsed)
+	}
+}
+
+func TestHandleConnPropagatesClientHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backend.Close()
+	backendDone := make(chan error, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			backendDone <- err
+			return
+		}
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			backendDone <- err
+			return
+		}
+		_, err = conn.Write([]byte("reply:" + string(request)))
+		backendDone <- err
+	}()
+	client, accepted := tcpPairForTest(t)
+	defer client.Close()
+	var stats forwardStats
+	handled := make(chan error, 1)
+	go func() {
+		var err error
+		stats, err = handleConn(accepted, backend.Addr().String(), time.Second, time.Second, 0)
+		handled <- err
+	}()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("close write: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read reply after half-close: %v", err)
+	}
+	if string(reply) != "reply:request" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if err := <-backendDone; err != nil {
+		t.Fatalf("backend failed: %v", err)
+	}
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatalf("handle conn failed: %v", err)
+		}
+		if !stats.Dialed || stats.Upstream != int64(len("request")) || stats.Downstream != int64(len("reply:request")) {
+			t.Fatalf("unexpected forward stats %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected handleConn to return once both directions are done")
+	}
+}
+
+func TestHandleConnPropagatesBackendHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backend.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("banner"))
+		_ = conn.(*net.TCPConn).CloseWrite()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+	client, accepted := tcpPairForTest(t)
+	defer client.Close()
+	go func() {
+		_, _ = handleConn(accepted, backend.Addr().String(), time.Second, time.Second, 0)
+	}()
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	banner, err := ioutil.ReadAll(client)
+	if err != nil || string(banner) != "banner" {
+		t.Fatalf("expected banner then EOF, got %q: %v", banner, err)
+	}
+	if _, err := client.Write([]byte("upload")); err != nil {
+		t.Fatalf("write after backend half-close: %v", err)
+	}
+	_ = client.CloseWrite()
+	select {
+	case data := <-received:
+		if data != "upload" {
+			t.Fatalf("backend received %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend did not receive data sent after its half-close")
+	}
+}
+
 func TestStartForwardStopsAndReleasesListener(t *testing.T) {
 	backend, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -162,6 +327,46 @@ func TestStartForwardRejectsUnauthorizedConnection(t *testing.T) {
 	}
 }
 
+func startEchoBackendForTest(t *testing.T) net.Listener {
+	t.Helper()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return backend
+}
+
+func tcpPairForTest(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("listen source: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("dial source: %v", err)
+	}
+	accepted, err := listener.AcceptTCP()
+	if err != nil {
+		_ = client.Close()
+		t.Fatalf("accept source: %v", err)
+	}
+	return client, accepted
+}
+
 func freeTCPPort(t *testing.T) uint16 {
 	t.Helper()
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -175,3 +380,187 @@ func freeTCPPort(t *testing.T) uint16 {
 func intPort(port uint16) string {
 	return strconv.Itoa(int(port))
 }
+
+func startTrackedForwardForTest(t *testing.T, terminateOnExpiry bool) (*forwardRuntime, net.Conn) {
+	t.Helper()
+	backend := startEchoBackendForTest(t)
+	t.Cleanup(func() { _ = backend.Close() })
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	cfg := forwardConfig{
+		BindPort:          freeTCPPort(t),
+		ForwardAddr:       backend.Addr().String(),
+		AllowTokens:       []accessRule{{Token: token}},
+		TerminateOnExpiry: terminateOnExpiry,
+	}
+	cfg.SetDefaultValue()
+	globalConfig = &config{ServerID: "connauth-server", ForwardConfigs: []forwardConfig{cfg}}
+	initClientList()
+	if !authorizeClient("127.0.0.1", "workstation", cfg.BindPort, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	runtime, err := startForwardWithStop(&globalConfig.ForwardConfigs[0], make(chan struct{}))
+	if err != nil {
+		t.Fatalf("start forward: %v", err)
+	}
+	t.Cleanup(func() {
+		close(runtime.Stop)
+		<-runtime.Done
+	})
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(cfg.BindPort)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if !echoForTest(conn) {
+		t.Fatal("expected authorized connection to be forwarded")
+	}
+	return runtime, conn
+}
+
+func echoForTest(conn net.Conn) bool {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	return err == nil && string(buf) == "ping"
+}
+
+func TestForwardsOnDifferentBindAddrsAreAuthorizedSeparately(t *testing.T) {
+	if probe, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	} else {
+		_ = probe.Close()
+	}
+	backend := startEchoBackendForTest(t)
+	defer backend.Close()
+	port := freeTCPPort(t)
+	first, second := "token-abcdefghijklmnopqrstuvwxyz", "token-zyxwvutsrqponmlkjihgfedcba"
+	globalConfig = &config{ServerID: "connauth-server", ForwardConfigs: []forwardConfig{
+		{BindPort: port, BindAddr: "127.0.0.1", ForwardAddr: backend.Addr().String(), AllowTokens: []accessRule{{Token: first}}},
+		{BindPort: port, BindAddr: "127.0.0.2", ForwardAddr: backend.Addr().String(), AllowTokens: []accessRule{{Token: second}}},
+	}}
+	for i := range globalConfig.ForwardConfigs {
+		globalConfig.ForwardConfigs[i].SetDefaultValue()
+	}
+	initClientList()
+	for i := range globalConfig.ForwardConfigs {
+		runtime, err := startForwardWithStop(&globalConfig.ForwardConfigs[i], make(chan struct{}))
+		if err != nil {
+			t.Fatalf("start forward %d: %v", i+1, err)
+		}
+		defer func() {
+			close(runtime.Stop)
+			<-runtime.Done
+		}()
+	}
+	if !authorizeClient("127.0.0.1", "workstation", port, first).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	dial := func(host string) net.Conn {
+		dialer := net.Dialer{Timeout: time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(host, intPort(port)))
+		if err != nil {
+			t.Fatalf("dial %s: %v", host, err)
+		}
+		return conn
+	}
+	conn := dial("127.0.0.1")
+	defer conn.Close()
+	if !echoForTest(conn) {
+		t.Fatal("expected forward accepting the token to forward")
+	}
+	other := dial("127.0.0.2")
+	defer other.Close()
+	if echoForTest(other) {
+		t.Fatal("expected forward with another token to stay closed")
+	}
+	if isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("127.0.0.1"), "workstation") {
+		t.Fatal("authorization must not spread to the other bindaddr")
+	}
+}
+
+func TestAuthWithBindAddrAuthorizesOnlyThatForward(t *testing.T) {
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{ServerID: "connauth-server", ForwardConfigs: []forwardConfig{
+		{BindPort: 40022, BindAddr: "192.0.2.1", ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}},
+		{BindPort: 40022, BindAddr: "192.0.2.2", ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}},
+	}}
+	for i := range globalConfig.ForwardConfigs {
+		globalConfig.ForwardConfigs[i].SetDefaultValue()
+	}
+	initClientList()
+	creds := clientCredentials{Token: token}
+	if !authorizeCredentials("198.51.100.7", "workstation", 40022, "192.0.2.2", creds, false).Authorized {
+		t.Fatal("expected client to be authorized on the forward of its bindaddr")
+	}
+	first, second := &globalConfig.ForwardConfigs[0], &globalConfig.ForwardConfigs[1]
+	if isClientAuthed(first, net.ParseIP("198.51.100.7"), "workstation") || !isClientAuthed(second, net.ParseIP("198.51.100.7"), "workstation") {
+		t.Fatal("expected only the forward of the bindaddr to be authorized")
+	}
+	if authorizeCredentials("198.51.100.7", "workstation", 40022, "192.0.2.3", creds, false).Authorized {
+		t.Fatal("expected a bindaddr without forward to be denied")
+	}
+	if !authorizeCredentials("198.51.100.8", "workstation", 40022, "", creds, false).Authorized ||
+		!isClientAuthed(first, net.ParseIP("198.51.100.8"), "workstation") || !isClientAuthed(second, net.ParseIP("198.51.100.8"), "workstation") {
+		t.Fatal("expected an auth without bindaddr to authorize every forward of the port")
+	}
+}
+
+func TestForwardTracksConnectionWithItsAuthorization(t *testing.T) {
+	runtime, _ := startTrackedForwardForTest(t, false)
+	conns := runtime.conns.list()
+	if len(conns) != 1 {
+		t.Fatalf("expected one tracked connection, got %d", len(conns))
+	}
+	grant := conns[0].grant
+	if grant.IP != "127.0.0.1" || grant.ClientID != "workstation" || grant.RuleID == "" || grant.Static {
+		t.Fatalf("unexpected grant of tracked connection: %+v", grant)
+	}
+}
+
+func TestForwardTerminatesConnectionWhenAuthRevoked(t *testing.T) {
+	runtime, conn := startTrackedForwardForTest(t, true)
+	if terminated := runtime.terminateRevoked(time.Now()); terminated != 0 {
+		t.Fatalf("expected authorized connection to be kept, %d terminated", terminated)
+	}
+	if revokeAuthorizedClients("127.0.0.1", "workstation", 0) != 1 {
+		t.Fatal("expected authorization to be revoked")
+	}
+	if terminated := runtime.terminateRevoked(time.Now()); terminated != 1 {
+		t.Fatalf("expected revoked connection to be terminated, %d terminated", terminated)
+	}
+	if echoForTest(conn) {
+		t.Fatal("expected revoked connection to be closed")
+	}
+}
+
+func TestForwardKeepsConnectionWithoutTerminateOnExpiry(t *testing.T) {
+	runtime, conn := startTrackedForwardForTest(t, false)
+	revokeAuthorizedClients("127.0.0.1", "workstation", 0)
+	if terminated := runtime.terminateRevoked(time.Now()); terminated != 0 {
+		t.Fatalf("expected no connection to be terminated, %d terminated", terminated)
+	}
+	if !echoForTest(conn) {
+		t.Fatal("expected established connection to keep working")
+	}
+}
+
+func TestForwardTerminatesExpiredConnectionInBackground(t *testing.T) {
+	_, conn := startTrackedForwardForTest(t, true)
+	muxClient.Lock()
+	for _, list := range allClientList {
+		for key, state := range list {
+			state.ExpiresAt = time.Now().Add(-time.Second)
+			list[key] = state
+		}
+	}
+	muxClient.Unlock()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected expired connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected expired connection to be closed by the refresh loop")
+	}
+}
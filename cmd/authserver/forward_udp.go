@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// largest UDP payload
+const udpMaxPacket = 65535
+
+// packets of a flow waiting to be sent to the backend, more are dropped
+const udpFlowQueue = 64
+
+// how long packets of a rejected source are dropped before it is checked again
+var udpRejectTime = time.Second
+
+// dials the backend of a flow, replaced in tests
+var dialUDPBackend = net.DialTimeout
+
+// udpFlow is the NAT session of one source address of a udp forward. It
+// stands in for the accepted connection of a tcp forward: closing it closes
+// the socket towards the backend and ends the flow.
+type udpFlow struct {
+	idleConn
+	source     *net.UDPAddr
+	packets    chan []byte   // packets of the source, sent by the flow itself
+	closed     chan struct{} // closed once the backend stopped replying
+	upstream   int64
+	downstream int64
+}
+
+func newUDPFlow(source *net.UDPAddr) *udpFlow {
+	return &udpFlow{source: source, packets: make(chan []byte, udpFlowQueue), closed: make(chan struct{})}
+}
+
+// RemoteAddr returns the source address of the flow instead of the backend
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.source
+}
+
+// queue hands a packet of the source to the flow without blocking the read
+// loop, the packet is dropped when the queue is full
+func (f *udpFlow) queue(packet []byte) {
+	select {
+	case f.packets <- append([]byte(nil), packet...):
+	default:
+	}
+}
+
+// send passes the queued packets of the source to the backend until closed
+func (f *udpFlow) send() {
+	for {
+		select {
+		case <-f.closed:
+			return
+		case packet := <-f.packets:
+			if n, err := f.Write(packet); err == nil {
+				atomic.AddInt64(&f.upstream, int64(n))
+			}
+		}
+	}
+}
+
+// relay passes the replies of the backend to the source until the flow is
+// idle, reaches maxsessiontime or is closed
+func (f *udpFlow) relay(listener *net.UDPConn) {
+	buf := make([]byte, udpMaxPacket)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := listener.WriteToUDP(buf[:n], f.source); err != nil {
+			return
+		}
+		atomic.AddInt64(&f.downstream, int64(n))
+	}
+}
+
+// udpFlowTable finds the flow of a source address
+type udpFlowTable struct {
+	mux   sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newUDPFlowTable() *udpFlowTable {
+	return &udpFlowTable{flows: make(map[string]*udpFlow)}
+}
+
+func (t *udpFlowTable) get(source *net.UDPAddr) *udpFlow {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.flows[source.String()]
+}
+
+func (t *udpFlowTable) add(flow *udpFlow) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.flows[flow.source.String()] = flow
+}
+
+func (t *udpFlowTable) remove(flow *udpFlow) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.flows[flow.source.String()] == flow {
+		delete(t.flows, flow.source.String())
+	}
+}
+
+// udpRejections remembers the sources that were just rejected, so a source
+// sending many packets is not checked for every one of them. A rejection ends
+// after udpRejectTime or once a client was authorized. Only the read loop
+// uses it.
+type udpRejections struct {
+	items      map[string]udpRejection
+	maxEntries int
+}
+
+type udpRejection struct {
+	until time.Time
+	adds  uint64 // clientListAdds at the time of the rejection
+}
+
+func newUDPRejections(maxEntries int) *udpRejections {
+	return &udpRejections{items: make(map[string]udpRejection), maxEntries: maxEntries}
+}
+
+func (r *udpRejections) rejected(source *net.UDPAddr, now time.Time) bool {
+	item, ok := r.items[source.String()]
+	if !ok {
+		return false
+	}
+	if !item.until.After(now) || item.adds != atomic.LoadUint64(&clientListAdds) {
+		delete(r.items, source.String())
+		return false
+	}
+	return true
+}
+
+// add remembers source as rejected, adds is clientListAdds from before the
+// source was checked
+func (r *udpRejections) add(source *net.UDPAddr, now time.Time, adds uint64) {
+	if r.maxEntries > 0 && len(r.items) >= r.maxEntries {
+		r.items = make(map[string]udpRejection)
+	}
+	r.items[source.String()] = udpRejection{until: now.Add(udpRejectTime), adds: adds}
+}
+
+// startUDPForwardWithStop forwards the packets of authorized source
+// addresses to the backend of cfg, each source address with its own flow.
+// Packets of other sources are dropped without reply.
+func startUDPForwardWithStop(cfg *forwardConfig, stop chan struct{}) (*forwardRuntime, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.listenAddr())
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed: %v", cfg.listenAddr(), err)
+	}
+	listener, err := sockets.listenUDP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed: %v", cfg.listenAddr(), err)
+	}
+	log.WithFields(log.Fields{
+		"event":        "forward_listening",
+		"port":         cfg.BindPort,
+		"bind_addr":    cfg.BindAddr,
+		"protocol":     cfg.Protocol,
+		"forward_addr": cfg.ForwardAddr,
+		"result":       "success",
+	}).Infof("listening on %s/udp, will forward to %s", cfg.listenAddr(), cfg.ForwardAddr)
+	limiter := newConnectionLimiter(*cfg.MaxConnGlobal, *cfg.MaxConnPerIP)
+	done := make(chan struct{})
+	runtime := &forwardRuntime{Stop: stop, Done: done, cfg: cfg, limiter: limiter, conns: newConnectionRegistry()}
+	flows := newUDPFlowTable()
+	rejections := newUDPRejections(10000)
+	reading := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		<-stop
+		_ = listener.Close()
+		// replies cannot be sent once the socket is closed, so flows end at
+		// once instead of draining. The next packet of a source opens a new
+		// flow at the process that took over the socket.
+		<-reading
+		for _, c := range runtime.conns.list() {
+			_ = c.conn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(reading)
+		buf := make([]byte, udpMaxPacket)
+		for {
+			n, source, err := listener.ReadFromUDP(buf)
+			cfg := runtime.config()
+			if err != nil {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				log.WithFields(log.Fields{
+					"event":  "forward_accept_failed",
+					"port":   cfg.BindPort,
+					"result": "failed",
+					"error":  err.Error(),
+				}).Warnf("read packet on port %d/udp fail: %v", cfg.BindPort, err)
+				continue
+			}
+			flow := flows.get(source)
+			if flow == nil {
+				now := time.Now()
+				if rejections.rejected(source, now) {
+					continue
+				}
+				adds := atomic.LoadUint64(&clientListAdds)
+				if flow = runtime.openFlow(cfg, listener, flows, source); flow == nil {
+					rejections.add(source, now, adds)
+					continue
+				}
+			}
+			flow.queue(buf[:n])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		runtime.refreshUntil(stop)
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return runtime, nil
+}
+
+// openFlow starts the flow of an authorized source, it returns nil when the
+// source is not authorized or the flow limits are reached. The flow dials the
+// backend itself, packets of the source are queued meanwhile.
+func (r *forwardRuntime) openFlow(cfg *forwardConfig, listener *net.UDPConn, flows *udpFlowTable, source *net.UDPAddr) *udpFlow {
+	grant, ok := grantConnection(cfg, source.IP)
+	if !ok {
+		// a rejected source is checked once per udpRejectTime, still keep it
+		// out of the default log level
+		log.WithFields(log.Fields{
+			"event":       "forward_unauthorized",
+			"source_ip":   source.IP.String(),
+			"source_addr": source.String(),
+			"port":        cfg.BindPort,
+			"result":      "rejected",
+			"reason":      "not_authed",
+		}).Debugf("%v haven't auth yet, drop packet", source)
+		return nil
+	}
+	if !r.limiter.acquire(source.IP) {
+		log.WithFields(log.Fields{
+			"event":       "forward_rejected",
+			"source_ip":   source.IP.String(),
+			"source_addr": source.String(),
+			"port":        cfg.BindPort,
+			"result":      "rejected",
+			"reason":      "resource_limit",
+		}).Warnf("flow from %s rejected by resource limit", source)
+		return nil
+	}
+	flow := newUDPFlow(source)
+	flows.add(flow)
+	go r.runFlow(cfg, listener, flows, flow, grant)
+	return flow
+}
+
+// runFlow dials the backend of flow and relays between both until the flow
+// is idle, reaches maxsessiontime or is closed
+func (r *forwardRuntime) runFlow(cfg *forwardConfig, listener *net.UDPConn, flows *udpFlowTable, flow *udpFlow, grant connectionGrant) {
+	source := flow.source
+	defer r.limiter.release(source.IP)
+	defer flows.remove(flow)
+	dialStart := time.Now()
+	backend, err := dialUDPBackend("udp", cfg.ForwardAddr, time.Duration(*cfg.DialTimeoutMS)*time.Millisecond)
+	stats := forwardStats{DialDuration: time.Since(dialStart)}
+	if err != nil {
+		observeForward(cfg.BindPort, stats)
+		log.WithFields(log.Fields{
+			"event":        "forward_failed",
+			"source_ip":    source.IP.String(),
+			"source_addr":  source.String(),
+			"port":         cfg.BindPort,
+			"forward_addr": cfg.ForwardAddr,
+			"result":       "failed",
+			"error":        err.Error(),
+		}).Warnf("handle flow (from %s to %d/udp) failed: %v", source, cfg.BindPort, err)
+		return
+	}
+	defer backend.Close()
+	stats.Dialed = true
+	deadline := newIdleDeadline(time.Duration(*cfg.IdleTimeoutMS)*time.Millisecond,
+		time.Duration(*cfg.MaxSessionTime)*time.Second, backend)
+	flow.idleConn = idleConn{Conn: backend, deadline: deadline}
+	tracked := r.conns.add(flow, grant)
+	defer r.conns.remove(tracked)
+	select {
+	case <-r.Stop:
+		// stopped while dialing, the flows may have been closed already
+		return
+	default:
+	}
+	log.WithFields(log.Fields{
+		"event":       "forward_authorized",
+		"source_ip":   source.IP.String(),
+		"source_addr": source.String(),
+		"client_id":   grant.ClientID,
+		"rule_id":     grant.RuleID,
+		"port":        cfg.BindPort,
+		"result":      "authorized",
+	}).Infof("port %d/udp receive authorized flow from %v", cfg.BindPort, source)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		flow.send()
+	}()
+	flow.relay(listener)
+	_ = backend.Close()
+	close(flow.closed)
+	<-sent
+	stats.Upstream = atomic.LoadInt64(&flow.upstream)
+	stats.Downstream = atomic.LoadInt64(&flow.downstream)
+	observeForward(cfg.BindPort, stats)
+	log.WithFields(log.Fields{
+		"event":       "forward_closed",
+		"source_addr": source.String(),
+		"port":        cfg.BindPort,
+		"result":      "closed",
+	}).Debugf("flow from %s to port %d/udp closed", source, cfg.BindPort)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startUDPEchoBackendForTest(t *testing.T) *net.UDPConn {
+	t.Helper()
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	go func() {
+		buf := make([]byte, udpMaxPacket)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return backend
+}
+
+func freeUDPPort(t *testing.T) uint16 {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func startUDPForwardForTest(t *testing.T, cfg forwardConfig) *forwardRuntime {
+	t.Helper()
+	backend := startUDPEchoBackendForTest(t)
+	cfg.BindPort = freeUDPPort(t)
+	cfg.BindAddr = "127.0.0.1"
+	cfg.Protocol = "udp"
+	cfg.ForwardAddr = backend.LocalAddr().String()
+	cfg.AllowTokens = []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}}
+	cfg.SetDefaultValue()
+	globalConfig = &config{ServerID: "connauth-server", ForwardConfigs: []forwardConfig{cfg}}
+	initClientList()
+	runtime, err := startForwardWithStop(&globalConfig.ForwardConfigs[0], make(chan struct{}))
+	if err != nil {
+		t.Fatalf("start forward: %v", err)
+	}
+	t.Cleanup(func() {
+		close(runtime.Stop)
+		<-runtime.Done
+	})
+	return runtime
+}
+
+func dialUDPForwardForTest(t *testing.T, runtime *forwardRuntime) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", runtime.config().listenAddr())
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func udpEchoForTest(conn net.Conn) bool {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == "ping"
+}
+
+func waitForFlowsForTest(t *testing.T, runtime *forwardRuntime, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(runtime.conns.list()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d flows, got %d", want, len(runtime.conns.list()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPForwardRelaysOnlyAuthorizedSources(t *testing.T) {
+	runtime := startUDPForwardForTest(t, forwardConfig{})
+	conn := dialUDPForwardForTest(t, runtime)
+	if udpEchoForTest(conn) {
+		t.Fatal("expected packets of unauthorized source to be dropped")
+	}
+	if len(runtime.conns.list()) != 0 {
+		t.Fatal("unauthorized source must not open a flow")
+	}
+
+	if !authorizeClient("127.0.0.1", "workstation", runtime.config().BindPort, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	if !udpEchoForTest(conn) || !udpEchoForTest(conn) {
+		t.Fatal("expected authorized flow to be relayed both ways")
+	}
+	flows := runtime.conns.list()
+	if len(flows) != 1 {
+		t.Fatalf("expected one flow per source address, got %d", len(flows))
+	}
+	if flows[0].conn.RemoteAddr().String() != conn.LocalAddr().String() || flows[0].grant.ClientID != "workstation" {
+		t.Fatalf("unexpected flow: %s %+v", flows[0].conn.RemoteAddr(), flows[0].grant)
+	}
+}
+
+func TestUDPForwardLimitsFlowsPerIP(t *testing.T) {
+	runtime := startUDPForwardForTest(t, forwardConfig{MaxConnPerIP: newUint32(1)})
+	authorizeClient("127.0.0.1", "workstation", runtime.config().BindPort, "token-abcdefghijklmnopqrstuvwxyz")
+	first := dialUDPForwardForTest(t, runtime)
+	if !udpEchoForTest(first) {
+		t.Fatal("expected first flow to be relayed")
+	}
+	second := dialUDPForwardForTest(t, runtime)
+	if udpEchoForTest(second) {
+		t.Fatal("expected second flow of the IP to be rejected by maxconnperip")
+	}
+	if active, byIP := runtime.limiter.snapshot(); active != 1 || byIP["127.0.0.1"] != 1 {
+		t.Fatalf("expected one counted flow, got %d %v", active, byIP)
+	}
+}
+
+func TestUDPForwardExpiresIdleFlows(t *testing.T) {
+	runtime := startUDPForwardForTest(t, forwardConfig{IdleTimeoutMS: newUint32(100)})
+	authorizeClient("127.0.0.1", "workstation", runtime.config().BindPort, "token-abcdefghijklmnopqrstuvwxyz")
+	conn := dialUDPForwardForTest(t, runtime)
+	if !udpEchoForTest(conn) {
+		t.Fatal("expected flow to be relayed")
+	}
+	waitForFlowsForTest(t, runtime, 0)
+	if active, _ := runtime.limiter.snapshot(); active != 0 {
+		t.Fatalf("expected idle flow to release its limit, %d active", active)
+	}
+	if !udpEchoForTest(conn) {
+		t.Fatal("expected next packet to open a new flow")
+	}
+}
+
+func TestUDPForwardTerminatesRevokedFlows(t *testing.T) {
+	runtime := startUDPForwardForTest(t, forwardConfig{TerminateOnExpiry: true})
+	authorizeClient("127.0.0.1", "workstation", runtime.config().BindPort, "token-abcdefghijklmnopqrstuvwxyz")
+	conn := dialUDPForwardForTest(t, runtime)
+	if !udpEchoForTest(conn) {
+		t.Fatal("expected flow to be relayed")
+	}
+	revokeAuthorizedClients("127.0.0.1", "", 0)
+	if terminated := runtime.terminateRevoked(time.Now()); terminated != 1 {
+		t.Fatalf("expected revoked flow to be terminated, %d terminated", terminated)
+	}
+	waitForFlowsForTest(t, runtime, 0)
+	if udpEchoForTest(conn) {
+		t.Fatal("expected packets to be dropped after revoke")
+	}
+}
+
+func TestUDPForwardDialsBackendOffTheReadLoop(t *testing.T) {
+	previous := dialUDPBackend
+	defer func() { dialUDPBackend = previous }()
+	release := make(chan struct{})
+	var dials int32
+	dialUDPBackend = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			<-release
+		}
+		return previous(network, address, timeout)
+	}
+	runtime := startUDPForwardForTest(t, forwardConfig{})
+	authorizeClient("127.0.0.1", "workstation", runtime.config().BindPort, "token-abcdefghijklmnopqrstuvwxyz")
+	slow := dialUDPForwardForTest(t, runtime)
+	if _, err := slow.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&dials) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the flow to dial the backend")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fast := dialUDPForwardForTest(t, runtime)
+	if !udpEchoForTest(fast) {
+		t.Fatal("expected other sources to be relayed while a flow dials")
+	}
+	close(release)
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := slow.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("expected the packet queued while dialing to be relayed, got %q %v", buf[:n], err)
+	}
+}
+
+func TestUDPRejectionsEndAfterTimeOrNewAuthorization(t *testing.T) {
+	rejections := newUDPRejections(10)
+	source := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}
+	now := time.Now()
+	rejections.add(source, now, atomic.LoadUint64(&clientListAdds))
+	if !rejections.rejected(source, now) {
+		t.Fatal("expected source to stay rejected")
+	}
+	if rejections.rejected(source, now.Add(udpRejectTime)) {
+		t.Fatal("expected rejection to end after udpRejectTime")
+	}
+	rejections.add(source, now, atomic.LoadUint64(&clientListAdds))
+	atomic.AddUint64(&clientListAdds, 1)
+	if rejections.rejected(source, now) {
+		t.Fatal("expected rejection to end once a client was authorized")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"crypto/ed25519"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+var keypairSessions = newKeypairSessionStore(10000)
+
+type keypairSessionKey struct {
+	IP              string
+	ClientID        string
+	ClientEphemeral string
+}
+
+type keypairSession struct {
+	Key             []byte
+	ServerEphemeral []byte
+	ExpiresAt       time.Time
+}
+
+// keypairSessionStore keeps the session key of a challenge in keypair mode
+// until the challenge response arrives, the response is sealed with it
+type keypairSessionStore struct {
+	mux        sync.Mutex
+	items      map[keypairSessionKey]keypairSession
+	maxEntries int
+}
+
+func newKeypairSessionStore(maxEntries int) *keypairSessionStore {
+	return &keypairSessionStore{
+		items:      make(map[keypairSessionKey]keypairSession),
+		maxEntries: maxEntries,
+	}
+}
+
+func (s *keypairSessionStore) add(key keypairSessionKey, session keypairSession) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, exists := s.items[key]; !exists && s.maxEntries > 0 && len(s.items) >= s.maxEntries {
+		return false
+	}
+	s.items[key] = session
+	return true
+}
+
+// take removes the session of key, a session can be used only once
+func (s *keypairSessionStore) take(key keypairSessionKey, now time.Time) (keypairSession, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	session, exists := s.items[key]
+	if !exists {
+		return keypairSession{}, false
+	}
+	delete(s.items, key)
+	return session, session.ExpiresAt.After(now)
+}
+
+func (s *keypairSessionStore) cleanup(now time.Time) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	deleted := 0
+	for key, session := range s.items {
+		if !session.ExpiresAt.After(now) {
+			delete(s.items, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// handleKeypairPacket handles an envelope in keypair mode. A signed envelope
+// carries the challenge request, an unsigned one the challenge response.
+func handleKeypairPacket(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, now time.Time) {
+	pub, ok := currentConfig().clientKeyByID(env.ClientID)
+	if !ok {
+		authPacketsIgnored.Inc("unknown_client_key")
+		log.Debugf("auth packet from %s ignored: unknown client key", peer.IP.String())
+		return
+	}
+	if len(env.EphemeralKey) == 0 {
+		authPacketsIgnored.Inc("invalid_envelope")
+		log.Debugf("auth packet from %s ignored: invalid envelope", peer.IP.String())
+		return
+	}
+	if len(env.Signature) > 0 {
+		handleKeypairRequest(conn, peer, env, format, pub, now)
+	} else {
+		handleKeypairResponse(conn, peer, env, format, pub, now)
+	}
+}
+
+func handleKeypairRequest(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, pub ed25519.PublicKey, now time.Time) {
+	if !authproto.VerifyHello(pub, env) {
+		authPacketsIgnored.Inc("bad_signature")
+		log.Debugf("challenge request from %s ignored: bad signature", peer.IP.String())
+		recordDecryptFailure(peer.IP, "bad_signature", now)
+		return
+	}
+	ephemeral, err := authproto.NewEphemeralKey()
+	if err != nil {
+		authPacketsIgnored.Inc("key_generation_failed")
+		log.Warnf("challenge request from %s ignored: %v", peer.IP.String(), err)
+		return
+	}
+	serverEphemeral := ephemeral.PublicKey().Bytes()
+	key, err := authproto.SessionKey(ephemeral, env.EphemeralKey, env.Context(), env.EphemeralKey, serverEphemeral)
+	if err != nil {
+		authPacketsIgnored.Inc("invalid_envelope")
+		log.Debugf("challenge request from %s ignored: %v", peer.IP.String(), err)
+		return
+	}
+	sessionKey := keypairSessionKey{IP: peer.IP.String(), ClientID: env.ClientID, ClientEphemeral: string(env.EphemeralKey)}
+	session := keypairSession{Key: key, ServerEphemeral: serverEphemeral, ExpiresAt: now.Add(authproto.ChallengeTTL)}
+	if !keypairSessions.add(sessionKey, session) {
+		authPacketsIgnored.Inc("pending_limit_reached")
+		log.Debugf("challenge request from %s ignored: pending limit reached", peer.IP.String())
+		return
+	}
+	reply := authproto.Envelope{ServerID: env.ServerID, ClientID: env.ClientID, EphemeralKey: serverEphemeral}
+	handleChallengeRequest(conn, peer, reply, format, string(key), env.Payload)
+}
+
+func handleKeypairResponse(conn *net.UDPConn, peer *net.UDPAddr, env authproto.Envelope, format string, pub ed25519.PublicKey, now time.Time) {
+	session, ok := keypairSessions.take(keypairSessionKey{IP: peer.IP.String(), ClientID: env.ClientID, ClientEphemeral: string(env.EphemeralKey)}, now)
+	if !ok {
+		authPacketsIgnored.Inc("no_pending_challenge")
+		log.Debugf("challenge response from %s ignored: no pending challenge", peer.IP.String())
+		return
+	}
+	plain, err := authproto.Open(session.Key, env.Context(), env.Payload)
+	if err != nil {
+		authPacketsIgnored.Inc("decrypt_failed")
+		log.Debugf("challenge response from %s ignored: decrypt failed", peer.IP.String())
+		recordDecryptFailure(peer.IP, "decrypt_failed", now)
+		return
+	}
+	var resp authproto.ChallengeResponse
+	if err := authproto.DecodeMessage(plain, format, &resp); err != nil {
+		authPacketsIgnored.Inc("invalid_response")
+		log.Debugf("challenge response from %s ignored: invalid response", peer.IP.String())
+		return
+	}
+	challenge := authproto.Challenge{Port: resp.Port, ClientNonce: resp.ClientNonce, ServerNonce: resp.ServerNonce}
+	if resp.ClientID != env.ClientID ||
+		!authproto.VerifyChallenge(pub, env.Context(), env.EphemeralKey, session.ServerEphemeral, challenge, resp.Signature) {
+		authPacketsIgnored.Inc("bad_signature")
+		// the response decrypted with the session key, so the source received
+		// the challenge and is not spoofed
+		log.Debugf("challenge response from %s ignored: bad signature", peer.IP.String())
+		recordAuthFailure(peer.IP, "bad_signature", now)
+		return
+	}
+	reply := authproto.Envelope{ServerID: env.ServerID, ClientID: env.ClientID, EphemeralKey: session.ServerEphemeral}
+	handleChallengeResponse(conn, peer, reply, format, string(session.Key), plain)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+func setupKeypairAuthForTest(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := authproto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate client key: %v", err)
+	}
+	key, _ := authproto.ParsePrivateKey(priv)
+	authAddr := freeUDPAddr(t)
+	expiry := uint32(60)
+	conf := &config{
+		ServerID:   "connauth-server",
+		AuthAddr:   authAddr,
+		ClientKeys: []clientKeyConfig{{ClientID: "laptop", PublicKey: pub}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	if err := conf.CheckValid(); err != nil {
+		t.Fatalf("expected keypair config to be valid: %v", err)
+	}
+	conf.AuthBan.MaxFailures = newUint32(0)
+	// auth loops of earlier iterations may still read the config
+	setConfig(conf)
+	initClientList()
+	stopAuth := startAuthForTest(t, authAddr)
+	t.Cleanup(stopAuth)
+	return authAddr, key
+}
+
+// keypairHelloForTest sends a signed challenge request of client laptop and
+// returns the ephemeral key it used
+func keypairHelloForTest(t *testing.T, conn *net.UDPConn, key ed25519.PrivateKey, format string) *ecdh.PrivateKey {
+	t.Helper()
+	ephemeral, err := authproto.NewEphemeralKey()
+	if err != nil {
+		t.Fatalf("ephemeral key: %v", err)
+	}
+	body, err := authproto.EncodeMessage(authproto.ChallengeRequest{
+		Type:        authproto.MessageTypeChallengeRequest,
+		ServerID:    "connauth-server",
+		ClientID:    "laptop",
+		Port:        40022,
+		ClientNonce: "client-nonce",
+		Timestamp:   time.Now().Unix(),
+	}, format)
+	if err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	env := authproto.Envelope{ServerID: "connauth-server", ClientID: "laptop", EphemeralKey: ephemeral.PublicKey().Bytes(), Payload: body}
+	env.Signature = authproto.SignHello(key, env)
+	packet, err := authproto.EncodeEnvelope(env, format)
+	if err != nil {
+		t.Fatalf("encode envelope: %v", err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	return ephemeral
+}
+
+func TestKeypairHandshakeAuthorizesClient(t *testing.T) {
+	for _, format := range []string{authproto.WireFormatJSON, authproto.WireFormatBinary} {
+		authAddr, key := setupKeypairAuthForTest(t)
+		conn := dialUDPForTest(t, authAddr)
+		defer conn.Close()
+		ctx := authproto.Context{KeyID: "laptop", ServerID: "connauth-server"}
+
+		ephemeral := keypairHelloForTest(t, conn, key, format)
+		env, replyFormat, err := authproto.DecodeEnvelope(readUDPWithTimeout(conn, time.Second))
+		if err != nil || replyFormat != format || env.ClientID != "laptop" || len(env.EphemeralKey) != authproto.EphemeralKeySize {
+			t.Fatalf("expected %s challenge envelope: %+v %v", format, env, err)
+		}
+		clientEphemeral := ephemeral.PublicKey().Bytes()
+		session, err := authproto.SessionKey(ephemeral, env.EphemeralKey, ctx, clientEphemeral, env.EphemeralKey)
+		if err != nil {
+			t.Fatalf("session key: %v", err)
+		}
+		plain, err := authproto.Open(session, ctx, env.Payload)
+		if err != nil {
+			t.Fatalf("open challenge: %v", err)
+		}
+		var challenge authproto.Challenge
+		if err := authproto.DecodeMessage(plain, format, &challenge); err != nil || challenge.ServerNonce == "" {
+			t.Fatalf("decode challenge: %+v %v", challenge, err)
+		}
+
+		resp := authproto.ChallengeResponse{
+			Type:        authproto.MessageTypeChallengeResponse,
+			ServerID:    "connauth-server",
+			ClientID:    "laptop",
+			Port:        40022,
+			ClientNonce: challenge.ClientNonce,
+			ServerNonce: challenge.ServerNonce,
+			Token:       "token-abcdefghijklmnopqrstuvwxyz",
+			Timestamp:   time.Now().Unix(),
+			Signature:   authproto.SignChallenge(key, ctx, clientEphemeral, env.EphemeralKey, challenge),
+		}
+		body, _ := authproto.EncodeMessage(resp, format)
+		sealed, _ := authproto.Seal(session, ctx, body)
+		packet, _ := authproto.EncodeEnvelope(authproto.Envelope{ServerID: "connauth-server", ClientID: "laptop", EphemeralKey: clientEphemeral, Payload: sealed}, format)
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatalf("write response: %v", err)
+		}
+		env, _, err = authproto.DecodeEnvelope(readUDPWithTimeout(conn, time.Second))
+		if err != nil {
+			t.Fatalf("decode result envelope: %v", err)
+		}
+		plain, err = authproto.Open(session, ctx, env.Payload)
+		if err != nil {
+			t.Fatalf("open result: %v", err)
+		}
+		var result authproto.AuthResult
+		if err := authproto.DecodeMessage(plain, format, &result); err != nil || !result.Authorized() {
+			t.Fatalf("expected authorized result: %+v %v", result, err)
+		}
+		if !isClientAuthed(&currentConfig().ForwardConfigs[0], net.ParseIP("127.0.0.1"), "laptop") {
+			t.Fatal("expected keypair client to be authorized")
+		}
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatalf("replay response: %v", err)
+		}
+		if raw := readUDPWithTimeout(conn, 100*time.Millisecond); raw != nil {
+			t.Fatal("expected replayed response to be ignored")
+		}
+	}
+}
+
+func TestKeypairRequestWithWrongKeyIsSilent(t *testing.T) {
+	authAddr, _ := setupKeypairAuthForTest(t)
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+	_, priv, _ := authproto.GenerateKey()
+	other, _ := authproto.ParsePrivateKey(priv)
+	badSignature := authPacketsIgnored.Value("bad_signature")
+	keypairHelloForTest(t, conn, other, authproto.WireFormatBinary)
+	if raw := readUDPWithTimeout(conn, 200*time.Millisecond); raw != nil {
+		t.Fatal("expected request signed by another key to be ignored")
+	}
+	if authPacketsIgnored.Value("bad_signature")-badSignature != 1 {
+		t.Fatal("expected request to be counted as bad signature")
+	}
+	revoked := *currentConfig()
+	revoked.ClientKeys = nil
+	setConfig(&revoked)
+	keypairHelloForTest(t, conn, other, authproto.WireFormatBinary)
+	if raw := readUDPWithTimeout(conn, 200*time.Millisecond); raw != nil {
+		t.Fatal("expected request of revoked client to be ignored")
+	}
+}
+
+func TestServerConfigValidatesClientKeys(t *testing.T) {
+	pub, _, _ := authproto.GenerateKey()
+	cfg := config{
+		ServerID:   "connauth-server",
+		AuthAddr:   "127.0.0.1:40100",
+		ClientKeys: []clientKeyConfig{{ClientID: "laptop", PublicKey: pub}, {ClientID: "laptop", PublicKey: pub}},
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected duplicate client key to be rejected")
+	}
+	cfg.ClientKeys = []clientKeyConfig{{ClientID: "laptop", PublicKey: "not-a-key"}}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected invalid public key to be rejected")
+	}
+	cfg.ClientKeys = nil
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected config without authkeys and clientkeys to be rejected")
+	}
+}
@@ -25,7 +25,16 @@ func initLogger(cfg *config) error {
 			log.AddHook(hook)
 		}
 	}
-	switch strings.ToLower(cfg.LogLevel) {
+	setLogLevel(cfg.LogLevel)
+	formatter := &log.TextFormatter{}
+	formatter.FullTimestamp = true
+	formatter.TimestampFormat = "2006-01-02 15:04:05"
+	log.SetFormatter(formatter)
+	return nil
+}
+
+func setLogLevel(level string) {
+	switch strings.ToLower(level) {
 	case "p", "panic":
 		log.SetLevel(log.PanicLevel)
 	case "f", "fatal":
@@ -43,9 +52,4 @@ func initLogger(cfg *config) error {
 	default:
 		log.SetLevel(log.WarnLevel)
 	}
-	formatter := &log.TextFormatter{}
-	formatter.FullTimestamp = true
-	formatter.TimestampFormat = "2006-01-02 15:04:05"
-	log.SetFormatter(formatter)
-	return nil
 }
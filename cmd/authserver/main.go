@@ -1,12 +1,15 @@
 package main
 
 import (
+	"connauth/utils/authproto"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	_log "log"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"connauth/utils/service"
 )
@@ -30,34 +33,116 @@ func Main(exit <-chan struct{}) {
 	log.Debug("Platform:", service.Platform())
 	log.Info("Log level:", log.GetLevel())
 
+	inheritSockets()
 	stop := make(chan struct{})
+	upgraded := watchUpgrade(stop)
+	runtime := newServerRuntime(configFile)
+	conf := currentConfig()
+	initClientList()
+	var stateDone <-chan struct{}
+	if conf.StateFile != "" {
+		if count, err := loadClientState(conf.StateFile, time.Now()); err != nil {
+			log.Warn(err)
+		} else {
+			log.Infof("restored %d authorized clients from %s", count, conf.StateFile)
+		}
+		stateDone = keepClientState(conf.StateFile, time.Duration(*conf.StateSaveInterval)*time.Second, stop, upgraded)
+	}
 	go func() {
-		initClientList()
-		if _, err := waitForAuth(globalConfig.AuthAddr, stop); err != nil {
+		_, err := waitForAuth(conf.AuthAddr, stop)
+		if err != nil {
 			log.Error(err)
 		} else {
-			log.Infof("waiting for auth by UDP, address %s", globalConfig.AuthAddr)
+			log.Infof("waiting for auth by UDP, address %s", conf.AuthAddr)
 		}
-		for i := range globalConfig.ForwardConfigs {
-			cfg := &globalConfig.ForwardConfigs[i]
-			if err := startForward(cfg); err != nil {
-				log.Errorf("start forward %d failed: %v", i+1, err)
+		runtime.start(conf)
+		finishUpgrade(err == nil)
+		if conf.Admin.Addr != "" {
+			if _, err := startAdmin(conf.Admin.Addr, runtime, stop); err != nil {
+				log.Error(err)
+			} else {
+				log.Infof("admin API listening on %s", conf.Admin.Addr)
 			}
 		}
+		if conf.MetricsAddr != "" {
+			if _, err := startMetrics(conf.MetricsAddr, runtime, stop); err != nil {
+				log.Error(err)
+			} else {
+				log.Infof("metrics listening on %s", conf.MetricsAddr)
+			}
+		}
+		_ = service.Notify("READY=1")
+		go service.KeepAlive(func() error { return runtime.checkAlive(time.Now()) }, stop)
+		runtime.watch(stop)
 	}()
 
-	// waiting for the exit signal
-	<-exit
+	// waiting for the exit signal, or for a new process that took over
+	select {
+	case <-exit:
+	case <-upgraded:
+	}
+	// stop accepting auths and connections, then let the forwarded
+	// connections finish within shutdowngrace
 	close(stop)
+	grace := time.Duration(*currentConfig().ShutdownGrace) * time.Second
+	active, closed := runtime.shutdown(grace)
+	log.WithFields(log.Fields{
+		"event":        "shutdown_drained",
+		"result":       "success",
+		"active":       active,
+		"force_closed": closed,
+	}).Infof("%d forwarded connections finished, %d force-closed after %s", active-closed, closed, grace)
+	if stateDone != nil {
+		<-stateDone
+	}
+}
+
+var configFile string
+
+// controlService installs or uninstalls the service that runs with
+// configFile
+func controlService(command string, configFile string) error {
+	if command == "uninstall" {
+		return service.Uninstall()
+	}
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	return service.Install([]string{"-c", abs})
 }
 
 func main() {
 	var err error
-	var configFile string
 	var checkConfig bool
+	var genKey bool
 	flag.StringVar(&configFile, "c", DefaultConfigFile, "path of config file")
 	flag.BoolVar(&checkConfig, "check-config", false, "validate config and exit")
+	flag.BoolVar(&genKey, "genkey", false, "generate an identity key and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s hash-token < token.txt\n       %s [flags] install|uninstall\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	command := flag.Arg(0)
+	switch command {
+	case "", "install", "uninstall":
+	case "hash-token":
+		if err := runHashToken(os.Stdin, os.Stdout); err != nil {
+			_log.Fatalln("Hash token fail:", err)
+		}
+		return
+	default:
+		_log.Fatalln("Unknown command:", command)
+	}
+	if genKey {
+		pub, priv, err := authproto.GenerateKey()
+		if err != nil {
+			_log.Fatalln("Generate key fail:", err)
+		}
+		fmt.Printf("# server_config.yaml\nidentitykey: %q\n# serverpublickey of client_config.yaml\nserverpublickey: %q\n", priv, pub)
+		return
+	}
 	if configFile == "" {
 		configFile = path.Join(getCurrentPath(), DefaultConfigFile)
 	}
@@ -77,6 +162,13 @@ func main() {
 		DisplayName: globalConfig.Service.DisplayName,
 		Description: globalConfig.Service.Description,
 	})
+	if command != "" {
+		if err := controlService(command, configFile); err != nil {
+			_log.Fatalf("%s service fail: %v", command, err)
+		}
+		_log.Printf("%s service %s done", command, globalConfig.Service.ServiceName)
+		return
+	}
 	err = service.Run(Main)
 	if err != nil {
 		log.Error(err)
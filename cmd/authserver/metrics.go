@@ -0,0 +1,101 @@
+package main
+
+import (
+	"connauth/utils/metrics"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	authPacketsIgnored = metrics.NewCounterVec("connauth_auth_packets_ignored_total",
+		"Auth packets dropped without reply, by reason.", "reason")
+	authPacketsReceived = metrics.NewCounterVec("connauth_auth_packets_total",
+		"Auth packets received with a decodable envelope, by wire format (json or binary).", "format")
+	authChallengesIssued = metrics.NewCounterVec("connauth_auth_challenges_issued_total",
+		"Challenges sent in reply to a valid challenge request.")
+	authResults = metrics.NewCounterVec("connauth_auth_results_total",
+		"Answered challenge responses, by result (success, renewed or failed).", "result")
+	authBansIssued = metrics.NewCounterVec("connauth_auth_bans_total",
+		"Source IPs banned for failing auth too often, by the failure that triggered the ban.", "reason")
+	backendDialSeconds = metrics.NewHistogramVec("connauth_backend_dial_seconds",
+		"Latency of connecting to the backend, by port and result (success or failed).",
+		[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 3, 10}, "port", "result")
+	forwardedBytes = metrics.NewHistogramVec("connauth_forwarded_bytes",
+		"Bytes forwarded per connection, by port and direction (upstream to backend, downstream to client).",
+		metrics.ExponentialBuckets(1024, 4, 10), "port", "direction")
+)
+
+func observeForward(port uint16, stats forwardStats) {
+	portLabel := strconv.Itoa(int(port))
+	if !stats.Dialed {
+		backendDialSeconds.Observe(stats.DialDuration.Seconds(), portLabel, "failed")
+		return
+	}
+	backendDialSeconds.Observe(stats.DialDuration.Seconds(), portLabel, "success")
+	forwardedBytes.Observe(float64(stats.Upstream), portLabel, "upstream")
+	forwardedBytes.Observe(float64(stats.Downstream), portLabel, "downstream")
+}
+
+func newMetricsRegistry(runtime *serverRuntime) *metrics.Registry {
+	pending := metrics.NewGaugeFunc("connauth_pending_challenges",
+		"Challenges waiting for a response.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(pendingChallenges.count())}}
+		})
+	banned := metrics.NewGaugeFunc("connauth_banned_ips",
+		"Source IPs currently banned by authban.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(len(authBans.snapshot(time.Now())))}}
+		})
+	clients := metrics.NewGaugeFunc("connauth_authorized_clients",
+		"Unexpired authorized clients, by port.", []string{"port"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for port, count := range countAuthorizedClients(time.Now()) {
+				samples = append(samples, metrics.Sample{LabelValues: []string{strconv.Itoa(int(port))}, Value: float64(count)})
+			}
+			return samples
+		})
+	connections := metrics.NewGaugeFunc("connauth_active_connections",
+		"Active forwarded connections, by port.", []string{"port"}, func() []metrics.Sample {
+			// forwards of one port on different bindaddrs are summed
+			active := make(map[uint16]int)
+			for _, stat := range runtime.connections() {
+				active[stat.Port] += stat.Active
+			}
+			var samples []metrics.Sample
+			for port, count := range active {
+				samples = append(samples, metrics.Sample{LabelValues: []string{strconv.Itoa(int(port))}, Value: float64(count)})
+			}
+			return samples
+		})
+	return metrics.NewRegistry(authPacketsReceived, authPacketsIgnored, authChallengesIssued, authResults, authBansIssued,
+		pending, banned, clients, connections, backendDialSeconds, forwardedBytes)
+}
+
+func startMetrics(addr string, runtime *serverRuntime, stop <-chan struct{}) (<-chan struct{}, error) {
+	listener, err := sockets.listenTCP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen metrics addr %s failed: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsRegistry(runtime).Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+	done := make(chan struct{})
+	go func() {
+		<-stop
+		_ = server.Close()
+	}()
+	go func() {
+		defer close(done)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Warnf("metrics server on %s stopped: %v", addr, err)
+		}
+	}()
+	return done, nil
+}
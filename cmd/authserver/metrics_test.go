@@ -0,0 +1,132 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthPacketsAreCountedByOutcome(t *testing.T) {
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	expiry := uint32(60)
+	authAddr := freeUDPAddr(t)
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: authAddr,
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: key}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: token}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	initClientList()
+	stopAuth := startAuthForTest(t, authAddr)
+	defer stopAuth()
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+
+	invalidEnvelope := authPacketsIgnored.Value("invalid_envelope")
+	unknownKeyID := authPacketsIgnored.Value("unknown_key_id")
+	issued := authChallengesIssued.Value()
+	success, renewed, failed := authResults.Value("success"), authResults.Value("renewed"), authResults.Value("failed")
+
+	if _, err := conn.Write([]byte("not an envelope")); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	env, _ := json.Marshal(authproto.Envelope{KeyID: "unknown-key", ServerID: "connauth-server", Payload: []byte("payload")})
+	if _, err := conn.Write(env); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	for i, tokenValue := range []string{token, token, "wrong-abcdefghijklmnopqrstuvwxyz"} {
+		challenge := sendChallengeRequestForTest(t, conn, key, fmt.Sprintf("client-nonce-%d", i), 40022)
+		sendChallengeResponseForTest(t, conn, key, challenge, tokenValue)
+		readAuthResultForTest(t, conn, key)
+	}
+
+	if got := authPacketsIgnored.Value("invalid_envelope") - invalidEnvelope; got != 1 {
+		t.Fatalf("expected one invalid envelope, got %v", got)
+	}
+	if got := authPacketsIgnored.Value("unknown_key_id") - unknownKeyID; got != 1 {
+		t.Fatalf("expected one unknown key id, got %v", got)
+	}
+	if got := authChallengesIssued.Value() - issued; got != 3 {
+		t.Fatalf("expected three issued challenges, got %v", got)
+	}
+	if authResults.Value("success")-success != 1 || authResults.Value("renewed")-renewed != 1 || authResults.Value("failed")-failed != 1 {
+		t.Fatal("expected one success, one renewed and one failed auth result")
+	}
+}
+
+func TestMetricsEndpointReportsStateGauges(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	port := freeTCPPort(t)
+	writeReloadConfigForTest(t, file, port)
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	previous := pendingChallenges
+	pendingChallenges = newPendingChallengeStore(10, 4)
+	defer func() {
+		pendingChallenges = previous
+	}()
+	pendingChallenges.add(pendingChallengeKey{IP: "192.0.2.10", ClientNonce: "client-nonce"}, time.Now().Add(time.Minute))
+	if !authorizeClient("192.0.2.10", "workstation", port, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	backendDialSeconds.Observe(0.002, intPort(port), "success")
+
+	rec := httptest.NewRecorder()
+	newMetricsRegistry(runtime).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"connauth_pending_challenges 1\n",
+		fmt.Sprintf("connauth_authorized_clients{port=\"%d\"} 1\n", port),
+		fmt.Sprintf("connauth_active_connections{port=\"%d\"} 0\n", port),
+		fmt.Sprintf("connauth_backend_dial_seconds_bucket{port=\"%d\",result=\"success\",le=\"0.005\"}", port),
+		"# TYPE connauth_auth_packets_ignored_total counter\n",
+		"# TYPE connauth_forwarded_bytes histogram\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("metrics output misses %q:\n%s", expected, body)
+		}
+	}
+}
+
+func TestForwardObservesBackendDialFailure(t *testing.T) {
+	port := uint16(40999)
+	before := backendDialSeconds.Count(intPort(port), "failed")
+	client, accepted := tcpPairForTest(t)
+	defer client.Close()
+	stats, err := handleConn(accepted, "127.0.0.1:1", 100*time.Millisecond, time.Second, 0)
+	if err == nil {
+		t.Fatal("expected dial to closed port to fail")
+	}
+	observeForward(port, stats)
+	if backendDialSeconds.Count(intPort(port), "failed")-before != 1 {
+		t.Fatal("expected failed dial to be observed")
+	}
+}
+
+func TestServerConfigValidatesMetricsAddr(t *testing.T) {
+	cfg := config{
+		ServerID:    "connauth-server",
+		AuthAddr:    "127.0.0.1:40100",
+		AuthKeys:    []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		MetricsAddr: "not-an-addr",
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected invalid metricsaddr to be rejected")
+	}
+	cfg.MetricsAddr = "127.0.0.1:40190"
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatalf("expected metricsaddr to be valid: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// usedOTPCodes keeps a totp code to the client that used it first. The
+// proof of a code can be brute-forced by anyone able to read the response,
+// so a code must not be good for someone else afterwards.
+var usedOTPCodes = newOTPUses()
+
+// otpUses remembers per totp secret the latest step used and by whom
+type otpUses struct {
+	mux   sync.Mutex
+	items map[[sha256.Size]byte]otpUse
+}
+
+type otpUse struct {
+	step   uint64
+	client authorizedClientKey
+}
+
+func newOTPUses() *otpUses {
+	return &otpUses{items: make(map[[sha256.Size]byte]otpUse)}
+}
+
+// use records that client proved the code of step. The code of the latest
+// step stays good for the same client, so a renewal or a second forward of
+// the same auth still passes, older steps are refused.
+func (u *otpUses) use(secret []byte, step uint64, client authorizedClientKey) bool {
+	key := sha256.Sum256(secret)
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if last, ok := u.items[key]; ok {
+		if step < last.step || step == last.step && last.client != client {
+			return false
+		}
+	}
+	u.items[key] = otpUse{step: step, client: client}
+	return true
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestOTPCodeIsGoodForOneClientOnly(t *testing.T) {
+	uses := newOTPUses()
+	secret := []byte("12345678901234567890")
+	client := authorizedClientKey{IP: "192.0.2.10", ClientID: "workstation"}
+	other := authorizedClientKey{IP: "198.51.100.7", ClientID: "workstation"}
+	if !uses.use(secret, 100, client) || !uses.use(secret, 100, client) {
+		t.Fatal("expected the code to stay good for the client that used it")
+	}
+	if uses.use(secret, 100, other) {
+		t.Fatal("expected a used code to be refused for another client")
+	}
+	if !uses.use([]byte("another secret 12345"), 100, other) {
+		t.Fatal("expected codes of other secrets to be independent")
+	}
+	if !uses.use(secret, 101, other) {
+		t.Fatal("expected the code of a later step to be accepted")
+	}
+	if uses.use(secret, 100, client) {
+		t.Fatal("expected the code of an earlier step to be refused")
+	}
+}
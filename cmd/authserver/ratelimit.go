@@ -0,0 +1,260 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var authLimiter = newAuthRateLimiter(100000)
+var authBans = newAuthBanList(100000)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// authRateLimiter is a token bucket per source prefix for the UDP auth port
+type authRateLimiter struct {
+	mux        sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxEntries int
+}
+
+func newAuthRateLimiter(maxEntries int) *authRateLimiter {
+	return &authRateLimiter{
+		buckets:    make(map[string]*tokenBucket),
+		maxEntries: maxEntries,
+	}
+}
+
+// allow takes one token from the bucket of key. A source seen for the first
+// time starts with a full bucket of burst tokens.
+func (l *authRateLimiter) allow(key string, rate float64, burst float64, now time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if l.maxEntries > 0 && len(l.buckets) >= l.maxEntries {
+			l.cleanupLocked(rate, burst, now)
+		}
+		if l.maxEntries > 0 && len(l.buckets) >= l.maxEntries {
+			// too many sources to track, a spoofed flood must not lock out
+			// everyone, the pending challenge limit still applies
+			return true
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup drops the buckets that are full again, they behave the same as a
+// new bucket
+func (l *authRateLimiter) cleanup(rate float64, burst float64, now time.Time) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.cleanupLocked(rate, burst, now)
+}
+
+func (l *authRateLimiter) cleanupLocked(rate float64, burst float64, now time.Time) int {
+	deleted := 0
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// rateLimitKey returns the source prefix of ip that shares one bucket
+func rateLimitKey(ip net.IP, ipv4Prefix int, ipv6Prefix int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ipv4Prefix, 32)).String() + "/" + strconv.Itoa(ipv4Prefix)
+	}
+	return ip.Mask(net.CIDRMask(ipv6Prefix, 128)).String() + "/" + strconv.Itoa(ipv6Prefix)
+}
+
+// kinds of failures, each is counted apart with its own threshold
+const (
+	authFailure    = "auth"    // a completed challenge with wrong credentials
+	decryptFailure = "decrypt" // a packet that does not decrypt or verify
+)
+
+// authBanList counts failed auths per IP and bans an IP that fails too often
+// within a window, see handleAuthPacket and isIPDenied
+type authBanList struct {
+	mux        sync.Mutex
+	failures   map[string][]time.Time
+	banned     map[string]time.Time
+	maxEntries int
+}
+
+func newAuthBanList(maxEntries int) *authBanList {
+	return &authBanList{
+		failures:   make(map[string][]time.Time),
+		banned:     make(map[string]time.Time),
+		maxEntries: maxEntries,
+	}
+}
+
+// recordFailure counts one failure of kind of ip and bans it once
+// maxFailures of that kind are reached within window. It returns true when ip
+// was banned by this call.
+func (b *authBanList) recordFailure(ip string, kind string, maxFailures int, window time.Duration, banTime time.Duration, now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if until, ok := b.banned[ip]; ok && until.After(now) {
+		return false
+	}
+	key := kind + " " + ip
+	recent, tracked := b.failures[key]
+	if !tracked && b.maxEntries > 0 && len(b.failures) >= b.maxEntries {
+		return false
+	}
+	kept := recent[:0]
+	for _, t := range recent {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	if len(kept) < maxFailures {
+		b.failures[key] = kept
+		return false
+	}
+	delete(b.failures, key)
+	b.banned[ip] = now.Add(banTime)
+	return true
+}
+
+func (b *authBanList) isBanned(ip string, now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	until, ok := b.banned[ip]
+	if !ok {
+		return false
+	}
+	if !until.After(now) {
+		delete(b.banned, ip)
+		return false
+	}
+	return true
+}
+
+type authBanEntry struct {
+	IP    string
+	Until time.Time
+}
+
+func (b *authBanList) snapshot(now time.Time) []authBanEntry {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	entries := make([]authBanEntry, 0, len(b.banned))
+	for ip, until := range b.banned {
+		if until.After(now) {
+			entries = append(entries, authBanEntry{IP: ip, Until: until})
+		}
+	}
+	return entries
+}
+
+// unban lifts the ban of ip, it returns false if ip was not banned
+func (b *authBanList) unban(ip string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	_, ok := b.banned[ip]
+	delete(b.banned, ip)
+	delete(b.failures, authFailure+" "+ip)
+	delete(b.failures, decryptFailure+" "+ip)
+	return ok
+}
+
+// cleanup drops expired bans and failures older than window
+func (b *authBanList) cleanup(window time.Duration, now time.Time) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	deleted := 0
+	for ip, until := range b.banned {
+		if !until.After(now) {
+			delete(b.banned, ip)
+			deleted++
+		}
+	}
+	for key, recent := range b.failures {
+		if len(recent) == 0 || now.Sub(recent[len(recent)-1]) >= window {
+			delete(b.failures, key)
+		}
+	}
+	return deleted
+}
+
+// allowAuthPacket applies the rate limit of the auth port to ip
+func allowAuthPacket(ip net.IP, now time.Time) bool {
+	limit := currentConfig().AuthRateLimit
+	if limit.Rate == nil || *limit.Rate == 0 {
+		return true
+	}
+	key := rateLimitKey(ip, int(*limit.IPv4Prefix), int(*limit.IPv6Prefix))
+	return authLimiter.allow(key, float64(*limit.Rate), float64(*limit.Burst), now)
+}
+
+// recordAuthFailure counts a failed auth of ip after a completed challenge and
+// bans ip when it fails maxfailures times
+func recordAuthFailure(ip net.IP, reason string, now time.Time) {
+	recordFailure(ip, authFailure, currentConfig().AuthBan.MaxFailures, reason, now)
+}
+
+// recordDecryptFailure counts a packet of ip that does not decrypt or verify
+// and bans ip after maxdecryptfailures of them. The source of such a packet
+// is not proven, so the threshold is separate from that of failed auths.
+func recordDecryptFailure(ip net.IP, reason string, now time.Time) {
+	recordFailure(ip, decryptFailure, currentConfig().AuthBan.MaxDecryptFailures, reason, now)
+}
+
+func recordFailure(ip net.IP, kind string, maxFailures *uint32, reason string, now time.Time) {
+	if maxFailures == nil || *maxFailures == 0 {
+		return
+	}
+	ban := currentConfig().AuthBan
+	banTime := time.Duration(*ban.BanTime) * time.Second
+	if !authBans.recordFailure(ip.String(), kind, int(*maxFailures), time.Duration(*ban.Window)*time.Second, banTime, now) {
+		return
+	}
+	authBansIssued.Inc(reason)
+	log.WithFields(log.Fields{
+		"event":       "auth_banned",
+		"source_ip":   ip.String(),
+		"result":      "banned",
+		"reason":      reason,
+		"failures":    *maxFailures,
+		"ban_seconds": *ban.BanTime,
+	}).Warnf("ban %s for %d seconds after %d failures within %d seconds", ip.String(), *ban.BanTime, *maxFailures, *ban.Window)
+}
+
+// cleanupAuthLimits drops rate limit buckets and bans that no longer matter
+func cleanupAuthLimits(now time.Time) {
+	conf := currentConfig()
+	if limit := conf.AuthRateLimit; limit.Rate != nil && *limit.Rate > 0 {
+		authLimiter.cleanup(float64(*limit.Rate), float64(*limit.Burst), now)
+	}
+	window := time.Duration(0)
+	if conf.AuthBan.Window != nil {
+		window = time.Duration(*conf.AuthBan.Window) * time.Second
+	}
+	if deleted := authBans.cleanup(window, now); deleted > 0 {
+		log.Debugf("%d auth bans expired", deleted)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuthRateLimiterRefillsTokens(t *testing.T) {
+	limiter := newAuthRateLimiter(10)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("192.0.2.0/24", 1, 3, now) {
+			t.Fatalf("expected packet %d within burst to be allowed", i)
+		}
+	}
+	if limiter.allow("192.0.2.0/24", 1, 3, now) {
+		t.Fatal("expected packet above burst to be limited")
+	}
+	if !limiter.allow("198.51.100.0/24", 1, 3, now) {
+		t.Fatal("expected other source to have its own bucket")
+	}
+	if !limiter.allow("192.0.2.0/24", 1, 3, now.Add(time.Second)) {
+		t.Fatal("expected bucket to refill with rate")
+	}
+	if limiter.allow("192.0.2.0/24", 1, 3, now.Add(time.Second)) {
+		t.Fatal("expected refill to be limited by rate")
+	}
+	if deleted := limiter.cleanup(1, 3, now.Add(time.Minute)); deleted != 2 {
+		t.Fatalf("expected refilled buckets to be cleaned up, got %d", deleted)
+	}
+}
+
+func TestRateLimitKeyGroupsPrefix(t *testing.T) {
+	if key := rateLimitKey(net.ParseIP("192.0.2.77"), 24, 64); key != "192.0.2.0/24" {
+		t.Fatalf("unexpected ipv4 key %s", key)
+	}
+	if key := rateLimitKey(net.ParseIP("2001:db8:1:2:3:4:5:6"), 32, 64); key != "2001:db8:1:2::/64" {
+		t.Fatalf("unexpected ipv6 key %s", key)
+	}
+}
+
+func TestAuthBanListBansRepeatedFailuresWithinWindow(t *testing.T) {
+	bans := newAuthBanList(10)
+	now := time.Now()
+	if bans.recordFailure("192.0.2.10", authFailure, 3, time.Minute, time.Hour, now) ||
+		bans.recordFailure("192.0.2.10", authFailure, 3, time.Minute, time.Hour, now.Add(2*time.Minute)) ||
+		bans.recordFailure("192.0.2.10", authFailure, 3, time.Minute, time.Hour, now.Add(2*time.Minute)) {
+		t.Fatal("failures outside the window must not be counted")
+	}
+	if bans.recordFailure("192.0.2.10", decryptFailure, 3, time.Minute, time.Hour, now.Add(2*time.Minute)) {
+		t.Fatal("failures of another kind must be counted apart")
+	}
+	if !bans.recordFailure("192.0.2.10", authFailure, 3, time.Minute, time.Hour, now.Add(2*time.Minute+time.Second)) {
+		t.Fatal("expected third failure within window to ban")
+	}
+	if !bans.isBanned("192.0.2.10", now.Add(3*time.Minute)) {
+		t.Fatal("expected ip to be banned")
+	}
+	if bans.isBanned("192.0.2.11", now.Add(3*time.Minute)) {
+		t.Fatal("ban must be limited to the failing ip")
+	}
+	if bans.isBanned("192.0.2.10", now.Add(2*time.Hour+3*time.Minute)) {
+		t.Fatal("expected ban to expire")
+	}
+}
+
+func TestServerConfigSetsAuthLimitDefaults(t *testing.T) {
+	cfg := config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+	}
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatalf("expected config to be valid: %v", err)
+	}
+	if *cfg.AuthRateLimit.Rate != 10 || *cfg.AuthRateLimit.Burst != 20 || *cfg.AuthRateLimit.IPv4Prefix != 32 || *cfg.AuthRateLimit.IPv6Prefix != 64 {
+		t.Fatalf("unexpected rate limit defaults %+v", cfg.AuthRateLimit)
+	}
+	if *cfg.AuthBan.MaxFailures != 10 || *cfg.AuthBan.MaxDecryptFailures != 100 || *cfg.AuthBan.Window != 300 || *cfg.AuthBan.BanTime != 900 {
+		t.Fatalf("unexpected ban defaults %+v", cfg.AuthBan)
+	}
+	cfg.AuthRateLimit.IPv4Prefix = newUint32(33)
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected invalid ipv4 prefix to be rejected")
+	}
+}
+
+func setupAuthLimitsForTest(t *testing.T, rate uint32, burst uint32, maxFailures uint32, maxDecryptFailures uint32) string {
+	t.Helper()
+	previousLimiter, previousBans := authLimiter, authBans
+	authLimiter, authBans = newAuthRateLimiter(100), newAuthBanList(100)
+	t.Cleanup(func() {
+		authLimiter, authBans = previousLimiter, previousBans
+	})
+	authAddr := freeUDPAddr(t)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	expiry := uint32(60)
+	conf := &config{
+		ServerID: "connauth-server",
+		AuthAddr: authAddr,
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: token}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	conf.AuthRateLimit.Rate = newUint32(rate)
+	conf.AuthRateLimit.Burst = newUint32(burst)
+	conf.AuthRateLimit.IPv4Prefix = newUint32(32)
+	conf.AuthRateLimit.IPv6Prefix = newUint32(64)
+	conf.AuthBan.MaxFailures = newUint32(maxFailures)
+	conf.AuthBan.MaxDecryptFailures = newUint32(maxDecryptFailures)
+	conf.AuthBan.Window = newUint32(60)
+	conf.AuthBan.BanTime = newUint32(600)
+	setConfig(conf)
+	initClientList()
+	stopAuth := startAuthForTest(t, authAddr)
+	t.Cleanup(stopAuth)
+	return authAddr
+}
+
+func TestAuthPortRateLimitsSourceIP(t *testing.T) {
+	authAddr := setupAuthLimitsForTest(t, 1, 2, 0, 0)
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	limited := authPacketsIgnored.Value("rate_limited")
+	sendChallengeRequestForTest(t, conn, key, "client-nonce-1", 40022)
+	sendChallengeRequestForTest(t, conn, key, "client-nonce-2", 40022)
+	if _, err := sendChallengeRequest(conn, "primary-2026-06", key, "connauth-server", "workstation", "client-nonce-3", 40022); err == nil {
+		t.Fatal("expected request above burst to be dropped")
+	}
+	if authPacketsIgnored.Value("rate_limited")-limited != 1 {
+		t.Fatal("expected dropped request to be counted as rate limited")
+	}
+}
+
+func TestDecryptFailuresBanSourceIPAtTheirOwnThreshold(t *testing.T) {
+	authAddr := setupAuthLimitsForTest(t, 0, 0, 1, 3)
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+	bad, err := authproto.Seal([]byte("wrong-abcdefghijklmnopqrstuvwxyz"), authproto.Context{KeyID: "primary-2026-06", ServerID: "connauth-server"}, []byte("{}"))
+	if err != nil {
+		t.Fatalf("seal packet: %v", err)
+	}
+	env, _ := json.Marshal(authproto.Envelope{KeyID: "primary-2026-06", ServerID: "connauth-server", Payload: bad})
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(env); err != nil {
+			t.Fatalf("write packet: %v", err)
+		}
+	}
+	// maxfailures of 1 does not apply to undecryptable packets
+	sendChallengeRequestForTest(t, conn, "abcdefghijklmnopqrstuvwxyz123456", "client-nonce", 40022)
+	if authBans.isBanned("127.0.0.1", time.Now()) {
+		t.Fatal("expected ip below maxdecryptfailures not to be banned")
+	}
+	if _, err := conn.Write(env); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !authBans.isBanned("127.0.0.1", time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected source ip to be banned after maxdecryptfailures")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRepeatedAuthFailuresBanSourceIP(t *testing.T) {
+	authAddr := setupAuthLimitsForTest(t, 0, 0, 3, 0)
+	key := "abcdefghijklmnopqrstuvwxyz123456"
+	if !authorizeClient("127.0.0.1", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	for i := 0; i < 3; i++ {
+		if err := sendChallengeAuthForTest(authAddr, "primary-2026-06", key, "connauth-server", "attacker", "token-wrong-abcdefghijklmnopqrstu", 40022); err != nil {
+			t.Fatalf("challenge auth: %v", err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for !authBans.isBanned("127.0.0.1", time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected source ip to be banned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn := dialUDPForTest(t, authAddr)
+	defer conn.Close()
+	if _, err := sendChallengeRequest(conn, "primary-2026-06", key, "connauth-server", "workstation", "client-nonce", 40022); err == nil {
+		t.Fatal("expected banned ip to be ignored by the auth port")
+	}
+	if !isIPDenied(net.ParseIP("127.0.0.1")) {
+		t.Fatal("expected banned ip to be denied")
+	}
+	if _, ok := grantConnection(&currentConfig().ForwardConfigs[0], net.ParseIP("127.0.0.1")); ok {
+		t.Fatal("expected banned ip to be refused by the forwards")
+	}
+	authBans.unban("127.0.0.1")
+	if _, ok := grantConnection(&currentConfig().ForwardConfigs[0], net.ParseIP("127.0.0.1")); !ok {
+		t.Fatal("expected unbanned ip to keep its authorization")
+	}
+}
+
+func TestAdminListsAndLiftsBans(t *testing.T) {
+	handler := setupAdminForTest(t)
+	previous := authBans
+	authBans = newAuthBanList(10)
+	defer func() {
+		authBans = previous
+	}()
+	authBans.recordFailure("192.0.2.10", authFailure, 1, time.Minute, time.Hour, time.Now())
+	code, out := adminRequestForTest(t, handler, http.MethodGet, "/bans", adminTokenForTest, "")
+	if code != http.StatusOK || len(out["bans"].([]interface{})) != 1 {
+		t.Fatalf("expected one ban: %d %v", code, out)
+	}
+	code, out = adminRequestForTest(t, handler, http.MethodPost, "/unban", adminTokenForTest, `{"ip":"192.0.2.10"}`)
+	if code != http.StatusOK || out["unbanned"] != true {
+		t.Fatalf("expected ban to be lifted: %d %v", code, out)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected unbanned client to keep its authorization")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often the config file is checked for changes
+var configPollInterval = 5 * time.Second
+
+// serverRuntime owns the running forwards, so a reload can start and stop
+// only the listeners whose bindaddr, bindport and protocol were added or removed
+type serverRuntime struct {
+	mux      sync.Mutex
+	file     string
+	forwards map[string]*forwardRuntime
+	stopping bool // set by shutdown, forwards are no longer started or changed
+}
+
+func newServerRuntime(file string) *serverRuntime {
+	return &serverRuntime{
+		file:     file,
+		forwards: make(map[string]*forwardRuntime),
+	}
+}
+
+func (s *serverRuntime) start(conf *config) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopping {
+		return
+	}
+	for i := range conf.ForwardConfigs {
+		s.startForward(&conf.ForwardConfigs[i], i)
+	}
+}
+
+func (s *serverRuntime) startForward(cfg *forwardConfig, index int) {
+	runtime, err := startForwardWithStop(cfg, make(chan struct{}))
+	if err != nil {
+		log.Errorf("start forward %d failed: %v", index+1, err)
+		return
+	}
+	s.forwards[cfg.id()] = runtime
+}
+
+func (s *serverRuntime) stop() {
+	s.shutdown(0)
+}
+
+// shutdown stops accepting on every forward, then waits up to grace for the
+// forwarded connections to finish. It returns how many connections were
+// still open and how many of them had to be closed.
+func (s *serverRuntime) shutdown(grace time.Duration) (int, int) {
+	s.mux.Lock()
+	if s.stopping {
+		s.mux.Unlock()
+		return 0, 0
+	}
+	s.stopping = true
+	forwards := make([]*forwardRuntime, 0, len(s.forwards))
+	for _, runtime := range s.forwards {
+		close(runtime.Stop)
+		forwards = append(forwards, runtime)
+	}
+	// the admin API and terminateRevoked keep working while draining, a
+	// reload does nothing once stopping
+	s.mux.Unlock()
+	active := 0
+	for _, runtime := range forwards {
+		<-runtime.Done
+		active += len(runtime.conns.list())
+	}
+	deadline := time.Now().Add(grace)
+	closed := 0
+	for _, runtime := range forwards {
+		closed += runtime.drain(deadline)
+	}
+	s.mux.Lock()
+	s.forwards = make(map[string]*forwardRuntime)
+	s.mux.Unlock()
+	return active, closed
+}
+
+type forwardConnections struct {
+	Port     uint16
+	BindAddr string
+	Protocol string
+	Active   int
+	ByIP     map[string]int
+	Conns    []connectionEntry
+}
+
+type connectionEntry struct {
+	SourceAddr string
+	Grant      connectionGrant
+	Since      time.Time
+}
+
+func (s *serverRuntime) connections() []forwardConnections {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	stats := make([]forwardConnections, 0, len(s.forwards))
+	for id, runtime := range s.forwards {
+		active, byIP := runtime.limiter.snapshot()
+		bindAddr, port, protocol := splitForwardID(id)
+		stat := forwardConnections{Port: port, BindAddr: bindAddr, Protocol: protocol, Active: active, ByIP: byIP}
+		for _, c := range runtime.conns.list() {
+			stat.Conns = append(stat.Conns, connectionEntry{SourceAddr: c.conn.RemoteAddr().String(), Grant: c.grant, Since: c.since})
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// terminateRevoked closes the connections of every forward that lost their
+// authorization, see forwardRuntime.terminateRevoked
+func (s *serverRuntime) terminateRevoked() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.terminateRevokedLocked(time.Now())
+}
+
+func (s *serverRuntime) terminateRevokedLocked(now time.Time) int {
+	terminated := 0
+	for _, runtime := range s.forwards {
+		terminated += runtime.terminateRevoked(now)
+	}
+	return terminated
+}
+
+// reload reads and validates the config file again. An invalid config is
+// reported and the running config stays unchanged.
+func (s *serverRuntime) reload() error {
+	conf, err := readConfig(s.file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":  "config_reload_failed",
+			"result": "failed",
+			"error":  err.Error(),
+		}).Errorf("reload config %s failed, keep running config: %v", s.file, err)
+		return err
+	}
+	return s.apply(conf)
+}
+
+// apply switches to conf. The new forwards are started before conf goes
+// live; if one of them cannot listen, the forwards stopped for conf are
+// started again and the running config stays unchanged.
+func (s *serverRuntime) apply(conf *config) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopping {
+		log.Warnf("config %s not reloaded, shutting down", s.file)
+		return nil
+	}
+	old := currentConfig()
+	if old != nil && old.AuthAddr != conf.AuthAddr {
+		log.Warnf("authaddr changed from %s to %s, restart to apply it", old.AuthAddr, conf.AuthAddr)
+	}
+	if old != nil && old.Logger != conf.Logger {
+		log.Warn("logger config changed, restart to apply it")
+	}
+	if old != nil && old.Admin.Addr != conf.Admin.Addr {
+		log.Warn("admin addr changed, restart to apply it")
+	}
+	if old != nil && old.MetricsAddr != conf.MetricsAddr {
+		log.Warn("metricsaddr changed, restart to apply it")
+	}
+	if old != nil && old.StateFile != conf.StateFile {
+		log.Warn("statefile changed, restart to apply it")
+	}
+
+	ids := make(map[string]bool)
+	for i := range conf.ForwardConfigs {
+		ids[conf.ForwardConfigs[i].id()] = true
+	}
+	// removed forwards are stopped first, a new forward may take over their
+	// address, e.g. when only the bindaddr changed
+	removed := make(map[string]*forwardConfig)
+	for id, runtime := range s.forwards {
+		if ids[id] {
+			continue
+		}
+		close(runtime.Stop)
+		<-runtime.Done
+		delete(s.forwards, id)
+		removed[id] = runtime.config()
+	}
+	added := make(map[string]*forwardRuntime)
+	for i := range conf.ForwardConfigs {
+		cfg := &conf.ForwardConfigs[i]
+		if _, ok := s.forwards[cfg.id()]; ok {
+			continue
+		}
+		runtime, err := startForwardWithStop(cfg, make(chan struct{}))
+		if err == nil {
+			added[cfg.id()] = runtime
+			continue
+		}
+		for _, runtime := range added {
+			close(runtime.Stop)
+			<-runtime.Done
+		}
+		for id, cfg := range removed {
+			runtime, err := startForwardWithStop(cfg, make(chan struct{}))
+			if err != nil {
+				log.Errorf("restart forward %s failed, it stays stopped: %v", id, err)
+				continue
+			}
+			s.forwards[id] = runtime
+		}
+		err = fmt.Errorf("start forward %d failed: %v", i+1, err)
+		log.WithFields(log.Fields{
+			"event":  "config_reload_failed",
+			"result": "failed",
+			"error":  err.Error(),
+		}).Errorf("reload config %s failed, keep running config: %v", s.file, err)
+		return err
+	}
+
+	setLogLevel(conf.LogLevel)
+	setConfig(conf)
+	syncClientList(conf)
+	for id := range removed {
+		bindAddr, port, protocol := splitForwardID(id)
+		log.WithFields(log.Fields{
+			"event":     "forward_stopped",
+			"port":      port,
+			"bind_addr": bindAddr,
+			"protocol":  protocol,
+			"result":    "success",
+		}).Infof("stop listening on %s", id)
+	}
+	for i := range conf.ForwardConfigs {
+		cfg := &conf.ForwardConfigs[i]
+		if runtime, ok := added[cfg.id()]; ok {
+			s.forwards[cfg.id()] = runtime
+			continue
+		}
+		s.forwards[cfg.id()].update(cfg)
+	}
+	// a reload can deny an IP or drop an allow rule of a running connection
+	terminated := s.terminateRevokedLocked(time.Now())
+	log.WithFields(log.Fields{
+		"event":      "config_reloaded",
+		"result":     "success",
+		"started":    len(added),
+		"stopped":    len(removed),
+		"terminated": terminated,
+	}).Infof("config %s reloaded, %d forwards started, %d stopped", s.file, len(added), len(removed))
+	return nil
+}
+
+// watch reloads the config on SIGHUP and whenever the config file changes
+func (s *serverRuntime) watch(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	lastStamp, _ := fileStamp(s.file)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Info("SIGHUP received, reload config")
+			lastStamp, _ = fileStamp(s.file)
+			_ = s.reload()
+		case <-ticker.C:
+			stamp, err := fileStamp(s.file)
+			if err != nil || stamp == lastStamp {
+				continue
+			}
+			lastStamp = stamp
+			log.Infof("config %s changed, reload config", s.file)
+			_ = s.reload()
+		}
+	}
+}
+
+func fileStamp(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size()), nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeReloadConfigForTest(t *testing.T, file string, ports ...uint16) {
+	t.Helper()
+	content := `
+serverid: "connauth-server"
+authaddr: "127.0.0.1:40100"
+authkeys:
+  - id: "primary-2026-06"
+    key: "abcdefghijklmnopqrstuvwxyz123456"
+forwardconfigs:
+`
+	for _, port := range ports {
+		content += fmt.Sprintf(`  - bindport: %d
+    forwardaddr: "127.0.0.1:22"
+    allowtokens:
+      - "token-abcdefghijklmnopqrstuvwxyz"
+`, port)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func startServerRuntimeForTest(t *testing.T, file string) *serverRuntime {
+	t.Helper()
+	conf, err := readConfig(file)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	setConfig(conf)
+	initClientList()
+	runtime := newServerRuntime(file)
+	runtime.start(conf)
+	return runtime
+}
+
+func TestReloadStartsAndStopsOnlyChangedForwards(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	kept, removed, added := freeTCPPort(t), freeTCPPort(t), freeTCPPort(t)
+	writeReloadConfigForTest(t, file, kept, removed)
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	keptRuntime := runtime.forwards[":"+intPort(kept)]
+	if !authorizeClient("192.0.2.10", "workstation", kept, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+		t.Fatal("expected client to be authorized before reload")
+	}
+
+	writeReloadConfigForTest(t, file, kept, added)
+	if err := runtime.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if runtime.forwards[":"+intPort(kept)] != keptRuntime {
+		t.Fatal("expected surviving forward to keep running")
+	}
+	if runtime.forwards[":"+intPort(kept)].config() != &currentConfig().ForwardConfigs[0] {
+		t.Fatal("expected surviving forward to use reloaded config")
+	}
+	if _, ok := runtime.forwards[":"+intPort(removed)]; ok {
+		t.Fatal("expected removed forward to stop")
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", intPort(removed)))
+	if err != nil {
+		t.Fatalf("expected removed port to be released: %v", err)
+	}
+	_ = listener.Close()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(added)), time.Second)
+	if err != nil {
+		t.Fatalf("expected added port to listen: %v", err)
+	}
+	_ = conn.Close()
+	if !isClientAuthed(&currentConfig().ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected authorization of surviving port to be carried over")
+	}
+}
+
+func TestReloadKeepsRunningConfigWhenInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	port := freeTCPPort(t)
+	writeReloadConfigForTest(t, file, port)
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	running := currentConfig()
+
+	if err := ioutil.WriteFile(file, []byte("serverid: \"connauth-server\"\nauthkeys: []\n"), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if err := runtime.reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if currentConfig() != running {
+		t.Fatal("expected running config to stay unchanged")
+	}
+	if _, ok := runtime.forwards[":"+intPort(port)]; !ok {
+		t.Fatal("expected forward to keep running")
+	}
+}
+
+func TestReloadKeepsRunningConfigWhenForwardCannotListen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	kept, removed, busy := freeTCPPort(t), freeTCPPort(t), freeTCPPort(t)
+	writeReloadConfigForTest(t, file, kept, removed)
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	running := currentConfig()
+	listener, err := net.Listen("tcp", net.JoinHostPort("", intPort(busy)))
+	if err != nil {
+		t.Fatalf("listen on busy port: %v", err)
+	}
+	defer listener.Close()
+
+	writeReloadConfigForTest(t, file, kept, busy)
+	if err := runtime.reload(); err == nil {
+		t.Fatal("expected reload to fail when a forward cannot listen")
+	}
+	if currentConfig() != running {
+		t.Fatal("expected running config to stay unchanged")
+	}
+	if _, ok := runtime.forwards[":"+intPort(busy)]; ok {
+		t.Fatal("expected failed forward not to be kept")
+	}
+	for _, port := range []uint16{kept, removed} {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(port)), time.Second)
+		if err != nil {
+			t.Fatalf("expected forward on port %d to keep listening: %v", port, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestWatchReloadsChangedConfigFile(t *testing.T) {
+	previousInterval := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	defer func() {
+		configPollInterval = previousInterval
+	}()
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	first, second := freeTCPPort(t), freeTCPPort(t)
+	writeReloadConfigForTest(t, file, first)
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		runtime.watch(stop)
+		close(watched)
+	}()
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	writeReloadConfigForTest(t, file, first, second)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(currentConfig().ForwardConfigs) == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected changed config file to be reloaded")
+}
+
+func TestReloadTerminatesConnectionOfNewlyDeniedIP(t *testing.T) {
+	backend := startEchoBackendForTest(t)
+	defer backend.Close()
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	port := freeTCPPort(t)
+	content := fmt.Sprintf(`
+serverid: "connauth-server"
+authaddr: "127.0.0.1:40100"
+authkeys:
+  - id: "primary-2026-06"
+    key: "abcdefghijklmnopqrstuvwxyz123456"
+forwardconfigs:
+  - bindport: %d
+    forwardaddr: "%s"
+    terminateonexpiry: true
+    allowips:
+      - "127.0.0.1"
+`, port, backend.Addr().String())
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	runtime := startServerRuntimeForTest(t, file)
+	defer runtime.stop()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(port)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	if !echoForTest(conn) {
+		t.Fatal("expected allowed connection to be forwarded")
+	}
+
+	content += "globaldenyips:\n  - \"127.0.0.1\"\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if err := runtime.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if echoForTest(conn) {
+		t.Fatal("expected connection of denied ip to be closed after reload")
+	}
+}
+
+func startDrainRuntimeForTest(t *testing.T) (*serverRuntime, net.Conn) {
+	t.Helper()
+	backend := startEchoBackendForTest(t)
+	t.Cleanup(func() { _ = backend.Close() })
+	file := filepath.Join(t.TempDir(), "server.yaml")
+	port := freeTCPPort(t)
+	content := fmt.Sprintf(`
+serverid: "connauth-server"
+authaddr: "127.0.0.1:40100"
+authkeys:
+  - id: "primary-2026-06"
+    key: "abcdefghijklmnopqrstuvwxyz123456"
+forwardconfigs:
+  - bindport: %d
+    forwardaddr: "%s"
+    allowips:
+      - "127.0.0.1"
+`, port, backend.Addr().String())
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	runtime := startServerRuntimeForTest(t, file)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(port)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if !echoForTest(conn) {
+		t.Fatal("expected allowed connection to be forwarded")
+	}
+	return runtime, conn
+}
+
+func TestShutdownWaitsForConnectionsWithinGrace(t *testing.T) {
+	runtime, conn := startDrainRuntimeForTest(t)
+	port := conn.RemoteAddr().(*net.TCPAddr).Port
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	start := time.Now()
+	active, closed := runtime.shutdown(5 * time.Second)
+	if active != 1 || closed != 0 {
+		t.Fatalf("expected the connection to finish by itself, active %d closed %d", active, closed)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("expected shutdown to return once the connection finished")
+	}
+	if _, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), time.Second); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+}
+
+func TestShutdownForceClosesConnectionsAfterGrace(t *testing.T) {
+	runtime, conn := startDrainRuntimeForTest(t)
+	active, closed := runtime.shutdown(100 * time.Millisecond)
+	if active != 1 || closed != 1 {
+		t.Fatalf("expected the connection to be force-closed, active %d closed %d", active, closed)
+	}
+	if echoForTest(conn) {
+		t.Fatal("expected force-closed connection to be closed")
+	}
+}
+
+func TestShutdownDoesNotBlockAdminOrReloadWhileDraining(t *testing.T) {
+	runtime, conn := startDrainRuntimeForTest(t)
+	result := make(chan int, 1)
+	go func() {
+		active, _ := runtime.shutdown(5 * time.Second)
+		result <- active
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		runtime.mux.Lock()
+		stopping := runtime.stopping
+		runtime.mux.Unlock()
+		if stopping {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected shutdown to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	answered := make(chan []forwardConnections, 1)
+	go func() {
+		_ = runtime.reload()
+		answered <- runtime.connections()
+	}()
+	select {
+	case stats := <-answered:
+		if len(stats) != 1 || stats[0].Active != 1 {
+			t.Fatalf("expected the draining connection to be listed, got %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected reload and connections to answer while draining")
+	}
+	_ = conn.Close()
+	select {
+	case active := <-result:
+		if active != 1 {
+			t.Fatalf("expected one draining connection, got %d", active)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected shutdown to return once the connection finished")
+	}
+	if stats := runtime.connections(); len(stats) != 0 {
+		t.Fatalf("expected no forwards after shutdown, got %+v", stats)
+	}
+}
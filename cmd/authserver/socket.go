@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+)
+
+// sockets are the listening sockets of the process. Sockets passed by
+// systemd socket activation or by the previous process of an upgrade are
+// used instead of binding again, and all of them are passed on to the next
+// process of an upgrade.
+var sockets = newSocketSet()
+
+type socketFiler interface {
+	File() (*os.File, error)
+}
+
+type socketSet struct {
+	mux       sync.Mutex
+	inherited []socketFiler
+	// by network and local address, the latest socket of an address wins
+	active map[string]socketFiler
+}
+
+func newSocketSet() *socketSet {
+	return &socketSet{active: make(map[string]socketFiler)}
+}
+
+// inheritFile takes over the listening socket of f, a TCP listener or a UDP
+// socket. f itself can be closed afterwards.
+func (s *socketSet) inheritFile(f *os.File) error {
+	var socket socketFiler
+	if l, err := net.FileListener(f); err == nil {
+		tcp, ok := l.(*net.TCPListener)
+		if !ok {
+			_ = l.Close()
+			return fmt.Errorf("%s is not a TCP listener", f.Name())
+		}
+		socket = tcp
+		log.Infof("inherited TCP listener %s", tcp.Addr())
+	} else if c, err := net.FilePacketConn(f); err == nil {
+		udp, ok := c.(*net.UDPConn)
+		if !ok {
+			_ = c.Close()
+			return fmt.Errorf("%s is not a UDP socket", f.Name())
+		}
+		socket = udp
+		log.Infof("inherited UDP socket %s", udp.LocalAddr())
+	} else {
+		return fmt.Errorf("%s is not a listening socket: %v", f.Name(), err)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.inherited = append(s.inherited, socket)
+	return nil
+}
+
+// sameListenAddr tells whether a socket bound to got is the socket of want.
+// The IP must match exactly, only the unspecified 0.0.0.0 and :: match each
+// other, so a wildcard never takes the socket of a single IP.
+func sameListenAddr(want net.IP, wantPort int, got net.IP, gotPort int) bool {
+	if wantPort != gotPort {
+		return false
+	}
+	wantAny := want == nil || want.IsUnspecified()
+	gotAny := got == nil || got.IsUnspecified()
+	if wantAny || gotAny {
+		return wantAny && gotAny
+	}
+	return want.Equal(got)
+}
+
+// listenTCP returns the inherited listener of addr, or a new one
+func (s *socketSet) listenTCP(addr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var listener *net.TCPListener
+	for i, socket := range s.inherited {
+		l, ok := socket.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		got := l.Addr().(*net.TCPAddr)
+		if sameListenAddr(tcpAddr.IP, tcpAddr.Port, got.IP, got.Port) {
+			listener = l
+			s.inherited = append(s.inherited[:i], s.inherited[i+1:]...)
+			break
+		}
+	}
+	if listener == nil {
+		if listener, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+			return nil, err
+		}
+	}
+	s.active["tcp "+listener.Addr().String()] = listener
+	return listener, nil
+}
+
+// listenUDP returns the inherited socket of addr, or a new one
+func (s *socketSet) listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var conn *net.UDPConn
+	for i, socket := range s.inherited {
+		c, ok := socket.(*net.UDPConn)
+		if !ok {
+			continue
+		}
+		got := c.LocalAddr().(*net.UDPAddr)
+		if sameListenAddr(addr.IP, addr.Port, got.IP, got.Port) {
+			conn = c
+			s.inherited = append(s.inherited[:i], s.inherited[i+1:]...)
+			break
+		}
+	}
+	if conn == nil {
+		var err error
+		if conn, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	s.active["udp "+conn.LocalAddr().String()] = conn
+	return conn, nil
+}
+
+// files returns duplicates of the sockets in use with their names, closed
+// sockets are skipped
+func (s *socketSet) files() ([]*os.File, []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var files []*os.File
+	var names []string
+	for name, socket := range s.active {
+		f, err := socket.File()
+		if err != nil {
+			delete(s.active, name)
+			continue
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+	return files, names
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketSetUsesInheritedTCPListener(t *testing.T) {
+	original, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := original.Addr().(*net.TCPAddr).Port
+	f, err := original.File()
+	if err != nil {
+		t.Fatalf("file of listener: %v", err)
+	}
+	set := newSocketSet()
+	if err := set.inheritFile(f); err != nil {
+		t.Fatalf("inherit: %v", err)
+	}
+	_ = f.Close()
+	_ = original.Close()
+
+	if other, err := set.listenTCP(":" + intPort(uint16(port))); err == nil {
+		_ = other.Close()
+	}
+	if len(set.inherited) != 1 {
+		t.Fatal("expected a wildcard address not to take the listener of a single IP")
+	}
+	listener, err := set.listenTCP("127.0.0.1:" + intPort(uint16(port)))
+	if err != nil {
+		t.Fatalf("expected inherited listener to be used, got %v", err)
+	}
+	defer listener.Close()
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial inherited listener: %v", err)
+	}
+	_ = conn.Close()
+	files, names := set.files()
+	if len(files) != 1 || !strings.HasPrefix(names[0], "tcp ") {
+		t.Fatalf("expected the listener to be passed on, got %v", names)
+	}
+	_ = files[0].Close()
+	_ = listener.Close()
+	if files, _ := set.files(); len(files) != 0 {
+		t.Fatal("expected a closed listener not to be passed on")
+	}
+}
+
+func TestSocketSetUsesInheritedUDPSocket(t *testing.T) {
+	original, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := original.LocalAddr().(*net.UDPAddr)
+	f, err := original.File()
+	if err != nil {
+		t.Fatalf("file of socket: %v", err)
+	}
+	set := newSocketSet()
+	if err := set.inheritFile(f); err != nil {
+		t.Fatalf("inherit: %v", err)
+	}
+	_ = f.Close()
+	_ = original.Close()
+
+	if other, err := set.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: addr.Port}); err == nil {
+		_ = other.Close()
+	}
+	if len(set.inherited) != 1 {
+		t.Fatal("expected socket of another IP not to be used")
+	}
+	conn, err := set.listenUDP(addr)
+	if err != nil {
+		t.Fatalf("expected inherited socket to be used, got %v", err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != addr.String() {
+		t.Fatalf("unexpected socket %s", conn.LocalAddr())
+	}
+}
+
+func TestSameListenAddrMatchesIPExactly(t *testing.T) {
+	cases := []struct {
+		want, got string
+		same      bool
+	}{
+		{"", "0.0.0.0", true},
+		{"0.0.0.0", "::", true},
+		{"::", "0.0.0.0", true},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"", "127.0.0.1", false},
+		{"0.0.0.0", "127.0.0.1", false},
+		{"127.0.0.1", "0.0.0.0", false},
+		{"127.0.0.1", "127.0.0.2", false},
+	}
+	for _, c := range cases {
+		if got := sameListenAddr(net.ParseIP(c.want), 40022, net.ParseIP(c.got), 40022); got != c.same {
+			t.Fatalf("want %q got %q: expected %v", c.want, c.got, c.same)
+		}
+	}
+	if sameListenAddr(nil, 40022, net.ParseIP("0.0.0.0"), 40023) {
+		t.Fatal("expected other port not to match")
+	}
+}
+
+func TestSocketSetRejectsFileThatIsNotASocket(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "plain")
+	if err := ioutil.WriteFile(file, []byte("x"), 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	if err := newSocketSet().inheritFile(f); err == nil {
+		t.Fatal("expected a plain file to be rejected")
+	}
+}
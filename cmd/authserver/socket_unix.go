@@ -0,0 +1,187 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"connauth/utils/service"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// first file descriptor of LISTEN_FDS, see sd_listen_fds
+const listenFDsStart = 3
+
+// file descriptor of the pipe on which the new process of an upgrade reports
+// that it took over the sockets
+const upgradeReadyEnv = "CONNAUTH_UPGRADE_READY_FD"
+
+// how long the old process waits for the new one of an upgrade
+var upgradeReadyTimeout = 30 * time.Second
+
+// set in the new process of an upgrade until finishUpgrade
+var upgradeReady *os.File
+
+// inheritSockets takes over the sockets of LISTEN_FDS, passed by systemd
+// socket activation or by the previous process of an upgrade
+func inheritSockets() {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+		_ = os.Unsetenv(upgradeReadyEnv)
+	}()
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil && fd >= listenFDsStart {
+		syscall.CloseOnExec(fd)
+		upgradeReady = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FDS "+strconv.Itoa(fd))
+		if err := sockets.inheritFile(f); err != nil {
+			log.Warnf("ignore inherited socket: %v", err)
+		}
+		_ = f.Close()
+	}
+}
+
+// finishUpgrade tells the old process of an upgrade whether this process is
+// serving, a failed one is killed by the old process
+func finishUpgrade(ok bool) {
+	if upgradeReady == nil {
+		return
+	}
+	if ok {
+		_, _ = upgradeReady.Write([]byte{1})
+	}
+	_ = upgradeReady.Close()
+	upgradeReady = nil
+}
+
+// watchUpgrade starts a new process of the current executable on SIGUSR2 and
+// passes the sockets to it. The returned channel is closed once the new
+// process serves, this process should then stop accepting and drain.
+func watchUpgrade(stop <-chan struct{}) <-chan struct{} {
+	upgraded := make(chan struct{})
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(usr2)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-usr2:
+				log.Info("SIGUSR2 received, start new process")
+				pid, err := upgrade()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"event":  "upgrade_failed",
+						"result": "failed",
+						"error":  err.Error(),
+					}).Errorf("upgrade failed, keep running: %v", err)
+					continue
+				}
+				log.WithFields(log.Fields{
+					"event":  "upgraded",
+					"result": "success",
+					"pid":    pid,
+				}).Infof("process %d took over the sockets, stop accepting and drain", pid)
+				// the new process is the main process of the service now
+				_ = service.Notify(fmt.Sprintf("MAINPID=%d", pid))
+				close(upgraded)
+				return
+			}
+		}
+	}()
+	return upgraded
+}
+
+// upgrade starts the current executable with the same arguments and the
+// sockets in use, and returns its pid once it serves
+func upgrade() (int, error) {
+	// the new process restores the authorized clients from the state file
+	if file := currentConfig().StateFile; file != "" {
+		saveClientStateAndLog(file)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	files, names := sockets.files()
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(upgradeEnviron(os.Environ()),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)))
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("start %s failed: %v", exe, err)
+	}
+	log.Infof("started process %d with sockets %s", cmd.Process.Pid, strings.Join(names, ", "))
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := ready.Read(buf)
+		result <- err
+	}()
+	select {
+	case err = <-result:
+		if err != nil {
+			err = fmt.Errorf("process %d did not start serving", cmd.Process.Pid)
+		}
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("process %d not ready after %s", cmd.Process.Pid, upgradeReadyTimeout)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	return pid, nil
+}
+
+// upgradeEnviron drops the variables that describe the sockets and watchdog
+// of this process from env
+func upgradeEnviron(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		switch name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", upgradeReadyEnv:
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInheritSocketsIgnoresFDsOfOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	previous := sockets
+	sockets = newSocketSet()
+	defer func() { sockets = previous }()
+	inheritSockets()
+	if len(sockets.inherited) != 0 {
+		t.Fatal("expected sockets of another pid to be ignored")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("expected LISTEN_FDS to be removed from the environment")
+	}
+}
+
+func TestUpgradeEnvironDropsSocketsAndWatchdogOfThisProcess(t *testing.T) {
+	env := upgradeEnviron([]string{"PATH=/bin", "LISTEN_FDS=2", "LISTEN_PID=10", "WATCHDOG_PID=10", "WATCHDOG_USEC=30000000", upgradeReadyEnv + "=5"})
+	if got := strings.Join(env, " "); got != "PATH=/bin WATCHDOG_USEC=30000000" {
+		t.Fatalf("unexpected environment %s", got)
+	}
+}
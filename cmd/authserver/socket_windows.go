@@ -0,0 +1,11 @@
+package main
+
+// sockets cannot be inherited on windows
+
+func inheritSockets() {}
+
+func finishUpgrade(ok bool) {}
+
+func watchUpgrade(stop <-chan struct{}) <-chan struct{} {
+	return make(chan struct{})
+}
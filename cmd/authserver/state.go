@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const clientStateVersion = 1
+
+type persistedClient struct {
+	IP        string `json:"ip"`
+	ClientID  string `json:"client_id"`
+	Port      uint16 `json:"port"`
+	BindAddr  string `json:"bind_addr,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	RuleID    string `json:"rule_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type clientState struct {
+	Version int               `json:"version"`
+	SavedAt int64             `json:"saved_at"`
+	Clients []persistedClient `json:"clients"`
+}
+
+// saveClientState writes the unexpired authorized clients to file. The file
+// is replaced atomically so a crash never leaves a truncated state behind.
+func saveClientState(file string, now time.Time) (int, error) {
+	state := clientState{Version: clientStateVersion, SavedAt: now.Unix()}
+	muxClient.Lock()
+	for id, list := range allClientList {
+		bindAddr, port, protocol := splitForwardID(id)
+		for key, value := range list {
+			if !value.ExpiresAt.After(now) {
+				continue
+			}
+			state.Clients = append(state.Clients, persistedClient{
+				IP:        key.IP,
+				ClientID:  key.ClientID,
+				Port:      port,
+				BindAddr:  bindAddr,
+				Protocol:  protocol,
+				RuleID:    value.RuleID,
+				ExpiresAt: value.ExpiresAt.Unix(),
+			})
+		}
+	}
+	muxClient.Unlock()
+	content, err := json.Marshal(state)
+	if err != nil {
+		return 0, fmt.Errorf("marshal client state failed: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("create client state file failed: %v", err)
+	}
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return 0, fmt.Errorf("write client state file failed: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, fmt.Errorf("write client state file failed: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, fmt.Errorf("replace client state file failed: %v", err)
+	}
+	return len(state.Clients), nil
+}
+
+// loadClientState restores the unexpired clients of file. Entries are bound
+// to the forward with the same bindaddr, bindport and protocol, entries
+// without a bindaddr to the forward listening on all addresses and entries
+// without a protocol to the tcp forward. Entries of forwards that
+// no longer exist are dropped, and so are entries whose token rule was
+// removed from the forward, admin grants are kept.
+func loadClientState(file string, now time.Time) (int, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read client state file failed: %v", err)
+	}
+	var state clientState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return 0, fmt.Errorf("parse client state file %s failed: %v", file, err)
+	}
+	if state.Version != clientStateVersion {
+		return 0, fmt.Errorf("client state file %s has unsupported version %d", file, state.Version)
+	}
+	conf := currentConfig()
+	forwards := make(map[string]*forwardConfig)
+	for i := range conf.ForwardConfigs {
+		forwards[conf.ForwardConfigs[i].id()] = &conf.ForwardConfigs[i]
+	}
+	muxClient.Lock()
+	defer muxClient.Unlock()
+	restored := 0
+	for _, c := range state.Clients {
+		expiresAt := time.Unix(c.ExpiresAt, 0)
+		if !expiresAt.After(now) {
+			continue
+		}
+		id := forwardID(c.BindAddr, c.Port, c.Protocol)
+		list, ok := allClientList[id]
+		if !ok || forwards[id] == nil {
+			continue
+		}
+		if c.RuleID != adminGrantRuleID && !hasTokenRule(conf, forwards[id], c.RuleID) {
+			continue
+		}
+		key := authorizedClientKey{IP: c.IP, ClientID: c.ClientID}
+		if current, exists := list[key]; exists && !current.ExpiresAt.Before(expiresAt) {
+			continue
+		} else if !exists && maxAuthorizedClients > 0 && len(list) >= maxAuthorizedClients {
+			continue
+		}
+		list[key] = authorizedClientState{ExpiresAt: expiresAt, RuleID: c.RuleID}
+		restored++
+	}
+	return restored, nil
+}
+
+// keepClientState saves the client state every interval and once more when
+// stop is closed. Once handedOff is closed, the new process of an upgrade
+// owns file and nothing is saved anymore.
+func keepClientState(file string, interval time.Duration, stop <-chan struct{}, handedOff <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-handedOff:
+				log.Debugf("client state %s handed off to the new process", file)
+				return
+			case <-stop:
+				select {
+				case <-handedOff:
+					log.Debugf("client state %s handed off to the new process", file)
+				default:
+					saveClientStateAndLog(file)
+				}
+				return
+			case <-ticker.C:
+				saveClientStateAndLog(file)
+			}
+		}
+	}()
+	return done
+}
+
+func saveClientStateAndLog(file string) {
+	count, err := saveClientState(file, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event":  "state_save_failed",
+			"result": "failed",
+			"error":  err.Error(),
+		}).Warnf("save client state to %s failed: %v", file, err)
+		return
+	}
+	log.Debugf("saved %d authorized clients to %s", count, file)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClientStateRestoresUnexpiredClientsByPort(t *testing.T) {
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		ForwardConfigs: []forwardConfig{
+			{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+			{BindPort: 40023, ForwardAddr: "127.0.0.1:23", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+		},
+	}
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized ||
+		!authorizeClient("192.0.2.11", "laptop", 40023, token).Authorized ||
+		!authorizeClient("192.0.2.12", "stale", 40022, token).Authorized {
+		t.Fatal("expected clients to be authorized")
+	}
+	muxClient.Lock()
+	allClientList[":40022"][authorizedClientKey{IP: "192.0.2.12", ClientID: "stale"}] = authorizedClientState{ExpiresAt: time.Now().Add(-time.Second)}
+	muxClient.Unlock()
+
+	file := filepath.Join(t.TempDir(), "state.json")
+	saved, err := saveClientState(file, time.Now())
+	if err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+	if saved != 2 {
+		t.Fatalf("expected expired client to be skipped, saved %d", saved)
+	}
+	if info, err := os.Stat(file); err != nil {
+		t.Fatalf("stat state file: %v", err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// restart with a config that reorders forwards and drops port 40023
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		ForwardConfigs: []forwardConfig{
+			{BindPort: 40024, ForwardAddr: "127.0.0.1:24", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+			{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+		},
+	}
+	initClientList()
+	restored, err := loadClientState(file, time.Now())
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if restored != 1 {
+		t.Fatalf("expected only client of surviving port to be restored, got %d", restored)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected client to be rebound by bindport")
+	}
+	if isIPAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10")) {
+		t.Fatal("restored client must not be authorized on other ports")
+	}
+}
+
+func TestClientStateRestoresClientsByBindAddr(t *testing.T) {
+	expiry := uint32(60)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{
+			{BindPort: 40022, BindAddr: "192.0.2.1", ForwardAddr: "127.0.0.1:22", AuthExpiredTime: &expiry},
+			{BindPort: 40022, BindAddr: "2001:db8::1", ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+		},
+	}
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	file := filepath.Join(t.TempDir(), "state.json")
+	if _, err := saveClientState(file, time.Now()); err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+
+	initClientList()
+	if restored, err := loadClientState(file, time.Now()); err != nil || restored != 1 {
+		t.Fatalf("expected one client to be restored, got %d: %v", restored, err)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected client to be rebound by bindaddr")
+	}
+	if isClientAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("restored client must not be authorized on other bindaddrs")
+	}
+}
+
+func TestClientStateRestoresClientsByProtocol(t *testing.T) {
+	expiry := uint32(60)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{
+			{BindPort: 51820, Protocol: "tcp", ForwardAddr: "127.0.0.1:51820", AuthExpiredTime: &expiry},
+			{BindPort: 51820, Protocol: "udp", ForwardAddr: "127.0.0.1:51820", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry},
+		},
+	}
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 51820, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	file := filepath.Join(t.TempDir(), "state.json")
+	if _, err := saveClientState(file, time.Now()); err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+
+	initClientList()
+	if restored, err := loadClientState(file, time.Now()); err != nil || restored != 1 {
+		t.Fatalf("expected one client to be restored, got %d: %v", restored, err)
+	}
+	if !isClientAuthed(&globalConfig.ForwardConfigs[1], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected client to be rebound to the udp forward")
+	}
+	if isClientAuthed(&globalConfig.ForwardConfigs[0], net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("restored client must not be authorized on the tcp forward")
+	}
+}
+
+func TestClientStateSkipsEntriesExpiredWhileStopped(t *testing.T) {
+	expiry := uint32(60)
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AuthExpiredTime: &expiry}},
+	}
+	initClientList()
+	file := filepath.Join(t.TempDir(), "state.json")
+	content := []byte(`{"version":1,"saved_at":1,"clients":[{"ip":"192.0.2.10","client_id":"workstation","port":40022,"expires_at":2}]}`)
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	restored, err := loadClientState(file, time.Now())
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if restored != 0 {
+		t.Fatalf("expected expired entry to be skipped, restored %d", restored)
+	}
+}
+
+func TestClientStateMissingFileIsEmpty(t *testing.T) {
+	globalConfig = &config{}
+	initClientList()
+	restored, err := loadClientState(filepath.Join(t.TempDir(), "missing.json"), time.Now())
+	if err != nil || restored != 0 {
+		t.Fatalf("expected missing state file to restore nothing, got %d: %v", restored, err)
+	}
+}
+
+func TestKeepClientStateSavesOnStop(t *testing.T) {
+	expiry := uint32(60)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry}},
+	}
+	initClientList()
+	file := filepath.Join(t.TempDir(), "state.json")
+	stop := make(chan struct{})
+	done := keepClientState(file, time.Hour, stop, make(chan struct{}))
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	close(stop)
+	<-done
+
+	initClientList()
+	if restored, err := loadClientState(file, time.Now()); err != nil || restored != 1 {
+		t.Fatalf("expected client saved on stop to be restored, got %d: %v", restored, err)
+	}
+}
+
+func TestKeepClientStateSkipsSaveAfterHandOff(t *testing.T) {
+	expiry := uint32(60)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{{BindPort: 40022, ForwardAddr: "127.0.0.1:22", AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry}},
+	}
+	initClientList()
+	file := filepath.Join(t.TempDir(), "state.json")
+	stop, handedOff := make(chan struct{}), make(chan struct{})
+	done := keepClientState(file, time.Hour, stop, handedOff)
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized {
+		t.Fatal("expected client to be authorized")
+	}
+	// the new process of an upgrade writes the file from now on
+	close(handedOff)
+	close(stop)
+	<-done
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expected state not to be saved after hand off: %v", err)
+	}
+}
+
+func TestClientStateDropsClientsOfRemovedRules(t *testing.T) {
+	expiry := uint32(60)
+	token := "token-abcdefghijklmnopqrstuvwxyz"
+	other := "other-abcdefghijklmnopqrstuvwxyz"
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{{BindPort: 40022, ForwardAddr: "127.0.0.1:22",
+			AllowTokens: []accessRule{{Token: token}, {Token: other}}, AuthExpiredTime: &expiry}},
+	}
+	initClientList()
+	if !authorizeClient("192.0.2.10", "workstation", 40022, token).Authorized ||
+		!authorizeClient("192.0.2.11", "laptop", 40022, other).Authorized {
+		t.Fatal("expected clients to be authorized")
+	}
+	if err := grantAuthorizedClient("192.0.2.12", "granted", 40022, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("grant client: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "state.json")
+	if _, err := saveClientState(file, time.Now()); err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+
+	// restart with a config that no longer has the rule of the laptop
+	globalConfig = &config{
+		ForwardConfigs: []forwardConfig{{BindPort: 40022, ForwardAddr: "127.0.0.1:22",
+			AllowTokens: []accessRule{{Token: token}}, AuthExpiredTime: &expiry}},
+	}
+	initClientList()
+	if restored, err := loadClientState(file, time.Now()); err != nil || restored != 2 {
+		t.Fatalf("expected two clients to be restored, got %d: %v", restored, err)
+	}
+	cfg := &globalConfig.ForwardConfigs[0]
+	if !isClientAuthed(cfg, net.ParseIP("192.0.2.10"), "workstation") {
+		t.Fatal("expected client of a kept rule to be restored")
+	}
+	if isClientAuthed(cfg, net.ParseIP("192.0.2.11"), "laptop") {
+		t.Fatal("client of a removed rule must not be restored")
+	}
+	if !isClientAuthed(cfg, net.ParseIP("192.0.2.12"), "granted") {
+		t.Fatal("expected admin grant to be restored")
+	}
+}
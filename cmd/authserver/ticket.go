@@ -0,0 +1,103 @@
+package main
+
+import (
+	"connauth/utils/authproto"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var connectionTickets = newTicketStore(10000)
+
+// connectionTicket is the client a ticket was issued to
+type connectionTicket struct {
+	BindPort  uint16
+	IP        string
+	ClientID  string
+	RuleID    string
+	ExpiresAt time.Time
+}
+
+// ticketStore keeps the tickets of forwards with requireticket until they
+// are used or the authorization they belong to expires
+type ticketStore struct {
+	mux        sync.Mutex
+	items      map[string]connectionTicket
+	maxEntries int
+}
+
+func newTicketStore(maxEntries int) *ticketStore {
+	return &ticketStore{
+		items:      make(map[string]connectionTicket),
+		maxEntries: maxEntries,
+	}
+}
+
+// issue returns a new ticket for t
+func (s *ticketStore) issue(t connectionTicket) (string, error) {
+	ticket, err := authproto.NewTicket()
+	if err != nil {
+		return "", err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.maxEntries > 0 && len(s.items) >= s.maxEntries {
+		return "", fmt.Errorf("too many tickets")
+	}
+	s.items[ticket] = t
+	return ticket, nil
+}
+
+// take removes ticket from the store, a ticket can be used only once
+func (s *ticketStore) take(ticket string, now time.Time) (connectionTicket, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t, exists := s.items[ticket]
+	if !exists {
+		return connectionTicket{}, false
+	}
+	delete(s.items, ticket)
+	return t, t.ExpiresAt.After(now)
+}
+
+func (s *ticketStore) cleanup(now time.Time) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	deleted := 0
+	for ticket, t := range s.items {
+		if !t.ExpiresAt.After(now) {
+			delete(s.items, ticket)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// grantTicketConnection returns the authorization of a connection to a
+// forward with requireticket. Statically allowed IPs connect without a
+// ticket, every other connection must start with the ticket line of a client
+// that is still authorized from the same IP. It returns the reason of a
+// rejected connection.
+func grantTicketConnection(cfg *forwardConfig, conn net.Conn, ip net.IP) (connectionGrant, string) {
+	if isIPDenied(ip) {
+		return connectionGrant{}, "ip_denied"
+	}
+	if ruleID, ok := staticIPRule(cfg, ip); ok {
+		return connectionGrant{IP: ip.String(), RuleID: ruleID, Static: true}, ""
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(authproto.TicketReadTimeout))
+	ticket, err := authproto.ReadTicket(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return connectionGrant{}, "missing_ticket"
+	}
+	t, ok := connectionTickets.take(ticket, time.Now())
+	if !ok || t.BindPort != cfg.BindPort || t.IP != ip.String() {
+		return connectionGrant{}, "invalid_ticket"
+	}
+	if !isClientAuthed(cfg, ip, t.ClientID) {
+		return connectionGrant{}, "not_authed"
+	}
+	return connectionGrant{IP: t.IP, ClientID: t.ClientID, RuleID: t.RuleID}, ""
+}
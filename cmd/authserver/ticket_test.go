@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"connauth/utils/authproto"
+)
+
+func startTicketForwardForTest(t *testing.T) *forwardConfig {
+	t.Helper()
+	return startTicketForwardWithConfigForTest(t, forwardConfig{})
+}
+
+func startTicketForwardWithConfigForTest(t *testing.T, cfg forwardConfig) *forwardConfig {
+	t.Helper()
+	backend := startEchoBackendForTest(t)
+	t.Cleanup(func() { _ = backend.Close() })
+	cfg.BindPort = freeTCPPort(t)
+	cfg.ForwardAddr = backend.Addr().String()
+	cfg.AllowTokens = []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}}
+	cfg.RequireTicket = true
+	cfg.SetDefaultValue()
+	// forwards of earlier tests may still read the config
+	conf := &config{ServerID: "connauth-server", ForwardConfigs: []forwardConfig{cfg}}
+	setConfig(conf)
+	initClientList()
+	runtime, err := startForwardWithStop(&conf.ForwardConfigs[0], make(chan struct{}))
+	if err != nil {
+		t.Fatalf("start forward: %v", err)
+	}
+	t.Cleanup(func() {
+		close(runtime.Stop)
+		<-runtime.Done
+	})
+	return &conf.ForwardConfigs[0]
+}
+
+func dialWithTicketForTest(t *testing.T, port uint16, ticket string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", intPort(port)), time.Second)
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if ticket != "" {
+		if err := authproto.WriteTicket(conn, ticket); err != nil {
+			t.Fatalf("write ticket: %v", err)
+		}
+	}
+	return conn
+}
+
+func authorizeWithTicketForTest(ip string, clientID string, port uint16) authResult {
+	return authorizeCredentials(ip, clientID, port, "", clientCredentials{Token: "token-abcdefghijklmnopqrstuvwxyz"}, true)
+}
+
+func TestForwardWithRequireTicketBindsConnectionToClient(t *testing.T) {
+	cfg := startTicketForwardForTest(t)
+	result := authorizeWithTicketForTest("127.0.0.1", "workstation", cfg.BindPort)
+	if !result.Authorized || result.Ticket == "" {
+		t.Fatalf("expected authorization with a ticket, got %+v", result)
+	}
+	if !echoForTest(dialWithTicketForTest(t, cfg.BindPort, result.Ticket)) {
+		t.Fatal("expected connection with ticket to be forwarded without the ticket line")
+	}
+	if echoForTest(dialWithTicketForTest(t, cfg.BindPort, result.Ticket)) {
+		t.Fatal("expected a used ticket to be rejected")
+	}
+	if echoForTest(dialWithTicketForTest(t, cfg.BindPort, "")) {
+		t.Fatal("expected connection without ticket to be rejected although the IP is authorized")
+	}
+}
+
+func TestTicketOfRevokedClientIsRejected(t *testing.T) {
+	cfg := startTicketForwardForTest(t)
+	result := authorizeWithTicketForTest("127.0.0.1", "workstation", cfg.BindPort)
+	other := authorizeWithTicketForTest("127.0.0.1", "laptop", cfg.BindPort)
+	if result.Ticket == "" || other.Ticket == "" {
+		t.Fatalf("expected both clients to get a ticket, got %+v %+v", result, other)
+	}
+	if revoked := revokeAuthorizedClients("127.0.0.1", "workstation", cfg.BindPort); revoked != 1 {
+		t.Fatalf("expected workstation to be revoked, revoked %d", revoked)
+	}
+	if echoForTest(dialWithTicketForTest(t, cfg.BindPort, result.Ticket)) {
+		t.Fatal("expected ticket of a client that is no longer authorized to be rejected")
+	}
+	if !echoForTest(dialWithTicketForTest(t, cfg.BindPort, other.Ticket)) {
+		t.Fatal("expected ticket of the authorized client behind the same IP to be forwarded")
+	}
+}
+
+func TestTicketStoreUsesTicketOnce(t *testing.T) {
+	store := newTicketStore(1)
+	now := time.Now()
+	ticket, err := store.issue(connectionTicket{BindPort: 40022, IP: "192.0.2.10", ClientID: "workstation", ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("issue ticket: %v", err)
+	}
+	if _, err := store.issue(connectionTicket{ExpiresAt: now.Add(time.Minute)}); err == nil {
+		t.Fatal("expected full store to refuse a ticket")
+	}
+	if got, ok := store.take(ticket, now); !ok || got.ClientID != "workstation" {
+		t.Fatalf("expected ticket to be taken, got %+v %v", got, ok)
+	}
+	if _, ok := store.take(ticket, now); ok {
+		t.Fatal("expected ticket to be used only once")
+	}
+	expired, _ := store.issue(connectionTicket{ExpiresAt: now.Add(-time.Second)})
+	if store.cleanup(now) != 1 {
+		t.Fatal("expected expired ticket to be cleaned up")
+	}
+	if _, ok := store.take(expired, now); ok {
+		t.Fatal("expected expired ticket to be rejected")
+	}
+}
+
+func TestRenewalsWithoutTicketDoNotFillTicketStore(t *testing.T) {
+	previous := connectionTickets
+	connectionTickets = newTicketStore(2)
+	defer func() { connectionTickets = previous }()
+	cfg := startTicketForwardForTest(t)
+	for i := 0; i < 5; i++ {
+		result := authorizeClient("127.0.0.1", "workstation", cfg.BindPort, "token-abcdefghijklmnopqrstuvwxyz")
+		if !result.Authorized || result.Ticket != "" {
+			t.Fatalf("expected renewal %d without a ticket, got %+v", i+1, result)
+		}
+	}
+	if len(connectionTickets.items) != 0 {
+		t.Fatalf("expected no ticket to be stored, got %d", len(connectionTickets.items))
+	}
+	result := authorizeWithTicketForTest("127.0.0.1", "workstation", cfg.BindPort)
+	if result.Ticket == "" {
+		t.Fatal("expected a ticket when the client asks for one")
+	}
+	if !echoForTest(dialWithTicketForTest(t, cfg.BindPort, result.Ticket)) {
+		t.Fatal("expected connection with ticket to be forwarded")
+	}
+}
+
+func TestConnectionsWaitingForTicketCountAgainstLimits(t *testing.T) {
+	cfg := startTicketForwardWithConfigForTest(t, forwardConfig{MaxConnPerIP: newUint32(2)})
+	for i := 0; i < 2; i++ {
+		// idle sockets that never send a ticket
+		dialWithTicketForTest(t, cfg.BindPort, "")
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn := dialWithTicketForTest(t, cfg.BindPort, "")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || time.Since(start) >= time.Second {
+		t.Fatal("expected connection above maxconnperip to be closed before its ticket is read")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters of new token hashes, verification uses the parameters
+// stored in the hash
+const (
+	tokenHashMemory  = 19 * 1024 // KiB
+	tokenHashTime    = 2
+	tokenHashThreads = 1
+	tokenHashSaltLen = 16
+	tokenHashKeyLen  = 32
+)
+
+// computes argon2id, replaced in tests
+var tokenHashKey = argon2.IDKey
+
+// tokenHash is a parsed tokenhash in the PHC string format
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//
+// with salt and hash encoded as base64 without padding
+type tokenHash struct {
+	encoded string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseTokenHash(s string) (*tokenHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("tokenhash must be an argon2id hash from authserver hash-token")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("tokenhash has unsupported argon2 version %s", parts[2])
+	}
+	h := &tokenHash{encoded: s}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("tokenhash has invalid parameters %s", parts[3])
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("tokenhash has invalid parameters %s", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) < 8 {
+		return nil, fmt.Errorf("tokenhash has invalid salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) < 16 {
+		return nil, fmt.Errorf("tokenhash has invalid hash")
+	}
+	return h, nil
+}
+
+// hashToken returns the tokenhash of token with a random salt
+func hashToken(token string) (string, error) {
+	salt := make([]byte, tokenHashSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("generate salt failed: %v", err)
+	}
+	key := argon2.IDKey([]byte(token), salt, tokenHashTime, tokenHashMemory, tokenHashThreads, tokenHashKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, tokenHashMemory, tokenHashTime, tokenHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifiedTokens remembers tokens that matched a hash, so a client that
+// renews every interval does not pay for argon2id each time
+var verifiedTokens = newTokenHashCache(10000)
+
+type tokenHashCache struct {
+	mux        sync.Mutex
+	items      map[[sha256.Size]byte]bool
+	maxEntries int
+}
+
+func newTokenHashCache(maxEntries int) *tokenHashCache {
+	return &tokenHashCache{items: make(map[[sha256.Size]byte]bool), maxEntries: maxEntries}
+}
+
+func tokenHashCacheKey(h *tokenHash, token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(h.encoded + "\x00" + token))
+}
+
+func (c *tokenHashCache) contains(h *tokenHash, token string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.items[tokenHashCacheKey(h, token)]
+}
+
+func (c *tokenHashCache) add(h *tokenHash, token string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		c.items = make(map[[sha256.Size]byte]bool)
+	}
+	c.items[tokenHashCacheKey(h, token)] = true
+}
+
+// verify tells whether token is the token of h
+func (h *tokenHash) verify(token string) bool {
+	if token == "" {
+		return false
+	}
+	if verifiedTokens.contains(h, token) {
+		return true
+	}
+	key := tokenHashKey([]byte(token), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return false
+	}
+	verifiedTokens.add(h, token)
+	return true
+}
+
+// tokenCheck checks the token of one auth against tokenhashes. Each hash is
+// computed at most once per auth, however many rules and forwards of the port
+// share it.
+type tokenCheck struct {
+	token    string
+	verified map[string]bool
+}
+
+func newTokenCheck(token string) *tokenCheck {
+	return &tokenCheck{token: token, verified: make(map[string]bool)}
+}
+
+func (c *tokenCheck) verify(h *tokenHash) bool {
+	if ok, checked := c.verified[h.encoded]; checked {
+		return ok
+	}
+	ok := h.verify(c.token)
+	c.verified[h.encoded] = ok
+	return ok
+}
+
+// runHashToken reads a token from in and writes its tokenhash to out, it backs
+// the hash-token subcommand
+func runHashToken(in io.Reader, out io.Writer) error {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("read token failed: %v", err)
+	}
+	token := strings.TrimRight(line, "\r\n")
+	if strings.Contains(token, "*") {
+		return fmt.Errorf("token cannot contain wildcard *, hashed tokens only match exactly")
+	}
+	if err := validateSecret("token", token); err != nil {
+		return err
+	}
+	hash, err := hashToken(token)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "tokenhash: %q\n", hash)
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTokenHashVerifiesOnlyItsToken(t *testing.T) {
+	encoded, err := hashToken("token-abcdefghijklmnopqrstuvwxyz")
+	if err != nil {
+		t.Fatalf("hash token: %v", err)
+	}
+	hash, err := parseTokenHash(encoded)
+	if err != nil {
+		t.Fatalf("parse token hash: %v", err)
+	}
+	if !hash.verify("token-abcdefghijklmnopqrstuvwxyz") || !hash.verify("token-abcdefghijklmnopqrstuvwxyz") {
+		t.Fatal("expected hashed token to verify, also from the cache")
+	}
+	if hash.verify("token-abcdefghijklmnopqrstuvwxy*") || hash.verify("") {
+		t.Fatal("expected other tokens to fail")
+	}
+	for _, bad := range []string{"token-abcdefghijklmnopqrstuvwxyz", "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA", strings.Replace(encoded, "v=19", "v=16", 1)} {
+		if _, err := parseTokenHash(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestHashTokenCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := runHashToken(strings.NewReader("token-abcdefghijklmnopqrstuvwxyz\n"), &out); err != nil {
+		t.Fatalf("hash-token: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), `tokenhash: "$argon2id$v=19$`) {
+		t.Fatalf("unexpected hash-token output %q", out.String())
+	}
+	for _, token := range []string{"token-abcdefghijklmnopqrstuvwx*\n", "short\n", ""} {
+		if err := runHashToken(strings.NewReader(token), &out); err == nil {
+			t.Fatalf("expected token %q to be rejected", token)
+		}
+	}
+}
+
+func TestHashedTokenRulesMatchExactly(t *testing.T) {
+	encoded, _ := hashToken("token-abcdefghijklmnopqrstuvwxyz")
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID: "connauth-server",
+		AuthAddr: "127.0.0.1:40100",
+		AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		Tokens:   map[string]tokenConfig{"ssh-primary": {TokenHash: encoded}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{TokenRef: "ssh-primary"}},
+			AuthExpiredTime: &expiry,
+		}, {
+			BindPort:        40023,
+			ForwardAddr:     "127.0.0.1:23",
+			AllowTokens:     []accessRule{{TokenHash: encoded}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("expected hashed tokens to be valid: %v", err)
+	}
+	initClientList()
+	for _, port := range []uint16{40022, 40023} {
+		if !authorizeClient("192.0.2.10", "workstation", port, "token-abcdefghijklmnopqrstuvwxyz").Authorized {
+			t.Fatalf("expected hashed token to auth port %d", port)
+		}
+		if authorizeClient("192.0.2.11", "workstation", port, "token-abcdefghijklmnopqrstuvwxy").Authorized {
+			t.Fatalf("expected other token to be denied on port %d", port)
+		}
+	}
+	if rule := globalConfig.ForwardConfigs[1].AllowTokens[0]; rule.ruleType != "inline_token_hash" || rule.ruleID != "inline:forward:40023:token:1" {
+		t.Fatalf("unexpected inline hashed rule: %#v", rule)
+	}
+}
+
+func TestTokenHashIsComputedOncePerAuth(t *testing.T) {
+	encoded, _ := hashToken("token-abcdefghijklmnopqrstuvwxyz")
+	previous := tokenHashKey
+	defer func() { tokenHashKey = previous }()
+	computed := 0
+	tokenHashKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		computed++
+		return previous(password, salt, time, memory, threads, keyLen)
+	}
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID:          "connauth-server",
+		AuthAddr:          "127.0.0.1:40100",
+		AuthKeys:          []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		GlobalAllowTokens: []accessRule{{TokenHash: encoded}},
+	}
+	for _, bindAddr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		globalConfig.ForwardConfigs = append(globalConfig.ForwardConfigs, forwardConfig{
+			BindAddr:        bindAddr,
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{TokenHash: encoded}, {TokenHash: encoded}},
+			AuthExpiredTime: &expiry,
+		})
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("check config: %v", err)
+	}
+	initClientList()
+	if authorizeClient("192.0.2.11", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxy").Authorized {
+		t.Fatal("expected other token to be denied")
+	}
+	if computed != 1 {
+		t.Fatalf("expected one argon2id for a hash shared by every rule of the port, computed %d", computed)
+	}
+}
+
+func TestTokenRulesAreAllEvaluatedAfterAMatch(t *testing.T) {
+	encoded, _ := hashToken("other-abcdefghijklmnopqrstuvwxyz")
+	previous := tokenHashKey
+	defer func() { tokenHashKey = previous }()
+	computed := 0
+	tokenHashKey = func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+		computed++
+		return previous(password, salt, time, memory, threads, keyLen)
+	}
+	expiry := uint32(60)
+	globalConfig = &config{
+		ServerID:          "connauth-server",
+		AuthAddr:          "127.0.0.1:40100",
+		AuthKeys:          []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+		GlobalAllowTokens: []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}},
+		ForwardConfigs: []forwardConfig{{
+			BindPort:        40022,
+			ForwardAddr:     "127.0.0.1:22",
+			AllowTokens:     []accessRule{{Token: "token-abcdefghijklmnopqrstuvwxyz"}, {TokenHash: encoded}},
+			AuthExpiredTime: &expiry,
+		}},
+	}
+	if err := globalConfig.CheckValid(); err != nil {
+		t.Fatalf("check config: %v", err)
+	}
+	initClientList()
+	result := authorizeClient("192.0.2.11", "workstation", 40022, "token-abcdefghijklmnopqrstuvwxyz")
+	if !result.Authorized || result.RuleScope != "global" || result.RuleID != "inline:global:token:1" {
+		t.Fatalf("expected the first global rule to authorize the client, got %+v", result)
+	}
+	if computed != 1 {
+		t.Fatalf("expected the tokenhash rule after the match to be evaluated, computed %d", computed)
+	}
+}
+
+func TestServerConfigRejectsTokenHashWithToken(t *testing.T) {
+	encoded, _ := hashToken("token-abcdefghijklmnopqrstuvwxyz")
+	expiry := uint32(60)
+	for _, c := range []struct {
+		tokens map[string]tokenConfig
+		rule   accessRule
+	}{
+		{map[string]tokenConfig{"ssh-primary": {Token: "token-abcdefghijklmnopqrstuvwxyz", TokenHash: encoded}}, accessRule{TokenRef: "ssh-primary"}},
+		{nil, accessRule{Token: "token-abcdefghijklmnopqrstuvwx*", TokenHash: encoded}},
+		{nil, accessRule{TokenRef: "ssh-primary", TokenHash: encoded}},
+		{nil, accessRule{TokenHash: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA"}},
+	} {
+		cfg := config{
+			ServerID: "connauth-server",
+			AuthAddr: "127.0.0.1:40100",
+			AuthKeys: []authKeyConfig{{ID: "primary-2026-06", Key: "abcdefghijklmnopqrstuvwxyz123456"}},
+			Tokens:   c.tokens,
+			ForwardConfigs: []forwardConfig{{
+				BindPort:        40022,
+				ForwardAddr:     "127.0.0.1:22",
+				AllowTokens:     []accessRule{c.rule},
+				AuthExpiredTime: &expiry,
+			}},
+		}
+		if err := cfg.CheckValid(); err == nil {
+			t.Fatalf("expected rule %#v to be rejected", c.rule)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often the auth loop comes round while no packet arrives
+var authLoopTick = time.Second
+
+// how long the auth loop may be busy or a lock may be held before the server
+// counts as stuck
+var livenessTimeout = 5 * time.Second
+
+// authLoopBeat is when the auth loop last came round in unix nanoseconds,
+// zero while no auth loop runs
+var authLoopBeat int64
+
+// checkAlive is the liveness check behind the systemd watchdog: the auth loop
+// must have come round lately and neither the runtime nor the client list
+// may be locked for longer than livenessTimeout
+func (s *serverRuntime) checkAlive(now time.Time) error {
+	if beat := atomic.LoadInt64(&authLoopBeat); beat != 0 && now.Sub(time.Unix(0, beat)) > livenessTimeout {
+		return fmt.Errorf("auth loop did not come round for %s", now.Sub(time.Unix(0, beat)).Round(time.Second))
+	}
+	if !lockedWithin(&s.mux, livenessTimeout) {
+		return fmt.Errorf("server runtime locked for more than %s", livenessTimeout)
+	}
+	if !lockedWithin(&muxClient, livenessTimeout) {
+		return fmt.Errorf("client list locked for more than %s", livenessTimeout)
+	}
+	return nil
+}
+
+// lockedWithin tells whether l could be locked within timeout, a stuck lock
+// leaves the goroutine behind
+func lockedWithin(l sync.Locker, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		l.Lock()
+		l.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckAliveFailsWhenAuthLoopOrLocksAreStuck(t *testing.T) {
+	previousTick, previousTimeout := authLoopTick, livenessTimeout
+	defer func() { authLoopTick, livenessTimeout = previousTick, previousTimeout }()
+	authLoopTick, livenessTimeout = 20*time.Millisecond, 100*time.Millisecond
+	globalConfig = &config{ServerID: "connauth-server"}
+	stopAuth := startAuthForTest(t, freeUDPAddr(t))
+	runtime := newServerRuntime("")
+
+	time.Sleep(3 * authLoopTick)
+	if err := runtime.checkAlive(time.Now()); err != nil {
+		t.Fatalf("expected an idle server to be alive: %v", err)
+	}
+	if err := runtime.checkAlive(time.Now().Add(2 * livenessTimeout)); err == nil {
+		t.Fatal("expected an auth loop that did not come round to fail the check")
+	}
+
+	runtime.mux.Lock()
+	err := runtime.checkAlive(time.Now())
+	runtime.mux.Unlock()
+	if err == nil {
+		t.Fatal("expected a stuck runtime lock to fail the check")
+	}
+
+	stopAuth()
+	if beat := atomic.LoadInt64(&authLoopBeat); beat != 0 {
+		t.Fatal("expected a stopped auth loop not to be checked")
+	}
+}
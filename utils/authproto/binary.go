@@ -0,0 +1,486 @@
+package authproto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// wire formats of envelopes and the messages inside
+const (
+	WireFormatJSON   = "json"
+	WireFormatBinary = "binary"
+)
+
+// BinaryVersion is the first byte of a binary envelope, BinaryKeypairVersion
+// the first byte of one in keypair mode. A JSON envelope always starts with
+// '{', so both formats can share one port.
+const (
+	BinaryVersion        byte = 0x01
+	BinaryKeypairVersion byte = 0x02
+)
+
+// ServerIDHashSize is the length of the server id hash of a binary envelope,
+// the server id itself is never sent in plain text
+const ServerIDHashSize = 8
+
+const serverIDHashPrefix = "connauth:server-id:"
+
+// binary message type codes
+const (
+	binaryChallengeRequest  byte = 1
+	binaryChallenge         byte = 2
+	binaryChallengeResponse byte = 3
+	binaryAuthResult        byte = 4
+)
+
+// tags of optional message fields
+const (
+	binaryFieldSignature byte = 1
+	binaryFieldOTP       byte = 2
+	binaryFieldTicket    byte = 3
+	binaryFieldWant      byte = 4
+	binaryFieldBindAddr  byte = 5
+)
+
+// bits of the want field of a challenge response
+const binaryWantTicket byte = 1
+
+var binaryMessageTypes = map[byte]string{
+	binaryChallengeRequest:  MessageTypeChallengeRequest,
+	binaryChallenge:         MessageTypeChallenge,
+	binaryChallengeResponse: MessageTypeChallengeResponse,
+	binaryAuthResult:        MessageTypeAuthResult,
+}
+
+// ValidWireFormat tells whether format is a known wire format
+func ValidWireFormat(format string) bool {
+	return format == WireFormatJSON || format == WireFormatBinary
+}
+
+// ServerIDHash returns the server id hash sent in a binary envelope
+func ServerIDHash(serverID string) []byte {
+	sum := sha256.Sum256([]byte(serverIDHashPrefix + serverID))
+	return sum[:ServerIDHashSize]
+}
+
+// MatchServer tells whether e is addressed to serverID. A binary envelope
+// only carries the hash of the server id.
+func (e Envelope) MatchServer(serverID string) bool {
+	if len(e.ServerIDHash) > 0 {
+		return bytes.Equal(e.ServerIDHash, ServerIDHash(serverID))
+	}
+	return e.ServerID == serverID
+}
+
+// EncodeEnvelope encodes e in format. The binary layout is
+//
+//	version(1) | key id length(1) | key id | server id hash(8) | payload
+//
+// where payload is the output of Seal, the AES-GCM nonce followed by the
+// ciphertext. In keypair mode it is
+//
+//	version(1) | client id length(1) | client id | server id hash(8) |
+//	ephemeral key length(1) | ephemeral key | signature length(1) | signature | payload
+func EncodeEnvelope(e Envelope, format string) ([]byte, error) {
+	switch format {
+	case WireFormatJSON:
+		return json.Marshal(e)
+	case WireFormatBinary:
+		version, id := BinaryVersion, e.KeyID
+		if e.Keypair() {
+			version, id = BinaryKeypairVersion, e.ClientID
+			if err := e.validateKeypair(); err != nil {
+				return nil, err
+			}
+		} else if err := validateField("key_id", e.KeyID); err != nil {
+			return nil, err
+		}
+		hash := e.ServerIDHash
+		if len(hash) == 0 {
+			if err := validateField("server_id", e.ServerID); err != nil {
+				return nil, err
+			}
+			hash = ServerIDHash(e.ServerID)
+		}
+		if len(hash) != ServerIDHashSize {
+			return nil, fmt.Errorf("server id hash invalid")
+		}
+		packet := make([]byte, 0, 4+len(id)+ServerIDHashSize+len(e.EphemeralKey)+len(e.Signature)+len(e.Payload))
+		packet = append(packet, version, byte(len(id)))
+		packet = append(packet, id...)
+		packet = append(packet, hash...)
+		if e.Keypair() {
+			packet = append(packet, byte(len(e.EphemeralKey)))
+			packet = append(packet, e.EphemeralKey...)
+			packet = append(packet, byte(len(e.Signature)))
+			packet = append(packet, e.Signature...)
+		}
+		return append(packet, e.Payload...), nil
+	}
+	return nil, fmt.Errorf("unknown wire format %s", format)
+}
+
+// DecodeEnvelope detects the format of packet and decodes it. A binary
+// envelope returns ServerIDHash instead of ServerID, see MatchServer.
+func DecodeEnvelope(packet []byte) (Envelope, string, error) {
+	if len(packet) == 0 {
+		return Envelope{}, "", fmt.Errorf("packet cannot be empty")
+	}
+	switch packet[0] {
+	case '{':
+		var e Envelope
+		if err := json.Unmarshal(packet, &e); err != nil {
+			return Envelope{}, "", fmt.Errorf("invalid json envelope")
+		}
+		return e, WireFormatJSON, nil
+	case BinaryVersion, BinaryKeypairVersion:
+		r := &binaryReader{buf: packet[1:]}
+		var e Envelope
+		id := r.string()
+		e.ServerIDHash = append([]byte(nil), r.take(ServerIDHashSize)...)
+		if packet[0] == BinaryKeypairVersion {
+			e.ClientID = id
+			e.EphemeralKey = r.bytes()
+			e.Signature = r.bytes()
+		} else {
+			e.KeyID = id
+		}
+		if r.err != nil {
+			return Envelope{}, "", fmt.Errorf("binary envelope truncated")
+		}
+		e.Payload = append([]byte(nil), r.buf...)
+		return e, WireFormatBinary, nil
+	}
+	return Envelope{}, "", fmt.Errorf("unknown wire format")
+}
+
+// EncodeMessage encodes one of ChallengeRequest, Challenge,
+// ChallengeResponse or AuthResult in format
+func EncodeMessage(msg interface{}, format string) ([]byte, error) {
+	switch format {
+	case WireFormatJSON:
+		return json.Marshal(msg)
+	case WireFormatBinary:
+		return encodeBinaryMessage(msg)
+	}
+	return nil, fmt.Errorf("unknown wire format %s", format)
+}
+
+// MessageTypeOf returns the message type of an opened payload
+func MessageTypeOf(plain []byte, format string) (string, error) {
+	switch format {
+	case WireFormatJSON:
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(plain, &header); err != nil {
+			return "", err
+		}
+		return header.Type, nil
+	case WireFormatBinary:
+		if len(plain) == 0 {
+			return "", fmt.Errorf("message cannot be empty")
+		}
+		msgType, ok := binaryMessageTypes[plain[0]]
+		if !ok {
+			return "", fmt.Errorf("unknown message type")
+		}
+		return msgType, nil
+	}
+	return "", fmt.Errorf("unknown wire format %s", format)
+}
+
+// DecodeMessage decodes an opened payload into out, a pointer to one of the
+// message types
+func DecodeMessage(plain []byte, format string, out interface{}) error {
+	switch format {
+	case WireFormatJSON:
+		return json.Unmarshal(plain, out)
+	case WireFormatBinary:
+		return decodeBinaryMessage(plain, out)
+	}
+	return fmt.Errorf("unknown wire format %s", format)
+}
+
+// A binary message starts with its type code followed by the fields of the
+// type in a fixed order: integers in big endian, strings with a one byte
+// length prefix. Optional fields may follow as tag(1) | length(2) | value,
+// a decoder skips tags it does not know.
+
+type binaryWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *binaryWriter) uint16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *binaryWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.buf = append(w.buf, b[:]...)
+}
+
+// optional writes an optional field, an empty value is left out
+func (w *binaryWriter) optional(tag byte, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	if len(value) > 0xffff {
+		if w.err == nil {
+			w.err = fmt.Errorf("optional field %d too long", tag)
+		}
+		return
+	}
+	w.buf = append(w.buf, tag, byte(len(value)>>8), byte(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *binaryWriter) string(name string, s string) {
+	if len(s) > 255 {
+		if w.err == nil {
+			w.err = fmt.Errorf("%s too long", name)
+		}
+		return
+	}
+	w.buf = append(w.buf, byte(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = fmt.Errorf("message truncated")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) uint16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *binaryReader) int64() int64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+// bytes reads a value with a one byte length prefix, an empty value is nil
+func (r *binaryReader) bytes() []byte {
+	n := r.take(1)
+	if n == nil || n[0] == 0 {
+		return nil
+	}
+	return append([]byte(nil), r.take(int(n[0]))...)
+}
+
+// optional reads the optional fields that follow the fixed layout and calls
+// set for each of them
+func (r *binaryReader) optional(set func(tag byte, value []byte) error) {
+	for r.err == nil && len(r.buf) > 0 {
+		tag := r.take(1)
+		length := r.uint16()
+		value := r.take(int(length))
+		if r.err != nil {
+			return
+		}
+		if set != nil {
+			if err := set(tag[0], value); err != nil {
+				r.err = err
+			}
+		}
+	}
+}
+
+// signatureField reads the optional signature field into dst
+func signatureField(dst *[]byte) func(tag byte, value []byte) error {
+	return func(tag byte, value []byte) error {
+		if tag == binaryFieldSignature {
+			*dst = append([]byte(nil), value...)
+		}
+		return nil
+	}
+}
+
+func checkType(name string, msgType string, expected string) error {
+	if msgType != expected {
+		return fmt.Errorf("invalid %s type", name)
+	}
+	return nil
+}
+
+func encodeBinaryMessage(msg interface{}) ([]byte, error) {
+	w := &binaryWriter{}
+	switch m := msg.(type) {
+	case ChallengeRequest:
+		if err := checkType("challenge request", m.Type, MessageTypeChallengeRequest); err != nil {
+			return nil, err
+		}
+		w.buf = append(w.buf, binaryChallengeRequest)
+		w.uint16(m.Port)
+		w.int64(m.Timestamp)
+		w.string("server_id", m.ServerID)
+		w.string("client_id", m.ClientID)
+		w.string("client_nonce", m.ClientNonce)
+	case Challenge:
+		if err := checkType("challenge", m.Type, MessageTypeChallenge); err != nil {
+			return nil, err
+		}
+		w.buf = append(w.buf, binaryChallenge)
+		w.uint16(m.Port)
+		w.int64(m.ExpiresAt)
+		w.string("server_id", m.ServerID)
+		w.string("client_id", m.ClientID)
+		w.string("client_nonce", m.ClientNonce)
+		w.string("server_nonce", m.ServerNonce)
+		w.optional(binaryFieldSignature, m.Signature)
+	case ChallengeResponse:
+		if err := checkType("challenge response", m.Type, MessageTypeChallengeResponse); err != nil {
+			return nil, err
+		}
+		w.buf = append(w.buf, binaryChallengeResponse)
+		w.uint16(m.Port)
+		w.int64(m.Timestamp)
+		w.string("server_id", m.ServerID)
+		w.string("client_id", m.ClientID)
+		w.string("client_nonce", m.ClientNonce)
+		w.string("server_nonce", m.ServerNonce)
+		w.string("token", m.Token)
+		w.optional(binaryFieldSignature, m.Signature)
+		w.optional(binaryFieldOTP, m.OTP)
+		if m.WantTicket {
+			w.optional(binaryFieldWant, []byte{binaryWantTicket})
+		}
+		w.optional(binaryFieldBindAddr, []byte(m.BindAddr))
+	case AuthResult:
+		if err := checkType("auth result", m.Type, MessageTypeAuthResult); err != nil {
+			return nil, err
+		}
+		w.buf = append(w.buf, binaryAuthResult)
+		w.uint16(m.Port)
+		w.int64(m.Timestamp)
+		w.int64(m.ExpiresAt)
+		w.string("server_id", m.ServerID)
+		w.string("client_id", m.ClientID)
+		w.string("client_nonce", m.ClientNonce)
+		w.string("server_nonce", m.ServerNonce)
+		w.string("result", m.Result)
+		w.string("reason", m.Reason)
+		w.optional(binaryFieldSignature, m.Signature)
+		w.optional(binaryFieldTicket, []byte(m.Ticket))
+	default:
+		return nil, fmt.Errorf("unsupported message %T", msg)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+func decodeBinaryMessage(plain []byte, out interface{}) error {
+	msgType, err := MessageTypeOf(plain, WireFormatBinary)
+	if err != nil {
+		return err
+	}
+	r := &binaryReader{buf: plain[1:]}
+	switch m := out.(type) {
+	case *ChallengeRequest:
+		if err := checkType("challenge request", msgType, MessageTypeChallengeRequest); err != nil {
+			return err
+		}
+		*m = ChallengeRequest{Type: msgType}
+		m.Port = r.uint16()
+		m.Timestamp = r.int64()
+		m.ServerID = r.string()
+		m.ClientID = r.string()
+		m.ClientNonce = r.string()
+	case *Challenge:
+		if err := checkType("challenge", msgType, MessageTypeChallenge); err != nil {
+			return err
+		}
+		*m = Challenge{Type: msgType}
+		m.Port = r.uint16()
+		m.ExpiresAt = r.int64()
+		m.ServerID = r.string()
+		m.ClientID = r.string()
+		m.ClientNonce = r.string()
+		m.ServerNonce = r.string()
+		r.optional(signatureField(&m.Signature))
+	case *ChallengeResponse:
+		if err := checkType("challenge response", msgType, MessageTypeChallengeResponse); err != nil {
+			return err
+		}
+		*m = ChallengeResponse{Type: msgType}
+		m.Port = r.uint16()
+		m.Timestamp = r.int64()
+		m.ServerID = r.string()
+		m.ClientID = r.string()
+		m.ClientNonce = r.string()
+		m.ServerNonce = r.string()
+		m.Token = r.string()
+		r.optional(func(tag byte, value []byte) error {
+			if tag == binaryFieldOTP {
+				m.OTP = append([]byte(nil), value...)
+				return nil
+			}
+			if tag == binaryFieldWant && len(value) > 0 {
+				m.WantTicket = value[0]&binaryWantTicket != 0
+				return nil
+			}
+			if tag == binaryFieldBindAddr {
+				m.BindAddr = string(value)
+				return nil
+			}
+			return signatureField(&m.Signature)(tag, value)
+		})
+	case *AuthResult:
+		if err := checkType("auth result", msgType, MessageTypeAuthResult); err != nil {
+			return err
+		}
+		*m = AuthResult{Type: msgType}
+		m.Port = r.uint16()
+		m.Timestamp = r.int64()
+		m.ExpiresAt = r.int64()
+		m.ServerID = r.string()
+		m.ClientID = r.string()
+		m.ClientNonce = r.string()
+		m.ServerNonce = r.string()
+		m.Result = r.string()
+		m.Reason = r.string()
+		r.optional(func(tag byte, value []byte) error {
+			if tag == binaryFieldTicket {
+				m.Ticket = string(value)
+				return nil
+			}
+			return signatureField(&m.Signature)(tag, value)
+		})
+	default:
+		return fmt.Errorf("unsupported message %T", out)
+	}
+	r.optional(nil)
+	return r.err
+}
@@ -0,0 +1,106 @@
+package authproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryEnvelopeRoundTrip(t *testing.T) {
+	env := Envelope{KeyID: "primary-2026-06", ServerID: "connauth-server", Payload: []byte("sealed-payload")}
+	packet, err := EncodeEnvelope(env, WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode envelope: %v", err)
+	}
+	if packet[0] != BinaryVersion || int(packet[1]) != len(env.KeyID) {
+		t.Fatalf("unexpected envelope header % x", packet[:2])
+	}
+	if bytes.Contains(packet, []byte(env.ServerID)) {
+		t.Fatal("binary envelope must not carry the server id in plain text")
+	}
+	decoded, format, err := DecodeEnvelope(packet)
+	if err != nil || format != WireFormatBinary {
+		t.Fatalf("decode envelope: %s %v", format, err)
+	}
+	if err := decoded.Validate(); err != nil {
+		t.Fatalf("expected decoded envelope to be valid: %v", err)
+	}
+	if decoded.KeyID != env.KeyID || !bytes.Equal(decoded.Payload, env.Payload) {
+		t.Fatalf("unexpected decoded envelope %+v", decoded)
+	}
+	if !decoded.MatchServer("connauth-server") || decoded.MatchServer("other-server") {
+		t.Fatal("expected server id hash to match only its server")
+	}
+	if _, _, err := DecodeEnvelope(packet[:len(env.KeyID)]); err == nil {
+		t.Fatal("expected truncated envelope to fail")
+	}
+}
+
+func TestDecodeEnvelopeDetectsJSON(t *testing.T) {
+	packet, err := EncodeEnvelope(Envelope{KeyID: "primary-2026-06", ServerID: "connauth-server", Payload: []byte("payload")}, WireFormatJSON)
+	if err != nil {
+		t.Fatalf("encode envelope: %v", err)
+	}
+	env, format, err := DecodeEnvelope(packet)
+	if err != nil || format != WireFormatJSON {
+		t.Fatalf("decode envelope: %s %v", format, err)
+	}
+	if env.ServerID != "connauth-server" || !env.MatchServer("connauth-server") {
+		t.Fatalf("unexpected json envelope %+v", env)
+	}
+	if _, _, err := DecodeEnvelope([]byte{0x7f, 0x00}); err == nil {
+		t.Fatal("expected unknown version to fail")
+	}
+}
+
+func TestBinaryMessagesRoundTrip(t *testing.T) {
+	messages := []struct {
+		msg interface{}
+		out interface{}
+	}{
+		{ChallengeRequest{Type: MessageTypeChallengeRequest, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", Timestamp: 1700000000}, &ChallengeRequest{}},
+		{Challenge{Type: MessageTypeChallenge, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", ExpiresAt: 1700000030}, &Challenge{}},
+		{ChallengeResponse{Type: MessageTypeChallengeResponse, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Token: "token-abcdefghijklmnopqrstuvwxyz", Timestamp: 1700000000}, &ChallengeResponse{}},
+		{ChallengeResponse{Type: MessageTypeChallengeResponse, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Token: "token-abcdefghijklmnopqrstuvwxyz", Timestamp: 1700000000, Signature: []byte("signature"), OTP: OTPProof("287082", "server-nonce")}, &ChallengeResponse{}},
+		{ChallengeResponse{Type: MessageTypeChallengeResponse, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Token: "token-abcdefghijklmnopqrstuvwxyz", Timestamp: 1700000000, WantTicket: true}, &ChallengeResponse{}},
+		{ChallengeResponse{Type: MessageTypeChallengeResponse, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Token: "token-abcdefghijklmnopqrstuvwxyz", Timestamp: 1700000000, BindAddr: "2001:db8::10"}, &ChallengeResponse{}},
+		{AuthResult{Type: MessageTypeAuthResult, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Result: AuthResultAuthorized, Reason: AuthReasonOK, ExpiresAt: 1700003600, Timestamp: 1700000000}, &AuthResult{}},
+		{AuthResult{Type: MessageTypeAuthResult, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce", Result: AuthResultAuthorized, Reason: AuthReasonOK, ExpiresAt: 1700003600, Timestamp: 1700000000, Signature: []byte("signature"), Ticket: "ticket"}, &AuthResult{}},
+	}
+	for _, m := range messages {
+		plain, err := EncodeMessage(m.msg, WireFormatBinary)
+		if err != nil {
+			t.Fatalf("encode %T: %v", m.msg, err)
+		}
+		msgType, err := MessageTypeOf(plain, WireFormatBinary)
+		if err != nil || msgType != reflect.ValueOf(m.msg).FieldByName("Type").String() {
+			t.Fatalf("unexpected type of %T: %s %v", m.msg, msgType, err)
+		}
+		if err := DecodeMessage(plain, WireFormatBinary, m.out); err != nil {
+			t.Fatalf("decode %T: %v", m.msg, err)
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(m.out).Elem().Interface(), m.msg) {
+			t.Fatalf("round trip mismatch: %+v != %+v", m.out, m.msg)
+		}
+		if err := DecodeMessage(plain[:len(plain)-1], WireFormatBinary, m.out); err == nil {
+			t.Fatalf("expected truncated %T to fail", m.msg)
+		}
+	}
+}
+
+func TestBinaryMessageSkipsUnknownOptionalFields(t *testing.T) {
+	req := ChallengeRequest{Type: MessageTypeChallengeRequest, ServerID: "connauth-server", ClientID: "workstation", Port: 40022, ClientNonce: "client-nonce", Timestamp: 1700000000}
+	plain, err := EncodeMessage(req, WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode request: %v", err)
+	}
+	plain = append(plain, 0xf0, 0x00, 0x03, 'a', 'b', 'c')
+	var decoded ChallengeRequest
+	if err := DecodeMessage(plain, WireFormatBinary, &decoded); err != nil || decoded != req {
+		t.Fatalf("expected unknown optional field to be skipped: %+v %v", decoded, err)
+	}
+	var challenge Challenge
+	if err := DecodeMessage(plain, WireFormatBinary, &challenge); err == nil {
+		t.Fatal("expected request not to decode as challenge")
+	}
+}
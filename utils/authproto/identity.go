@@ -0,0 +1,52 @@
+package authproto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+)
+
+// A server with an identity key signs its Challenge and AuthResult, a client
+// that pins the public key rejects unsigned or wrongly signed messages. The
+// signature covers the message and a hash of the key that seals it, the
+// authkey or the session key of keypair mode, so a signed message cannot be
+// relayed into another session.
+
+const identitySignaturePrefix = "connauth:server-identity"
+
+func identityTranscript(ctx Context, key []byte, msg interface{}) ([]byte, error) {
+	switch m := msg.(type) {
+	case Challenge:
+		m.Signature = nil
+		msg = m
+	case AuthResult:
+		m.Signature = nil
+		msg = m
+	default:
+		return nil, fmt.Errorf("unsupported message %T", msg)
+	}
+	body, err := encodeBinaryMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	binding := sha256.Sum256(append([]byte(identitySignaturePrefix), key...))
+	return transcript(identitySignaturePrefix, []byte(ctx.ServerID), []byte(ctx.KeyID), binding[:], body), nil
+}
+
+// SignServerMessage signs a Challenge or AuthResult sealed with key, the
+// signature is left out of what is signed
+func SignServerMessage(priv ed25519.PrivateKey, ctx Context, key []byte, msg interface{}) ([]byte, error) {
+	data, err := identityTranscript(ctx, key, msg)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(priv, data), nil
+}
+
+func VerifyServerMessage(pub ed25519.PublicKey, ctx Context, key []byte, msg interface{}, signature []byte) bool {
+	if len(signature) != SignatureSize {
+		return false
+	}
+	data, err := identityTranscript(ctx, key, msg)
+	return err == nil && ed25519.Verify(pub, data, signature)
+}
@@ -0,0 +1,38 @@
+package authproto
+
+import (
+	"testing"
+)
+
+func TestServerMessageSignature(t *testing.T) {
+	pubText, privText, _ := GenerateKey()
+	pub, _ := ParsePublicKey(pubText)
+	priv, _ := ParsePrivateKey(privText)
+	ctx := Context{KeyID: "primary-2026-06", ServerID: "connauth-server"}
+	key := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	challenge := Challenge{Type: MessageTypeChallenge, ServerID: "connauth-server", ClientID: "workstation", Port: 40022,
+		ClientNonce: "client-nonce", ServerNonce: "server-nonce", ExpiresAt: 1700000030}
+	signature, err := SignServerMessage(priv, ctx, key, challenge)
+	if err != nil {
+		t.Fatalf("sign challenge: %v", err)
+	}
+	challenge.Signature = signature
+	if !VerifyServerMessage(pub, ctx, key, challenge, signature) {
+		t.Fatal("expected signature to verify with the signature field set")
+	}
+	if VerifyServerMessage(pub, ctx, []byte("other-key-abcdefghijklmnopqrstuv"), challenge, signature) {
+		t.Fatal("expected signature to be bound to the sealing key")
+	}
+	challenge.ServerNonce = "other-nonce"
+	if VerifyServerMessage(pub, ctx, key, challenge, signature) {
+		t.Fatal("expected changed challenge to fail")
+	}
+	result := AuthResult{Type: MessageTypeAuthResult, ServerID: "connauth-server", ClientID: "workstation", Port: 40022,
+		ClientNonce: "client-nonce", ServerNonce: "server-nonce", Result: AuthResultDenied, Reason: AuthReasonNotAllowed, Timestamp: 1700000000}
+	if VerifyServerMessage(pub, ctx, key, result, signature) {
+		t.Fatal("expected challenge signature not to verify a result")
+	}
+	if _, err := SignServerMessage(priv, ctx, key, ChallengeRequest{}); err == nil {
+		t.Fatal("expected client messages to be rejected")
+	}
+}
@@ -0,0 +1,131 @@
+package authproto
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// In keypair mode every client has its own Ed25519 key instead of a shared
+// authkey. The handshake is:
+//
+//  1. the client sends the challenge request in clear with its client id, an
+//     ephemeral X25519 key and an Ed25519 signature over them (SignHello)
+//  2. the server answers with its own ephemeral X25519 key, the challenge is
+//     sealed with the session key derived from both ephemeral keys
+//  3. the challenge response carries a signature over the challenge
+//     (SignChallenge) and is sealed with the session key, as is the result
+//
+// The challenge request of keypair mode is signed but not encrypted, so the
+// client id and port are visible on the wire.
+
+const (
+	EphemeralKeySize = 32
+	SignatureSize    = ed25519.SignatureSize
+)
+
+const (
+	helloSignaturePrefix     = "connauth:keypair-hello"
+	challengeSignaturePrefix = "connauth:keypair-challenge"
+	sessionKeyPrefix         = "connauth:keypair-session"
+)
+
+// GenerateKey returns a new Ed25519 keypair of a client or server, the public
+// key and the private key seed encoded as base64
+func GenerateKey() (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate key failed: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv.Seed()), nil
+}
+
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes encoded as base64", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// ParsePrivateKey parses the base64 private key seed of GenerateKey
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key must be %d bytes encoded as base64", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
+
+func NewEphemeralKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate ephemeral key failed: %v", err)
+	}
+	return key, nil
+}
+
+// transcript joins parts with a length prefix each, so different parts can
+// never produce the same bytes
+func transcript(prefix string, parts ...[]byte) []byte {
+	out := []byte(prefix)
+	for _, part := range parts {
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(part)))
+		out = append(out, size[:]...)
+		out = append(out, part...)
+	}
+	return out
+}
+
+func helloTranscript(e Envelope) []byte {
+	return transcript(helloSignaturePrefix, []byte(e.ServerID), []byte(e.ClientID), e.EphemeralKey, e.Payload)
+}
+
+// SignHello signs the challenge request envelope e of keypair mode, e must
+// carry ServerID, ClientID, EphemeralKey and Payload
+func SignHello(priv ed25519.PrivateKey, e Envelope) []byte {
+	return ed25519.Sign(priv, helloTranscript(e))
+}
+
+func VerifyHello(pub ed25519.PublicKey, e Envelope) bool {
+	return len(e.Signature) == SignatureSize && ed25519.Verify(pub, helloTranscript(e), e.Signature)
+}
+
+func challengeTranscript(ctx Context, clientEphemeral []byte, serverEphemeral []byte, c Challenge) []byte {
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], c.Port)
+	return transcript(challengeSignaturePrefix, []byte(ctx.ServerID), []byte(ctx.KeyID),
+		clientEphemeral, serverEphemeral, port[:], []byte(c.ClientNonce), []byte(c.ServerNonce))
+}
+
+// SignChallenge signs the challenge c for ChallengeResponse.Signature, it
+// binds the response to both ephemeral keys of the session
+func SignChallenge(priv ed25519.PrivateKey, ctx Context, clientEphemeral []byte, serverEphemeral []byte, c Challenge) []byte {
+	return ed25519.Sign(priv, challengeTranscript(ctx, clientEphemeral, serverEphemeral, c))
+}
+
+func VerifyChallenge(pub ed25519.PublicKey, ctx Context, clientEphemeral []byte, serverEphemeral []byte, c Challenge, signature []byte) bool {
+	return len(signature) == SignatureSize && ed25519.Verify(pub, challengeTranscript(ctx, clientEphemeral, serverEphemeral, c), signature)
+}
+
+// SessionKey derives the key that seals the messages after the challenge
+// request from the X25519 agreement of priv and peer
+func SessionKey(priv *ecdh.PrivateKey, peer []byte, ctx Context, clientEphemeral []byte, serverEphemeral []byte) ([]byte, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key")
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+	mac := hmac.New(sha256.New, transcript(sessionKeyPrefix, []byte(ctx.ServerID), []byte(ctx.KeyID), clientEphemeral, serverEphemeral))
+	mac.Write(shared)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,117 @@
+package authproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeypairSessionKeysAgree(t *testing.T) {
+	ctx := Context{KeyID: "laptop", ServerID: "connauth-server"}
+	client, _ := NewEphemeralKey()
+	server, _ := NewEphemeralKey()
+	clientPub, serverPub := client.PublicKey().Bytes(), server.PublicKey().Bytes()
+	clientKey, err := SessionKey(client, serverPub, ctx, clientPub, serverPub)
+	if err != nil {
+		t.Fatalf("client session key: %v", err)
+	}
+	serverKey, err := SessionKey(server, clientPub, ctx, clientPub, serverPub)
+	if err != nil {
+		t.Fatalf("server session key: %v", err)
+	}
+	if !bytes.Equal(clientKey, serverKey) {
+		t.Fatal("expected both sides to derive the same session key")
+	}
+	other, _ := SessionKey(server, clientPub, Context{KeyID: "other", ServerID: "connauth-server"}, clientPub, serverPub)
+	if bytes.Equal(other, serverKey) {
+		t.Fatal("expected session key to be bound to the client id")
+	}
+	if _, err := SessionKey(server, make([]byte, EphemeralKeySize), ctx, clientPub, serverPub); err == nil {
+		t.Fatal("expected low order ephemeral key to be rejected")
+	}
+}
+
+func TestKeypairSignatures(t *testing.T) {
+	pubText, privText, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pub, err := ParsePublicKey(pubText)
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	priv, err := ParsePrivateKey(privText)
+	if err != nil {
+		t.Fatalf("parse private key: %v", err)
+	}
+	env := Envelope{ServerID: "connauth-server", ClientID: "laptop", EphemeralKey: make([]byte, EphemeralKeySize), Payload: []byte("request")}
+	env.Signature = SignHello(priv, env)
+	if !VerifyHello(pub, env) {
+		t.Fatal("expected hello signature to verify")
+	}
+	env.Payload = []byte("changed")
+	if VerifyHello(pub, env) {
+		t.Fatal("expected changed hello to fail")
+	}
+
+	ctx := Context{KeyID: "laptop", ServerID: "connauth-server"}
+	challenge := Challenge{Port: 40022, ClientNonce: "client-nonce", ServerNonce: "server-nonce"}
+	signature := SignChallenge(priv, ctx, []byte("client-ephemeral"), []byte("server-ephemeral"), challenge)
+	if !VerifyChallenge(pub, ctx, []byte("client-ephemeral"), []byte("server-ephemeral"), challenge, signature) {
+		t.Fatal("expected challenge signature to verify")
+	}
+	challenge.Port = 40023
+	if VerifyChallenge(pub, ctx, []byte("client-ephemeral"), []byte("server-ephemeral"), challenge, signature) {
+		t.Fatal("expected signature to be bound to the port")
+	}
+	if _, err := ParsePublicKey("short"); err == nil {
+		t.Fatal("expected invalid public key to fail")
+	}
+}
+
+func TestBinaryKeypairEnvelopeRoundTrip(t *testing.T) {
+	env := Envelope{
+		ServerID:     "connauth-server",
+		ClientID:     "laptop",
+		EphemeralKey: bytes.Repeat([]byte{1}, EphemeralKeySize),
+		Signature:    bytes.Repeat([]byte{2}, SignatureSize),
+		Payload:      []byte("payload"),
+	}
+	packet, err := EncodeEnvelope(env, WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode envelope: %v", err)
+	}
+	if packet[0] != BinaryKeypairVersion {
+		t.Fatalf("unexpected version %d", packet[0])
+	}
+	decoded, _, err := DecodeEnvelope(packet)
+	if err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	if err := decoded.Validate(); err != nil || !decoded.Keypair() || !decoded.MatchServer("connauth-server") {
+		t.Fatalf("unexpected decoded envelope %+v %v", decoded, err)
+	}
+	if !bytes.Equal(decoded.EphemeralKey, env.EphemeralKey) || !bytes.Equal(decoded.Signature, env.Signature) || !bytes.Equal(decoded.Payload, env.Payload) {
+		t.Fatalf("keypair fields mismatch %+v", decoded)
+	}
+	env.KeyID = "primary-2026-06"
+	if _, err := EncodeEnvelope(env, WireFormatBinary); err == nil {
+		t.Fatal("expected envelope with key id and client id to be rejected")
+	}
+}
+
+func TestBinaryChallengeResponseCarriesSignature(t *testing.T) {
+	resp := ChallengeResponse{Type: MessageTypeChallengeResponse, ServerID: "connauth-server", ClientID: "laptop", Port: 40022,
+		ClientNonce: "client-nonce", ServerNonce: "server-nonce", Token: "token-abcdefghijklmnopqrstuvwxyz", Timestamp: 1700000000,
+		Signature: bytes.Repeat([]byte{3}, SignatureSize)}
+	plain, err := EncodeMessage(resp, WireFormatBinary)
+	if err != nil {
+		t.Fatalf("encode response: %v", err)
+	}
+	var decoded ChallengeResponse
+	if err := DecodeMessage(plain, WireFormatBinary, &decoded); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if !bytes.Equal(decoded.Signature, resp.Signature) {
+		t.Fatal("expected signature to survive the binary round trip")
+	}
+}
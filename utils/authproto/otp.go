@@ -0,0 +1,96 @@
+package authproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A token rule may require a second factor, a RFC 6238 code of a shared TOTP
+// secret. The client does not send the code itself but OTPProof, a MAC keyed
+// by the code over the server nonce, so the proof of one challenge does not
+// answer another. The proof does not hide the code: with only 10^6 codes,
+// anyone who can read the response (a holder of the auth key, the response is
+// sealed in keypair mode) finds it offline. The server therefore accepts the
+// code of a step for one client only, see MatchOTP.
+
+const (
+	OTPDigits = 6
+	OTPPeriod = 30 * time.Second
+	// codes of the steps before and after the current one are accepted for
+	// clock drift
+	OTPSkewSteps = 1
+	// MinOTPSecretSize is the smallest secret accepted, 80 bits as used by
+	// most authenticator apps
+	MinOTPSecretSize = 10
+)
+
+const otpProofPrefix = "connauth:otp"
+
+// ParseOTPSecret parses a base32 TOTP secret as shown by authenticator apps,
+// spaces and padding are optional and case is ignored
+func ParseOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("totp secret must be encoded as base32")
+	}
+	if len(secret) < MinOTPSecretSize {
+		return nil, fmt.Errorf("totp secret must be at least %d bytes", MinOTPSecretSize)
+	}
+	return secret, nil
+}
+
+// TOTP returns the code of secret at t
+func TOTP(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(t.Unix()/int64(OTPPeriod/time.Second)))
+}
+
+// hotp is the RFC 4226 code of counter with HMAC-SHA1
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", OTPDigits, value%1000000)
+}
+
+// OTPProof binds code to the challenge of serverNonce, it is sent as
+// ChallengeResponse.OTP
+func OTPProof(code string, serverNonce string) []byte {
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write(transcript(otpProofPrefix, []byte(serverNonce)))
+	return mac.Sum(nil)
+}
+
+// VerifyOTP tells whether proof is the OTPProof of a current code of secret
+func VerifyOTP(secret []byte, proof []byte, serverNonce string, now time.Time) bool {
+	_, ok := MatchOTP(secret, proof, serverNonce, now)
+	return ok
+}
+
+// MatchOTP is VerifyOTP that also returns the time step of the code, callers
+// use it to refuse a code that was already used
+func MatchOTP(secret []byte, proof []byte, serverNonce string, now time.Time) (uint64, bool) {
+	if len(proof) != sha256.Size {
+		return 0, false
+	}
+	var matched uint64
+	ok := false
+	for step := -OTPSkewSteps; step <= OTPSkewSteps; step++ {
+		t := now.Add(time.Duration(step) * OTPPeriod)
+		if hmac.Equal(OTPProof(TOTP(secret, t), serverNonce), proof) && !ok {
+			matched = uint64(t.Unix() / int64(OTPPeriod/time.Second))
+			ok = true
+		}
+	}
+	return matched, ok
+}
@@ -0,0 +1,66 @@
+package authproto
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPMatchesRFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for ts, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if got := TOTP(secret, time.Unix(ts, 0)); got != code {
+			t.Fatalf("expected code %s at %d, got %s", code, ts, got)
+		}
+	}
+}
+
+func TestParseOTPSecret(t *testing.T) {
+	text := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	secret, err := ParseOTPSecret("gezd gnbv gy3t qojq" + text[16:])
+	if err != nil || string(secret) != "12345678901234567890" {
+		t.Fatalf("expected lower case secret with spaces to parse, got %q %v", secret, err)
+	}
+	if _, err := ParseOTPSecret("GEZDGNBV"); err == nil {
+		t.Fatal("expected short secret to be rejected")
+	}
+	if _, err := ParseOTPSecret("not base32!"); err == nil {
+		t.Fatal("expected invalid secret to be rejected")
+	}
+}
+
+func TestVerifyOTPIsBoundToServerNonce(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1700000000, 0)
+	proof := OTPProof(TOTP(secret, now), "server-nonce")
+	if !VerifyOTP(secret, proof, "server-nonce", now) {
+		t.Fatal("expected current code to verify")
+	}
+	if !VerifyOTP(secret, proof, "server-nonce", now.Add(OTPPeriod)) {
+		t.Fatal("expected code of the previous step to verify")
+	}
+	if VerifyOTP(secret, proof, "server-nonce", now.Add(3*OTPPeriod)) {
+		t.Fatal("expected old code to fail")
+	}
+	if VerifyOTP(secret, proof, "other-nonce", now) {
+		t.Fatal("expected proof of another challenge to fail")
+	}
+	if VerifyOTP(secret, nil, "server-nonce", now) {
+		t.Fatal("expected missing proof to fail")
+	}
+}
+
+func TestMatchOTPReturnsStepOfCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	for _, skew := range []int{-1, 0, 1} {
+		code := TOTP(secret, now.Add(time.Duration(skew)*OTPPeriod))
+		step, ok := MatchOTP(secret, OTPProof(code, "nonce"), "nonce", now)
+		if want := uint64(1234567890/30 + skew); !ok || step != want {
+			t.Fatalf("expected step %d for skew %d, got %d %v", want, skew, step, ok)
+		}
+	}
+	if _, ok := MatchOTP(secret, OTPProof(TOTP(secret, now.Add(2*OTPPeriod)), "nonce"), "nonce", now); ok {
+		t.Fatal("expected code outside the skew to be rejected")
+	}
+}
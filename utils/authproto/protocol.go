@@ -2,6 +2,7 @@ package authproto
 
 import (
 	"fmt"
+	"net"
 	"time"
 )
 
@@ -9,6 +10,21 @@ const (
 	MessageTypeChallengeRequest  = "challenge_request"
 	MessageTypeChallenge         = "challenge"
 	MessageTypeChallengeResponse = "challenge_response"
+	MessageTypeAuthResult        = "auth_result"
+)
+
+// result values of AuthResult
+const (
+	AuthResultAuthorized = "authorized"
+	AuthResultRenewed    = "renewed"
+	AuthResultDenied     = "denied"
+)
+
+// reason codes of AuthResult, kept generic so a denied client cannot tell
+// a wrong token from a wrong port
+const (
+	AuthReasonOK         = "ok"
+	AuthReasonNotAllowed = "not_allowed"
 )
 
 const (
@@ -29,6 +45,12 @@ type Envelope struct {
 	KeyID    string `json:"key_id"`
 	ServerID string `json:"server_id"`
 	Payload  []byte `json:"payload"`
+	// ServerIDHash replaces ServerID in a binary envelope
+	ServerIDHash []byte `json:"-"`
+	// keypair mode only, see keypair.go
+	ClientID     string `json:"client_id,omitempty"`
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	Signature    []byte `json:"signature,omitempty"`
 }
 
 type ChallengeRequest struct {
@@ -48,6 +70,8 @@ type Challenge struct {
 	ClientNonce string `json:"client_nonce"`
 	ServerNonce string `json:"server_nonce"`
 	ExpiresAt   int64  `json:"expires_at"`
+	// signature of the server identity key, see SignServerMessage
+	Signature []byte `json:"signature,omitempty"`
 }
 
 type ChallengeResponse struct {
@@ -59,6 +83,37 @@ type ChallengeResponse struct {
 	ServerNonce string `json:"server_nonce"`
 	Token       string `json:"token"`
 	Timestamp   int64  `json:"timestamp"`
+	// signature of the challenge in keypair mode, see SignChallenge
+	Signature []byte `json:"signature,omitempty"`
+	// second factor of token rules with totp, see OTPProof
+	OTP []byte `json:"otp,omitempty"`
+	// asks for the one-time ticket of a forward with requireticket, set
+	// only when a connection follows the auth
+	WantTicket bool `json:"want_ticket,omitempty"`
+	// limits the auth to the forward of port bound to this IP, empty for
+	// every forward of port
+	BindAddr string `json:"bind_addr,omitempty"`
+}
+
+type AuthResult struct {
+	Type        string `json:"type"`
+	ServerID    string `json:"server_id"`
+	ClientID    string `json:"client_id"`
+	Port        uint16 `json:"port"`
+	ClientNonce string `json:"client_nonce"`
+	ServerNonce string `json:"server_nonce"`
+	Result      string `json:"result"`
+	Reason      string `json:"reason"`
+	ExpiresAt   int64  `json:"expires_at"`
+	Timestamp   int64  `json:"timestamp"`
+	// signature of the server identity key, see SignServerMessage
+	Signature []byte `json:"signature,omitempty"`
+	// one-time ticket of a forward with requireticket, see WriteTicket
+	Ticket string `json:"ticket,omitempty"`
+}
+
+func (m AuthResult) Authorized() bool {
+	return m.Result == AuthResultAuthorized || m.Result == AuthResultRenewed
 }
 
 func TimestampAllowed(ts int64, now time.Time) bool {
@@ -95,11 +150,33 @@ func validateBase(msgType string, serverID string, clientID string, port uint16,
 	return nil
 }
 
+// Keypair tells whether e belongs to a handshake in keypair mode
+func (e Envelope) Keypair() bool {
+	return e.ClientID != ""
+}
+
+// Context returns the context to seal and open the payload of e, keypair
+// mode uses the client id as key id
+func (e Envelope) Context() Context {
+	if e.Keypair() {
+		return Context{KeyID: e.ClientID, ServerID: e.ServerID}
+	}
+	return Context{KeyID: e.KeyID, ServerID: e.ServerID}
+}
+
 func (e Envelope) Validate() error {
-	if err := validateField("key_id", e.KeyID); err != nil {
+	if e.Keypair() {
+		if err := e.validateKeypair(); err != nil {
+			return err
+		}
+	} else if err := validateField("key_id", e.KeyID); err != nil {
 		return err
 	}
-	if err := validateField("server_id", e.ServerID); err != nil {
+	if len(e.ServerIDHash) > 0 {
+		if len(e.ServerIDHash) != ServerIDHashSize {
+			return fmt.Errorf("server id hash invalid")
+		}
+	} else if err := validateField("server_id", e.ServerID); err != nil {
 		return err
 	}
 	if len(e.Payload) == 0 {
@@ -111,6 +188,22 @@ func (e Envelope) Validate() error {
 	return nil
 }
 
+func (e Envelope) validateKeypair() error {
+	if e.KeyID != "" {
+		return fmt.Errorf("key_id and client_id cannot both be set")
+	}
+	if err := validateField("client_id", e.ClientID); err != nil {
+		return err
+	}
+	if len(e.EphemeralKey) > 0 && len(e.EphemeralKey) != EphemeralKeySize {
+		return fmt.Errorf("ephemeral key invalid")
+	}
+	if len(e.Signature) > 0 && len(e.Signature) != SignatureSize {
+		return fmt.Errorf("signature invalid")
+	}
+	return nil
+}
+
 func (m ChallengeRequest) Validate(now time.Time) error {
 	if err := validateBase(m.Type, m.ServerID, m.ClientID, m.Port, m.Timestamp, now); err != nil {
 		return err
@@ -134,5 +227,33 @@ func (m ChallengeResponse) Validate(now time.Time) error {
 	if err := validateField("server_nonce", m.ServerNonce); err != nil {
 		return err
 	}
+	if m.BindAddr != "" && net.ParseIP(m.BindAddr) == nil {
+		return fmt.Errorf("invalid bind_addr")
+	}
 	return validateField("token", m.Token)
 }
+
+func (m AuthResult) Validate(now time.Time) error {
+	if err := validateBase(m.Type, m.ServerID, m.ClientID, m.Port, m.Timestamp, now); err != nil {
+		return err
+	}
+	if m.Type != MessageTypeAuthResult {
+		return fmt.Errorf("invalid auth result type")
+	}
+	if err := validateField("client_nonce", m.ClientNonce); err != nil {
+		return err
+	}
+	if err := validateField("server_nonce", m.ServerNonce); err != nil {
+		return err
+	}
+	switch m.Result {
+	case AuthResultAuthorized, AuthResultRenewed:
+		if m.ExpiresAt <= m.Timestamp {
+			return fmt.Errorf("expires_at must be after timestamp")
+		}
+	case AuthResultDenied:
+	default:
+		return fmt.Errorf("invalid auth result")
+	}
+	return validateField("reason", m.Reason)
+}
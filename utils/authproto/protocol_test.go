@@ -41,12 +41,61 @@ func TestChallengeResponseValidation(t *testing.T) {
 		t.Fatalf("expected response to be valid: %v", err)
 	}
 
+	resp.BindAddr = "192.0.2.10"
+	if err := resp.Validate(now); err != nil {
+		t.Fatalf("expected bind_addr to be valid: %v", err)
+	}
+	resp.BindAddr = "example.com"
+	if err := resp.Validate(now); err == nil {
+		t.Fatal("expected bind_addr that is not an IP to fail")
+	}
+
+	resp.BindAddr = ""
 	resp.Token = ""
 	if err := resp.Validate(now); err == nil {
 		t.Fatal("expected empty token to fail")
 	}
 }
 
+func TestAuthResultValidation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	result := AuthResult{
+		Type:        MessageTypeAuthResult,
+		ServerID:    "connauth-server",
+		ClientID:    "workstation",
+		Port:        40022,
+		ClientNonce: "client-nonce",
+		ServerNonce: "server-nonce",
+		Result:      AuthResultAuthorized,
+		Reason:      AuthReasonOK,
+		ExpiresAt:   now.Add(time.Hour).Unix(),
+		Timestamp:   now.Unix(),
+	}
+	if err := result.Validate(now); err != nil {
+		t.Fatalf("expected auth result to be valid: %v", err)
+	}
+	if !result.Authorized() {
+		t.Fatal("expected authorized result")
+	}
+
+	result.ExpiresAt = 0
+	if err := result.Validate(now); err == nil {
+		t.Fatal("expected authorized result without expiry to fail")
+	}
+	result.Result = AuthResultDenied
+	result.Reason = AuthReasonNotAllowed
+	if err := result.Validate(now); err != nil {
+		t.Fatalf("expected denied result to be valid: %v", err)
+	}
+	if result.Authorized() {
+		t.Fatal("expected denied result not to be authorized")
+	}
+	result.Result = "maybe"
+	if err := result.Validate(now); err == nil {
+		t.Fatal("expected unknown result to fail")
+	}
+}
+
 func TestTimestampAllowedRejectsStaleAndFutureValues(t *testing.T) {
 	now := time.Unix(1700000000, 0)
 	if !TimestampAllowed(now.Unix(), now) {
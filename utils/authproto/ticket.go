@@ -0,0 +1,64 @@
+package authproto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A forward with requireticket only accepts connections that start with a
+// ticket of AuthResult.Ticket. The ticket is sent as one line
+//
+//	CONNAUTH <ticket>\r\n
+//
+// before any data of the forwarded protocol, the server strips the line and
+// binds the connection to the client the ticket was issued to. A ticket can
+// be used once.
+
+const (
+	ticketPreamblePrefix = "CONNAUTH "
+	// MaxTicketPreamble limits the line read before the ticket is checked
+	MaxTicketPreamble = 64
+	// TicketReadTimeout is how long the server waits for the ticket line
+	TicketReadTimeout = 5 * time.Second
+)
+
+// NewTicket returns a random connection ticket
+func NewTicket() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("generate ticket failed: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// WriteTicket sends the ticket line, it must be the first bytes of the
+// connection
+func WriteTicket(w io.Writer, ticket string) error {
+	_, err := io.WriteString(w, ticketPreamblePrefix+ticket+"\r\n")
+	return err
+}
+
+// ReadTicket reads the ticket line from r one byte at a time, so nothing of
+// the forwarded protocol is consumed
+func ReadTicket(r io.Reader) (string, error) {
+	line := make([]byte, 0, MaxTicketPreamble)
+	var b [1]byte
+	for len(line) < MaxTicketPreamble {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", fmt.Errorf("read ticket failed: %v", err)
+		}
+		if b[0] == '\n' {
+			s := strings.TrimSuffix(string(line), "\r")
+			if !strings.HasPrefix(s, ticketPreamblePrefix) || len(s) == len(ticketPreamblePrefix) {
+				return "", fmt.Errorf("invalid ticket line")
+			}
+			return s[len(ticketPreamblePrefix):], nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("ticket line too long")
+}
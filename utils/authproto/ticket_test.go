@@ -0,0 +1,34 @@
+package authproto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTicketLineRoundTripKeepsFollowingData(t *testing.T) {
+	ticket, err := NewTicket()
+	if err != nil {
+		t.Fatalf("new ticket: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTicket(&buf, ticket); err != nil {
+		t.Fatalf("write ticket: %v", err)
+	}
+	buf.WriteString("SSH-2.0-OpenSSH\r\n")
+	got, err := ReadTicket(&buf)
+	if err != nil || got != ticket {
+		t.Fatalf("expected ticket %q, got %q %v", ticket, got, err)
+	}
+	if buf.String() != "SSH-2.0-OpenSSH\r\n" {
+		t.Fatalf("expected data after the ticket to stay unread, got %q", buf.String())
+	}
+}
+
+func TestReadTicketRejectsOtherData(t *testing.T) {
+	for _, data := range []string{"SSH-2.0-OpenSSH\r\n", "CONNAUTH \r\n", "CONNAUTH " + strings.Repeat("a", MaxTicketPreamble), "CONNAUTH abc"} {
+		if _, err := ReadTicket(strings.NewReader(data)); err == nil {
+			t.Fatalf("expected %q to be rejected", data)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	counter := NewCounterVec("test_packets_total", "Packets by reason.", "reason")
+	counter.Inc("unknown_key_id")
+	counter.Inc("unknown_key_id")
+	counter.Add(3, "decrypt_failed")
+	gauge := NewGaugeFunc("test_clients", "Clients per port.", []string{"port"}, func() []Sample {
+		return []Sample{{LabelValues: []string{"40023"}, Value: 1}, {LabelValues: []string{"40022"}, Value: 2}}
+	})
+	histogram := NewHistogramVec("test_dial_seconds", "Dial latency.", []float64{0.1, 1}, "port")
+	histogram.Observe(0.05, "40022")
+	histogram.Observe(0.5, "40022")
+	histogram.Observe(5, "40022")
+
+	var out bytes.Buffer
+	if err := NewRegistry(counter, gauge, histogram).Write(&out); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	expected := `# HELP test_packets_total Packets by reason.
+# TYPE test_packets_total counter
+test_packets_total{reason="decrypt_failed"} 3
+test_packets_total{reason="unknown_key_id"} 2
+# HELP test_clients Clients per port.
+# TYPE test_clients gauge
+test_clients{port="40022"} 2
+test_clients{port="40023"} 1
+# HELP test_dial_seconds Dial latency.
+# TYPE test_dial_seconds histogram
+test_dial_seconds_bucket{port="40022",le="0.1"} 1
+test_dial_seconds_bucket{port="40022",le="1"} 2
+test_dial_seconds_bucket{port="40022",le="+Inf"} 3
+test_dial_seconds_sum{port="40022"} 5.55
+test_dial_seconds_count{port="40022"} 3
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected metrics output:\n%s", out.String())
+	}
+	if counter.Value("unknown_key_id") != 2 || histogram.Count("40022") != 3 {
+		t.Fatal("unexpected stored values")
+	}
+}
+
+func TestRegistryEscapesLabelValues(t *testing.T) {
+	counter := NewCounterVec("test_total", "Line one\nline two.", "value")
+	counter.Inc("a\"b\\c\nd")
+	var out bytes.Buffer
+	_ = NewRegistry(counter).Write(&out)
+	if !strings.Contains(out.String(), `# HELP test_total Line one\nline two.`) {
+		t.Fatalf("help was not escaped:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `test_total{value="a\"b\\c\nd"} 1`) {
+		t.Fatalf("label value was not escaped:\n%s", out.String())
+	}
+}
+
+func TestRegistryHandlerServesGetOnly(t *testing.T) {
+	counter := NewCounterVec("test_total", "Test.")
+	counter.Inc()
+	handler := NewRegistry(counter).Handler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "test_total 1\n") {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected post to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestCounterVecRejectsWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected wrong label count to panic")
+		}
+	}()
+	NewCounterVec("test_total", "Test.", "reason").Inc()
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	buckets := ExponentialBuckets(1024, 4, 3)
+	if len(buckets) != 3 || buckets[0] != 1024 || buckets[2] != 16384 {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
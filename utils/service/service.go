@@ -9,6 +9,15 @@ type system interface {
 	Interactive() bool
 	Platform() string
 	Run(func(<-chan struct{})) error
+	// Install registers the current executable with args as a service
+	// named by Init
+	Install(args []string) error
+	Uninstall() error
+	// Notify sends state to the service manager, see sd_notify
+	Notify(state string) error
+	// KeepAlive keeps the watchdog of the service manager alive while alive
+	// passes, until stop is closed
+	KeepAlive(alive func() error, stop <-chan struct{})
 }
 
 type Option struct {
@@ -32,3 +41,19 @@ func Platform() string {
 func Run(f func(exit <-chan struct{})) error {
 	return _system.Run(f)
 }
+
+func Install(args []string) error {
+	return _system.Install(args)
+}
+
+func Uninstall() error {
+	return _system.Uninstall()
+}
+
+func Notify(state string) error {
+	return _system.Notify(state)
+}
+
+func KeepAlive(alive func() error, stop <-chan struct{}) {
+	_system.KeepAlive(alive, stop)
+}
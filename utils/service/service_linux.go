@@ -0,0 +1,239 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// directory of the unit files written by Install
+var unitDir = "/etc/systemd/system"
+
+// runs systemctl, replaced in tests
+var systemctl = func(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+var config Option
+
+type systemLinux struct {
+}
+
+func (s systemLinux) Init(option Option) error {
+	config = option
+	return nil
+}
+
+// Interactive is false when started by systemd or another init
+func (s systemLinux) Interactive() bool {
+	return os.Getenv("INVOCATION_ID") == "" && os.Getenv("NOTIFY_SOCKET") == "" && os.Getppid() != 1
+}
+
+func (s systemLinux) Platform() string {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		return "linux-systemd"
+	}
+	return runtime.GOOS
+}
+
+// Run stops f on SIGINT or SIGTERM and tells systemd when the service is
+// stopping. f sends READY=1 through Notify itself once it serves.
+func (s systemLinux) Run(f func(exit <-chan struct{})) error {
+	exit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(exit)
+	}()
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signalCh:
+		_ = sdNotify("STOPPING=1")
+	case <-done:
+		// f returned by itself, e.g. after handing over to a new process
+	}
+	close(exit)
+	// let f finish its shutdown work before the process exits
+	<-done
+	return nil
+}
+
+func (s systemLinux) Notify(state string) error {
+	return sdNotify(state)
+}
+
+// KeepAlive sends WATCHDOG=1 every half of WatchdogSec, but only when alive
+// passes, so systemd restarts a service that is stuck. It returns at once
+// when the unit has no watchdog for this process.
+func (s systemLinux) KeepAlive(alive func() error, stop <-chan struct{}) {
+	interval := watchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := alive(); err != nil {
+			logrus.Warnf("liveness check failed, watchdog not notified: %v", err)
+			continue
+		}
+		_ = sdNotify("WATCHDOG=1")
+	}
+}
+
+// Install writes the unit file of the service that starts the current
+// executable with args, and enables it
+func (s systemLinux) Install(args []string) error {
+	if err := checkName(config.Name); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	unit := unitFile(config, exe, args)
+	path := filepath.Join(unitDir, config.Name+".service")
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err := ioutil.WriteFile(path, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", config.Name+".service")
+}
+
+// Uninstall disables the service and removes its unit file
+func (s systemLinux) Uninstall() error {
+	if err := checkName(config.Name); err != nil {
+		return err
+	}
+	path := filepath.Join(unitDir, config.Name+".service")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s is not installed: %v", config.Name, err)
+	}
+	if err := systemctl("disable", "--now", config.Name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func checkName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("servicename must not be empty")
+	}
+	if strings.ContainsAny(name, " /") {
+		return errors.New("servicename must not contain space or /")
+	}
+	return nil
+}
+
+// unitFile is a systemd unit of type notify for exe with args
+func unitFile(option Option, exe string, args []string) string {
+	description := option.Description
+	if description == "" {
+		description = option.DisplayName
+	}
+	if description == "" {
+		description = option.Name
+	}
+	command := []string{quoteUnitArg(exe)}
+	for _, arg := range args {
+		command = append(command, quoteUnitArg(arg))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+WatchdogSec=30
+
+[Install]
+WantedBy=multi-user.target
+`, description, strings.Join(command, " "))
+}
+
+// quoteUnitArg quotes arg for ExecStart, which expands % and $ itself
+func quoteUnitArg(arg string) string {
+	arg = strings.Replace(arg, "%", "%%", -1)
+	arg = strings.Replace(arg, "$", "$$", -1)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	arg = strings.Replace(arg, `\`, `\\`, -1)
+	arg = strings.Replace(arg, `"`, `\"`, -1)
+	return `"` + arg + `"`
+}
+
+// sdNotify sends state to the socket of NOTIFY_SOCKET, it does nothing when
+// not started by systemd
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is the WatchdogSec of the unit, zero without a watchdog
+// for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func init() {
+	_system = systemLinux{}
+}
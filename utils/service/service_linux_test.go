@@ -0,0 +1,180 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func listenNotifySocketForTest(t *testing.T) *net.UnixConn {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen notify socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func readNotifyForTest(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read notify socket: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestRunNotifiesStoppingOnSIGTERM(t *testing.T) {
+	conn := listenNotifySocketForTest(t)
+	stopped := make(chan struct{})
+	serving := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- systemLinux{}.Run(func(exit <-chan struct{}) {
+			// readiness is up to f, once its listeners are up
+			_ = systemLinux{}.Notify("READY=1")
+			close(serving)
+			<-exit
+			close(stopped)
+		})
+	}()
+	if state := readNotifyForTest(t, conn); state != "READY=1" {
+		t.Fatalf("expected READY=1 of f first, got %q", state)
+	}
+	<-serving
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("send SIGTERM: %v", err)
+	}
+	if state := readNotifyForTest(t, conn); state != "STOPPING=1" {
+		t.Fatalf("expected STOPPING=1, got %q", state)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Run to return after SIGTERM")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected exit to be closed before Run returns")
+	}
+}
+
+func TestKeepAliveNotifiesWatchdogOnlyWhileAlive(t *testing.T) {
+	conn := listenNotifySocketForTest(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	var failing int32 = 1
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		systemLinux{}.KeepAlive(func() error {
+			if atomic.LoadInt32(&failing) == 1 {
+				return errors.New("stuck")
+			}
+			return nil
+		}, stop)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 256)); err == nil {
+		t.Fatalf("expected no watchdog notify while the check fails, got %d bytes", n)
+	}
+	atomic.StoreInt32(&failing, 0)
+	if state := readNotifyForTest(t, conn); state != "WATCHDOG=1" {
+		t.Fatalf("expected WATCHDOG=1 once the check passes, got %q", state)
+	}
+	close(stop)
+	<-done
+}
+
+func TestKeepAliveWithoutWatchdogOfThisProcessReturns(t *testing.T) {
+	for _, env := range []struct{ usec, pid string }{{"", ""}, {"100000", "1"}} {
+		t.Setenv("WATCHDOG_USEC", env.usec)
+		t.Setenv("WATCHDOG_PID", env.pid)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			systemLinux{}.KeepAlive(func() error { return nil }, make(chan struct{}))
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("expected KeepAlive to return without watchdog, env %+v", env)
+		}
+	}
+}
+
+func TestInstallWritesUnitFile(t *testing.T) {
+	previousDir, previousSystemctl := unitDir, systemctl
+	defer func() {
+		unitDir, systemctl = previousDir, previousSystemctl
+		config = Option{}
+	}()
+	unitDir = t.TempDir()
+	var calls []string
+	systemctl = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+	if err := (systemLinux{}).Install(nil); err == nil {
+		t.Fatal("expected install without servicename to fail")
+	}
+	_ = systemLinux{}.Init(Option{Name: "authserver", Description: "connauth server"})
+	if err := (systemLinux{}).Install([]string{"-c", "/etc/connauth/server config.yaml"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(unitDir, "authserver.service"))
+	if err != nil {
+		t.Fatalf("read unit: %v", err)
+	}
+	for _, line := range []string{"Description=connauth server", "Type=notify", "WatchdogSec=30", `-c "/etc/connauth/server config.yaml"`, "WantedBy=multi-user.target"} {
+		if !strings.Contains(string(content), line) {
+			t.Fatalf("unit file misses %q:\n%s", line, content)
+		}
+	}
+	if err := (systemLinux{}).Install(nil); err == nil {
+		t.Fatal("expected installing twice to fail")
+	}
+	if err := (systemLinux{}).Uninstall(); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(unitDir, "authserver.service")); !os.IsNotExist(err) {
+		t.Fatal("expected unit file to be removed")
+	}
+	want := "daemon-reload|enable authserver.service|disable --now authserver.service|daemon-reload"
+	if got := strings.Join(calls, "|"); got != want {
+		t.Fatalf("unexpected systemctl calls %s", got)
+	}
+}
+
+func TestQuoteUnitArgEscapesSpecifiers(t *testing.T) {
+	cases := map[string]string{
+		"/usr/bin/authserver": "/usr/bin/authserver",
+		"100%":                "100%%",
+		"$HOME":               "$$HOME",
+		`a "b"`:               `"a \"b\""`,
+		"":                    `""`,
+	}
+	for arg, want := range cases {
+		if got := quoteUnitArg(arg); got != want {
+			t.Fatalf("quote %q: expected %s, got %s", arg, want, got)
+		}
+	}
+}
@@ -1,11 +1,14 @@
-// +build !windows
+//go:build !windows && !linux
+// +build !windows,!linux
 
 package service
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"syscall"
 )
 
 type systemNoService struct {
@@ -25,14 +28,38 @@ func (s systemNoService) Platform() string {
 
 func (s systemNoService) Run(f func(exit <-chan struct{})) error {
 	exit := make(chan struct{})
-	go f(exit)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(exit)
+	}()
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-	<-signalCh
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signalCh:
+	case <-done:
+	}
 	close(exit)
+	// let f finish its shutdown work before the process exits
+	<-done
 	return nil
 }
 
+func (s systemNoService) Install([]string) error {
+	return fmt.Errorf("install is not supported on %s", runtime.GOOS)
+}
+
+func (s systemNoService) Uninstall() error {
+	return fmt.Errorf("uninstall is not supported on %s", runtime.GOOS)
+}
+
+func (s systemNoService) Notify(string) error {
+	return nil
+}
+
+func (s systemNoService) KeepAlive(func() error, <-chan struct{}) {
+}
+
 func init() {
 	_system = systemNoService{}
 }
@@ -17,6 +17,7 @@ var config Option
 
 type program struct {
 	exit chan struct{}
+	done chan struct{}
 	f    func(exit <-chan struct{})
 }
 
@@ -46,23 +47,28 @@ func (s systemWindows) Platform() string {
 func (sys systemWindows) Run(f func(exit <-chan struct{})) error {
 	if config.Name == "" {
 		exit := make(chan struct{})
-		go f(exit)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f(exit)
+		}()
 		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, os.Interrupt)
-		<-signalCh
+		select {
+		case <-signalCh:
+		case <-done:
+		}
 		close(exit)
+		// let f finish its shutdown work before the process exits
+		<-done
 		return nil
 	}
 	p := &program{
 		exit: make(chan struct{}),
+		done: make(chan struct{}),
 		f:    f,
 	}
-	cfg := &_service.Config{
-		Name:        config.Name,
-		DisplayName: config.DisplayName,
-		Description: config.Description,
-	}
-	s, err := _service.New(p, cfg)
+	s, err := newService(p, nil)
 	if err != nil {
 		return err
 	}
@@ -84,13 +90,52 @@ func (sys systemWindows) Run(f func(exit <-chan struct{})) error {
 	return s.Run()
 }
 
+func (sys systemWindows) Install(args []string) error {
+	s, err := newService(&program{}, args)
+	if err != nil {
+		return err
+	}
+	return s.Install()
+}
+
+func (sys systemWindows) Uninstall() error {
+	s, err := newService(&program{}, nil)
+	if err != nil {
+		return err
+	}
+	return s.Uninstall()
+}
+
+func (sys systemWindows) Notify(string) error {
+	return nil
+}
+
+func (sys systemWindows) KeepAlive(func() error, <-chan struct{}) {
+}
+
+func newService(p *program, args []string) (_service.Service, error) {
+	if config.Name == "" {
+		return nil, errors.New("Name must not be empty")
+	}
+	return _service.New(p, &_service.Config{
+		Name:        config.Name,
+		DisplayName: config.DisplayName,
+		Description: config.Description,
+		Arguments:   args,
+	})
+}
+
 func (p *program) Start(s _service.Service) error {
-	go p.f(p.exit)
+	go func() {
+		defer close(p.done)
+		p.f(p.exit)
+	}()
 	return nil
 }
 
 func (p *program) Stop(s _service.Service) error {
 	close(p.exit)
+	<-p.done
 	return nil
 }
 
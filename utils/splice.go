@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// CloseWriter is a connection that can shut down its write half, like
+// *net.TCPConn
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies data between a and b in both directions and returns the
+// bytes copied from a to b and from b to a. When one direction reaches EOF
+// only the write half of its destination is shut down, so the other
+// direction can still deliver a reply. Both sockets are closed once both
+// directions are done, or as soon as either direction fails.
+func Splice(a net.Conn, b net.Conn) (int64, int64) {
+	var wg sync.WaitGroup
+	var aToB, bToA int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aToB = copyHalf(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		bToA = copyHalf(a, b)
+	}()
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+	return aToB, bToA
+}
+
+func copyHalf(dest net.Conn, source net.Conn) int64 {
+	n, err := io.Copy(dest, source)
+	if err != nil {
+		// reset, timeout or closed: unblock the other direction too
+		_ = source.Close()
+		_ = dest.Close()
+		return n
+	}
+	if cw, ok := dest.(CloseWriter); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dest.Close()
+	}
+	return n
+}
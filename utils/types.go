@@ -7,6 +7,15 @@ type AuthConfig struct {
 	Port      uint16
 	Timestamp int64
 	Nonce     string
+	// OTP reads the totp code sent with Token, nil when the token has no
+	// second factor
+	OTP func() (string, error)
+	// WantTicket asks for the ticket of a forward with requireticket, for
+	// a connection made right after the auth
+	WantTicket bool
+	// BindAddr limits the auth to the forward of Port bound to this IP,
+	// empty for every forward of Port
+	BindAddr string
 }
 
 func (r AuthConfig) IsValid() bool {